@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"gemini-mcp-bash/internal/httpretry"
+	"gemini-mcp-bash/internal/mockllm"
+
+	"github.com/liuzl/ai/gemini"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+type echoArgs struct {
+	Text string `json:"text" jsonschema:"The text to echo."`
+}
+
+func echo(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[echoArgs]) (*mcp.CallToolResultFor[any], error) {
+	return &mcp.CallToolResultFor[any]{Content: []mcp.Content{&mcp.TextContent{Text: "echo: " + params.Arguments.Text}}}, nil
+}
+
+// newTestAgent returns an agent connected to an in-memory MCP server named
+// "test" with an echo tool, talking to the provider configured by env.
+func newTestAgent(t *testing.T, env map[string]string) *Agent {
+	t.Helper()
+	server := mcp.NewServer(&mcp.Implementation{Name: "test", Version: "v1.0.0"}, nil)
+	mcp.AddTool(server, &mcp.Tool{Name: "echo", Description: "Echo the text back."}, echo)
+	return newTestAgentFor(t, env, server)
+}
+
+// newTestAgentFor is newTestAgent with the MCP server provided by the test.
+func newTestAgentFor(t *testing.T, env map[string]string, server *mcp.Server) *Agent {
+	t.Helper()
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+	t.Setenv("MCP_AUDIT_LOG", "off")
+	t.Setenv("AGENT_SESSION_DIR", t.TempDir())
+	ctx := context.Background()
+
+	serverTransport, clientTransport := mcp.NewInMemoryTransports()
+	if _, err := server.Connect(ctx, serverTransport); err != nil {
+		t.Fatalf("server.Connect: %v", err)
+	}
+	pool := newServerPool()
+	info := &serverInfo{name: "test", notify: pool.dispatch}
+	client := mcp.NewClient(clientImplementation, pool.clientOptions())
+	session, err := client.Connect(ctx, &observedTransport{Transport: clientTransport, info: info})
+	if err != nil {
+		t.Fatalf("client.Connect: %v", err)
+	}
+	pool.sessions["test"], pool.infos["test"] = session, info
+	t.Cleanup(pool.Close)
+
+	t.Setenv("LLM_MAX_RETRIES", "0")
+	provider, err := newProvider(httpretry.New(mcpBaseTransport))
+	if err != nil {
+		t.Fatalf("newProvider: %v", err)
+	}
+	agent, err := NewAgent(provider, pool)
+	if err != nil {
+		t.Fatalf("NewAgent: %v", err)
+	}
+	agent.approval = &approvalPolicy{Default: approvalAllow}
+	agent.streaming = env["GEMINI_STREAM"] == "true"
+	if err := agent.discoverCapabilities(ctx); err != nil {
+		t.Fatalf("discoverCapabilities: %v", err)
+	}
+	return agent
+}
+
+// startMock serves fixture and checks when the test ends that every exchange
+// was served as expected.
+func startMock(t *testing.T, fixture *mockllm.Fixture) (*mockllm.Server, string) {
+	t.Helper()
+	mock := mockllm.NewServer(fixture)
+	server := httptest.NewServer(mock)
+	t.Cleanup(func() {
+		server.Close()
+		for _, failure := range mock.Failures() {
+			t.Error(failure)
+		}
+		if n := mock.Remaining(); n > 0 && !t.Failed() {
+			t.Errorf("%d exchange(s) of the fixture were not requested", n)
+		}
+	})
+	return mock, server.URL
+}
+
+// providerCases are the providers the agent loop is tested against, with the
+// name the echo tool has on each wire.
+var providerCases = []struct {
+	name     string
+	api      string
+	echoTool string
+	env      func(url string) map[string]string
+}{
+	{"gemini", mockllm.Gemini, "test.echo", func(url string) map[string]string {
+		return map[string]string{"AI_PROVIDER": "gemini", "GEMINI_BASE_URL": url, "GEMINI_API_KEY": "test", "GEMINI_MODEL": "test-model"}
+	}},
+	{"openai", mockllm.OpenAI, "test__echo", func(url string) map[string]string {
+		return map[string]string{"AI_PROVIDER": "openai", "OPENAI_BASE_URL": url, "OPENAI_API_KEY": "test", "OPENAI_MODEL": "test-model"}
+	}},
+	{"anthropic", mockllm.Anthropic, "test__echo", func(url string) map[string]string {
+		return map[string]string{"AI_PROVIDER": "anthropic", "ANTHROPIC_BASE_URL": url, "ANTHROPIC_API_KEY": "test", "ANTHROPIC_MODEL": "test-model"}
+	}},
+}
+
+func TestAgentLoopCallsTools(t *testing.T) {
+	for _, pc := range providerCases {
+		for _, stream := range []bool{false, true} {
+			name := pc.name
+			if stream {
+				name += "/stream"
+			}
+			t.Run(name, func(t *testing.T) {
+				fixture := &mockllm.Fixture{Exchanges: []mockllm.Exchange{
+					{
+						Expect: mockllm.Expect{
+							API:            pc.api,
+							Model:          "test-model",
+							Stream:         &stream,
+							Messages:       1,
+							Contains:       []string{"say hello"},
+							SystemContains: []string{"helpful"},
+							Tools:          []string{pc.echoTool},
+						},
+						Response: mockllm.Response{
+							Text:          "Calling the tool.",
+							FunctionCalls: []mockllm.FunctionCall{{Name: pc.echoTool, Args: map[string]any{"text": "hello"}}},
+							Usage:         &mockllm.Usage{PromptTokens: 40, CompletionTokens: 5},
+						},
+					},
+					{
+						Expect: mockllm.Expect{
+							Stream:            &stream,
+							Messages:          3,
+							Contains:          []string{"echo: hello"},
+							FunctionResponses: []string{pc.echoTool},
+						},
+						Response: mockllm.Response{
+							Chunks: []string{"The tool ", "said hello."},
+							Usage:  &mockllm.Usage{PromptTokens: 60, CompletionTokens: 4},
+						},
+					},
+				}}
+				_, url := startMock(t, fixture)
+				env := pc.env(url)
+				env["GEMINI_STREAM"] = map[bool]string{false: "false", true: "true"}[stream]
+				agent := newTestAgent(t, env)
+
+				response, err := agent.agentLoop(context.Background(), []gemini.Content{userMessage("say hello")})
+				if err != nil {
+					t.Fatalf("agentLoop: %v", err)
+				}
+				if got := responseText(response); got != "The tool said hello." {
+					t.Errorf("response text = %q, want %q", got, "The tool said hello.")
+				}
+				stats := agent.getStats()
+				if stats.TotalMessages != 4 || stats.FunctionCalls != 1 || stats.FunctionResponses != 1 {
+					t.Errorf("history has %d messages, %d calls, %d responses; want 4, 1, 1",
+						stats.TotalMessages, stats.FunctionCalls, stats.FunctionResponses)
+				}
+				if agent.lastPromptTokens != 60 {
+					t.Errorf("lastPromptTokens = %d, want 60", agent.lastPromptTokens)
+				}
+			})
+		}
+	}
+}
+
+func TestAgentLoopRollsBackFailedTurn(t *testing.T) {
+	fixture := &mockllm.Fixture{Exchanges: []mockllm.Exchange{
+		{Response: mockllm.Response{FunctionCalls: []mockllm.FunctionCall{{Name: "test.echo", Args: map[string]any{"text": "hi"}}}}},
+		{Response: mockllm.Response{Status: 503, Error: "overloaded"}},
+	}}
+	_, url := startMock(t, fixture)
+	agent := newTestAgent(t, providerCases[0].env(url))
+
+	_, err := agent.agentLoop(context.Background(), []gemini.Content{userMessage("hi")})
+	if err == nil || !strings.Contains(err.Error(), "overloaded") {
+		t.Fatalf("agentLoop error = %v, want the provider's error", err)
+	}
+	if len(agent.conversationHistory) != 0 {
+		t.Errorf("history has %d messages after a failed turn, want 0", len(agent.conversationHistory))
+	}
+}
+
+func TestAgentLoopReportsDeniedCalls(t *testing.T) {
+	fixture := &mockllm.Fixture{Exchanges: []mockllm.Exchange{
+		{Response: mockllm.Response{FunctionCalls: []mockllm.FunctionCall{{Name: "test.echo", Args: map[string]any{"text": "secret"}}}}},
+		{
+			Expect:   mockllm.Expect{FunctionResponses: []string{"test.echo"}, Contains: []string{`"denied":true`}},
+			Response: mockllm.Response{Text: "I may not echo that."},
+		},
+	}}
+	mock, url := startMock(t, fixture)
+	agent := newTestAgent(t, providerCases[0].env(url))
+	rule := approvalRule{Tool: "test.*", Args: map[string]string{"text": "secret"}, Action: approvalDeny}
+	if err := rule.compile(); err != nil {
+		t.Fatal(err)
+	}
+	agent.approval.Rules = []approvalRule{rule}
+
+	if _, err := agent.agentLoop(context.Background(), []gemini.Content{userMessage("echo the secret")}); err != nil {
+		t.Fatalf("agentLoop: %v", err)
+	}
+	requests := mock.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("got %d requests, want 2", len(requests))
+	}
+	var response map[string]any
+	json.Unmarshal(requests[1].Messages[2].FunctionResponses[0].Response, &response)
+	if _, ran := response["result"]; ran {
+		t.Errorf("denied call was run: %v", response)
+	}
+}
+
+func TestAgentLoopSeesToolListChanges(t *testing.T) {
+	fixture := &mockllm.Fixture{Exchanges: []mockllm.Exchange{{
+		Expect:   mockllm.Expect{Tools: []string{"test.shout"}},
+		Response: mockllm.Response{Text: "I can shout now."},
+	}}}
+	mock, url := startMock(t, fixture)
+	server := mcp.NewServer(&mcp.Implementation{Name: "test", Version: "v1.0.0"}, nil)
+	mcp.AddTool(server, &mcp.Tool{Name: "echo", Description: "Echo the text back."}, echo)
+	agent := newTestAgentFor(t, providerCases[0].env(url), server)
+
+	mcp.AddTool(server, &mcp.Tool{Name: "shout", Description: "Echo the text back loudly."}, echo)
+	server.RemoveTools("echo")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		agent.servers.mu.Lock()
+		changed := len(agent.servers.changed) > 0
+		agent.servers.mu.Unlock()
+		if changed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no tools/list_changed notification arrived")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := agent.agentLoop(context.Background(), []gemini.Content{userMessage("shout")}); err != nil {
+		t.Fatalf("agentLoop: %v", err)
+	}
+	if _, ok := agent.findTool("test.echo"); ok {
+		t.Error("removed tool test.echo is still registered")
+	}
+	if requests := mock.Requests(); len(requests) == 1 && slices.Contains(requests[0].Tools, "test.echo") {
+		t.Errorf("removed tool test.echo was declared: %v", requests[0].Tools)
+	}
+}
+
+func TestToolCallShowsProgressAndServerLogs(t *testing.T) {
+	output, err := os.CreateTemp(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// shown waits until the agent has printed text.
+	shown := func(text string) (string, bool) {
+		var printed string
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			data, _ := os.ReadFile(output.Name())
+			if printed = string(data); strings.Contains(printed, text) {
+				return printed, true
+			}
+		}
+		return printed, false
+	}
+
+	server := mcp.NewServer(&mcp.Implementation{Name: "test", Version: "v1.0.0"}, nil)
+	mcp.AddTool(server, &mcp.Tool{Name: "work", Description: "Work for a while."},
+		func(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[struct{}]) (*mcp.CallToolResultFor[any], error) {
+			token := params.GetProgressToken()
+			if token == nil {
+				return nil, errors.New("no progress token")
+			}
+			// Notifications are handled concurrently with the result, so
+			// keep the call running until the progress is shown.
+			ss.NotifyProgress(ctx, &mcp.ProgressNotificationParams{ProgressToken: token, Progress: 1, Total: 2, Message: "halfway"})
+			shown("halfway")
+			ss.Log(ctx, &mcp.LoggingMessageParams{Level: "debug", Data: "noise"})
+			ss.Log(ctx, &mcp.LoggingMessageParams{Level: "warning", Logger: "disk", Data: "almost full"})
+			return &mcp.CallToolResultFor[any]{Content: []mcp.Content{&mcp.TextContent{Text: "done"}}}, nil
+		})
+	agent := newTestAgentFor(t, providerCases[0].env("http://unused"), server)
+	agent.servers.handle(notificationProgress, agent.progress.update)
+	agent.servers.handle(notificationLoggingMessage, agent.serverLog)
+	ctx := context.Background()
+	if err := agent.servers.setLogLevel(ctx, "info"); err != nil {
+		t.Fatalf("setLogLevel: %v", err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = output
+	t.Cleanup(func() { os.Stdout = stdout })
+	response, _, err := agent.callMCPTool(ctx, "test.work", nil)
+	if err != nil || response["error"] != nil {
+		t.Fatalf("callMCPTool = %v, %v", response, err)
+	}
+	printed, _ := shown("almost full")
+	for _, want := range []string{"test.work [", "50%", "halfway", "[test/disk] WARNING: almost full"} {
+		if !strings.Contains(printed, want) {
+			t.Errorf("output lacks %q:\n%s", want, printed)
+		}
+	}
+	if strings.Contains(printed, "noise") {
+		t.Errorf("debug message shown at level info:\n%s", printed)
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"iter"
+	"net/http"
+	"os"
+	"strings"
+
+	"gemini-mcp-bash/internal/httpretry"
+
+	"github.com/liuzl/ai/gemini"
+)
+
+// anthropicVersion is the Messages API version the requests are written for.
+const anthropicVersion = "2023-06-01"
+
+// anthropicProvider talks to the Anthropic Messages API, or any endpoint
+// compatible with it, configured with ANTHROPIC_API_KEY, ANTHROPIC_BASE_URL,
+// ANTHROPIC_MODEL and ANTHROPIC_MAX_TOKENS.
+type anthropicProvider struct {
+	client    *http.Client
+	apiKey    string
+	endpoint  string
+	model     string
+	maxTokens int
+}
+
+func newAnthropicProvider(transport http.RoundTripper) *anthropicProvider {
+	baseURL := os.Getenv("ANTHROPIC_BASE_URL")
+	if baseURL == "" {
+		baseURL = "https://api.anthropic.com"
+	}
+	baseURL = strings.TrimSuffix(strings.TrimRight(baseURL, "/"), "/v1")
+	model := os.Getenv("ANTHROPIC_MODEL")
+	if model == "" {
+		model = "claude-sonnet-4-20250514"
+	}
+	return &anthropicProvider{
+		client:    &http.Client{Transport: transport},
+		apiKey:    os.Getenv("ANTHROPIC_API_KEY"),
+		endpoint:  baseURL + "/v1/messages",
+		model:     model,
+		maxTokens: envInt("ANTHROPIC_MAX_TOKENS", 4096),
+	}
+}
+
+func (p *anthropicProvider) Name() string { return "Claude" }
+
+func (p *anthropicProvider) Model() string { return p.model }
+
+// Messages API wire format.
+type anthropicRequest struct {
+	Model     string             `json:"model"`
+	MaxTokens int                `json:"max_tokens"`
+	System    string             `json:"system,omitempty"`
+	Messages  []anthropicMessage `json:"messages"`
+	Tools     []anthropicTool    `json:"tools,omitempty"`
+	Stream    bool               `json:"stream,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string           `json:"role"`
+	Content []anthropicBlock `json:"content"`
+}
+
+// anthropicBlock is a content block: text, image, document, tool_use or
+// tool_result.
+type anthropicBlock struct {
+	Type      string           `json:"type"`
+	Text      string           `json:"text,omitempty"`
+	Source    *anthropicSource `json:"source,omitempty"`
+	ID        string           `json:"id,omitempty"`
+	Name      string           `json:"name,omitempty"`
+	Input     json.RawMessage  `json:"input,omitempty"`
+	ToolUseID string           `json:"tool_use_id,omitempty"`
+	Content   string           `json:"content,omitempty"`
+	IsError   bool             `json:"is_error,omitempty"`
+}
+
+type anthropicSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+type anthropicTool struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	InputSchema map[string]any `json:"input_schema"`
+}
+
+type anthropicUsage struct {
+	InputTokens          int `json:"input_tokens"`
+	OutputTokens         int `json:"output_tokens"`
+	CacheReadInputTokens int `json:"cache_read_input_tokens"`
+}
+
+type anthropicResponse struct {
+	Content    []anthropicBlock `json:"content"`
+	StopReason string           `json:"stop_reason"`
+	Usage      anthropicUsage   `json:"usage"`
+}
+
+// anthropicEvent is one server-sent event of a streamed response.
+type anthropicEvent struct {
+	Type         string             `json:"type"`
+	Index        int                `json:"index"`
+	Message      *anthropicResponse `json:"message"`
+	ContentBlock *anthropicBlock    `json:"content_block"`
+	Delta        struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJSON string `json:"partial_json"`
+		StopReason  string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage *anthropicUsage `json:"usage"`
+	Error *anthropicError `json:"error"`
+}
+
+type anthropicError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// anthropicStopReasons maps Anthropic stop reasons to Gemini finish reasons.
+var anthropicStopReasons = map[string]string{
+	"end_turn":      "STOP",
+	"tool_use":      "STOP",
+	"stop_sequence": "STOP",
+	"max_tokens":    "MAX_TOKENS",
+	"refusal":       "SAFETY",
+}
+
+// anthropicConversation is a Gemini request translated for Anthropic, with
+// the function names it renamed so they can be mapped back.
+type anthropicConversation struct {
+	request *anthropicRequest
+	names   *functionNames
+}
+
+func (p *anthropicProvider) translate(request *gemini.GenerateContentRequest) *anthropicConversation {
+	c := &anthropicConversation{
+		request: &anthropicRequest{Model: p.model, MaxTokens: p.maxTokens},
+		names:   newFunctionNames(),
+	}
+	rename := c.names.rename
+
+	if request.SystemInstruction != nil {
+		c.request.System = contentText(*request.SystemInstruction)
+	}
+	for _, tool := range request.Tools {
+		for _, decl := range tool.FunctionDeclarations {
+			c.request.Tools = append(c.request.Tools, anthropicTool{
+				Name:        rename(decl.Name),
+				Description: decl.Description,
+				InputSchema: jsonSchema(decl.Parameters),
+			})
+		}
+	}
+
+	// Gemini pairs function responses with calls by name and order, Anthropic
+	// by ID, so give every call an ID and hand them out to the responses.
+	callIDs := make(map[string][]string)
+	for i, content := range request.Contents {
+		role := "user"
+		if content.Role != nil && *content.Role == "model" {
+			role = "assistant"
+		}
+		var blocks, results []anthropicBlock
+		for j, part := range content.Parts {
+			switch {
+			case part.FunctionCall != nil:
+				id := fmt.Sprintf("toolu_%d_%d", i, j)
+				callIDs[part.FunctionCall.Name] = append(callIDs[part.FunctionCall.Name], id)
+				input, _ := json.Marshal(part.FunctionCall.Args)
+				if part.FunctionCall.Args == nil {
+					input = []byte("{}")
+				}
+				blocks = append(blocks, anthropicBlock{Type: "tool_use", ID: id, Name: rename(part.FunctionCall.Name), Input: input})
+			case part.FunctionResponse != nil:
+				name := part.FunctionResponse.Name
+				id := fmt.Sprintf("toolu_%d_%d", i, j)
+				if ids := callIDs[name]; len(ids) > 0 {
+					id, callIDs[name] = ids[0], ids[1:]
+				}
+				response, _ := json.Marshal(part.FunctionResponse.Response)
+				_, failed := part.FunctionResponse.Response["error"]
+				results = append(results, anthropicBlock{Type: "tool_result", ToolUseID: id, Content: string(response), IsError: failed})
+			case part.InlineData != nil:
+				blocks = append(blocks, anthropicInlineBlock(part.InlineData))
+			case part.Text != nil && *part.Text != "":
+				blocks = append(blocks, anthropicBlock{Type: "text", Text: *part.Text})
+			}
+		}
+		// Tool results must lead the message that answers the tool calls.
+		blocks = append(results, blocks...)
+		if len(blocks) == 0 {
+			continue
+		}
+		// Roles must alternate, and function responses arrive as their own
+		// message, so merge consecutive messages from the same side.
+		if n := len(c.request.Messages); n > 0 && c.request.Messages[n-1].Role == role {
+			c.request.Messages[n-1].Content = append(c.request.Messages[n-1].Content, blocks...)
+			continue
+		}
+		c.request.Messages = append(c.request.Messages, anthropicMessage{Role: role, Content: blocks})
+	}
+	return c
+}
+
+// anthropicInlineBlock converts inline data into an image or document block,
+// or a note for types Anthropic does not accept.
+func anthropicInlineBlock(blob *gemini.Blob) anthropicBlock {
+	source := &anthropicSource{Type: "base64", MediaType: blob.MimeType, Data: blob.Data}
+	switch {
+	case strings.HasPrefix(blob.MimeType, "image/"):
+		return anthropicBlock{Type: "image", Source: source}
+	case blob.MimeType == "application/pdf":
+		return anthropicBlock{Type: "document", Source: source}
+	default:
+		return anthropicBlock{Type: "text", Text: fmt.Sprintf("[%s attachment omitted: not supported by this provider]", blob.MimeType)}
+	}
+}
+
+// part converts a text or tool_use block of a response into a Gemini part.
+func (c *anthropicConversation) part(block anthropicBlock) (gemini.Part, bool) {
+	switch block.Type {
+	case "text":
+		if block.Text == "" {
+			return gemini.Part{}, false
+		}
+		return gemini.Part{Text: gemini.StringPtr(block.Text)}, true
+	case "tool_use":
+		name := c.names.lookup(block.Name)
+		var args map[string]any
+		if len(block.Input) > 0 {
+			if err := json.Unmarshal(block.Input, &args); err != nil {
+				// Let the tool report what it was given rather than dropping the call.
+				args = map[string]any{"invalid_arguments": string(block.Input)}
+			}
+		}
+		return gemini.Part{FunctionCall: &gemini.FunctionCall{Name: name, Args: args}}, true
+	}
+	return gemini.Part{}, false
+}
+
+func anthropicUsageMetadata(usage anthropicUsage) *gemini.UsageMetadata {
+	return &gemini.UsageMetadata{
+		PromptTokenCount:        usage.InputTokens + usage.CacheReadInputTokens,
+		CachedContentTokenCount: usage.CacheReadInputTokens,
+		CandidatesTokenCount:    usage.OutputTokens,
+		TotalTokenCount:         usage.InputTokens + usage.CacheReadInputTokens + usage.OutputTokens,
+	}
+}
+
+// post sends a Messages API request.
+func (p *anthropicProvider) post(ctx context.Context, request *anthropicRequest) (*http.Response, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request: %v", err)
+	}
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	httpRequest.Header.Set("anthropic-version", anthropicVersion)
+	if p.apiKey != "" {
+		httpRequest.Header.Set("x-api-key", p.apiKey)
+	}
+	httpResponse, err := p.client.Do(httpRequest)
+	if err != nil {
+		return nil, err
+	}
+	if httpResponse.StatusCode >= 400 {
+		defer httpResponse.Body.Close()
+		data, _ := io.ReadAll(httpResponse.Body)
+		return nil, fmt.Errorf("Anthropic API error: %v", httpretry.NewStatusError(httpResponse, data))
+	}
+	return httpResponse, nil
+}
+
+func (p *anthropicProvider) Generate(ctx context.Context, request *gemini.GenerateContentRequest) (*gemini.GenerateContentResponse, error) {
+	conversation := p.translate(request)
+	httpResponse, err := p.post(ctx, conversation.request)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+	var response anthropicResponse
+	if err := json.NewDecoder(httpResponse.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %v", err)
+	}
+
+	content := gemini.Content{Role: gemini.StringPtr("model")}
+	for _, block := range response.Content {
+		if part, ok := conversation.part(block); ok {
+			content.Parts = append(content.Parts, part)
+		}
+	}
+	return &gemini.GenerateContentResponse{
+		Candidates:    []gemini.Candidate{{Content: content, FinishReason: anthropicStopReasons[response.StopReason]}},
+		UsageMetadata: anthropicUsageMetadata(response.Usage),
+	}, nil
+}
+
+// GenerateStream streams text deltas as they arrive. A tool_use block is
+// emitted whole once its input is complete.
+func (p *anthropicProvider) GenerateStream(ctx context.Context, request *gemini.GenerateContentRequest) iter.Seq2[*gemini.GenerateContentResponse, error] {
+	return func(yield func(*gemini.GenerateContentResponse, error) bool) {
+		conversation := p.translate(request)
+		conversation.request.Stream = true
+		httpResponse, err := p.post(ctx, conversation.request)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		defer httpResponse.Body.Close()
+
+		chunk := func(part gemini.Part) *gemini.GenerateContentResponse {
+			return &gemini.GenerateContentResponse{Candidates: []gemini.Candidate{{
+				Content: gemini.Content{Role: gemini.StringPtr("model"), Parts: []gemini.Part{part}},
+			}}}
+		}
+		var usage anthropicUsage
+		blocks := make(map[int]*anthropicBlock)
+		scanner := bufio.NewScanner(httpResponse.Body)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data:")
+			if !ok {
+				continue
+			}
+			var event anthropicEvent
+			if err := json.Unmarshal([]byte(strings.TrimSpace(data)), &event); err != nil {
+				yield(nil, fmt.Errorf("failed to decode stream event: %v", err))
+				return
+			}
+			switch event.Type {
+			case "error":
+				message := "unknown error"
+				if event.Error != nil {
+					message = event.Error.Type + ": " + event.Error.Message
+				}
+				yield(nil, fmt.Errorf("Anthropic API error: %s", message))
+				return
+			case "message_start":
+				if event.Message != nil {
+					usage = event.Message.Usage
+				}
+			case "content_block_start":
+				if event.ContentBlock != nil && event.ContentBlock.Type == "tool_use" {
+					block := *event.ContentBlock
+					block.Input = nil
+					blocks[event.Index] = &block
+				}
+			case "content_block_delta":
+				switch event.Delta.Type {
+				case "text_delta":
+					if event.Delta.Text != "" && !yield(chunk(gemini.Part{Text: gemini.StringPtr(event.Delta.Text)}), nil) {
+						return
+					}
+				case "input_json_delta":
+					if block, ok := blocks[event.Index]; ok {
+						block.Input = append(block.Input, event.Delta.PartialJSON...)
+					}
+				}
+			case "content_block_stop":
+				block, ok := blocks[event.Index]
+				if !ok {
+					continue
+				}
+				delete(blocks, event.Index)
+				if part, ok := conversation.part(*block); ok && !yield(chunk(part), nil) {
+					return
+				}
+			case "message_delta":
+				if event.Usage != nil {
+					usage.OutputTokens = event.Usage.OutputTokens
+				}
+			case "message_stop":
+				yield(&gemini.GenerateContentResponse{UsageMetadata: anthropicUsageMetadata(usage)}, nil)
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			yield(nil, err)
+		}
+	}
+}
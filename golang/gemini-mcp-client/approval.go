@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Approval actions.
+const (
+	approvalAllow = "allow"
+	approvalDeny  = "deny"
+	approvalAsk   = "ask"
+)
+
+// approvalRule matches function calls by tool name and arguments. Tool is a
+// glob on the namespaced name ("shell.*", "*.delete_*", "read_resource");
+// every pattern in Args must match the argument of that name, converted to a
+// string (non-string values as JSON).
+type approvalRule struct {
+	Tool   string            `json:"tool"`
+	Args   map[string]string `json:"args,omitempty"`
+	Action string            `json:"action"`
+
+	args map[string]*regexp.Regexp
+}
+
+// approvalPolicy decides which function calls need a human. It is read from
+// a JSON file such as
+//
+//	{
+//	  "default": "ask",
+//	  "rules": [
+//	    {"tool": "shell.execute_shell", "args": {"cmd": "rm -rf"}, "action": "deny"},
+//	    {"tool": "shell.get_os_info", "action": "allow"},
+//	    {"tool": "shell.execute_shell", "args": {"cmd": "^(ls|pwd|cat)( [^;&|`$<>]*)?$"}, "action": "allow"}
+//	  ]
+//	}
+//
+// The first matching rule wins, so order matters: put deny rules first, and
+// anchor allow patterns at both ends so that "ls; rm -rf /" does not pass as
+// ls. Calls matching no rule get the default action.
+type approvalPolicy struct {
+	Default string         `json:"default"`
+	Rules   []approvalRule `json:"rules"`
+
+	// session holds the tools approved for the rest of the session from the
+	// approval prompt. They take the place of ask rules and the default, but
+	// deny rules still apply. They are forgotten when the conversation is
+	// cleared or another session is loaded.
+	mu      sync.Mutex
+	session []string
+}
+
+// How a function call came to be run or refused, as recorded in the audit log.
+const (
+	decisionAllowed  = "allowed"
+	decisionApproved = "approved"
+	decisionSession  = "approved-session"
+	decisionEdited   = "edited"
+	decisionDenied   = "denied"
+	decisionRejected = "rejected"
+)
+
+// approvalDecision is the outcome of checking a call against the policy.
+type approvalDecision struct {
+	Action string
+	Rule   string
+}
+
+// loadApprovalPolicy reads the policy in MCP_APPROVAL_POLICY (default
+// "mcp_approval.json"). Without that file every call gets defaultAction.
+func loadApprovalPolicy(defaultAction string) (*approvalPolicy, error) {
+	policyPath := os.Getenv("MCP_APPROVAL_POLICY")
+	if policyPath == "" {
+		policyPath = "mcp_approval.json"
+	}
+	policy := &approvalPolicy{}
+	data, err := os.ReadFile(policyPath)
+	switch {
+	case errors.Is(err, os.ErrNotExist) && os.Getenv("MCP_APPROVAL_POLICY") == "":
+	case err != nil:
+		return nil, fmt.Errorf("failed to read approval policy: %v", err)
+	default:
+		if err := json.Unmarshal(data, policy); err != nil {
+			return nil, fmt.Errorf("failed to parse approval policy %s: %v", policyPath, err)
+		}
+	}
+	if policy.Default == "" {
+		policy.Default = defaultAction
+	}
+	if !validApprovalAction(policy.Default) {
+		return nil, fmt.Errorf("invalid default approval action %q, want allow, deny or ask", policy.Default)
+	}
+	for i := range policy.Rules {
+		if err := policy.Rules[i].compile(); err != nil {
+			return nil, fmt.Errorf("approval rule %d: %v", i+1, err)
+		}
+	}
+	return policy, nil
+}
+
+func validApprovalAction(action string) bool {
+	return action == approvalAllow || action == approvalDeny || action == approvalAsk
+}
+
+func (r *approvalRule) compile() error {
+	if !validApprovalAction(r.Action) {
+		return fmt.Errorf("invalid action %q, want allow, deny or ask", r.Action)
+	}
+	if _, err := path.Match(r.Tool, ""); err != nil || r.Tool == "" {
+		return fmt.Errorf("invalid tool pattern %q", r.Tool)
+	}
+	r.args = make(map[string]*regexp.Regexp, len(r.Args))
+	for name, pattern := range r.Args {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern for argument %s: %v", name, err)
+		}
+		r.args[name] = re
+	}
+	return nil
+}
+
+func (r *approvalRule) matches(tool string, args map[string]any) bool {
+	if ok, _ := path.Match(r.Tool, tool); !ok {
+		return false
+	}
+	for name, re := range r.args {
+		value, ok := args[name]
+		if !ok || !re.MatchString(argString(value)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *approvalRule) String() string {
+	var b strings.Builder
+	b.WriteString(r.Tool)
+	names := make([]string, 0, len(r.Args))
+	for name := range r.Args {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, " %s=~/%s/", name, r.Args[name])
+	}
+	return b.String() + " → " + r.Action
+}
+
+func argString(value any) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+// decide checks a call against the first matching rule, or the default. A
+// tool approved for the session is allowed unless that says deny.
+func (p *approvalPolicy) decide(tool string, args map[string]any) approvalDecision {
+	decision := approvalDecision{Action: p.Default, Rule: "default → " + p.Default}
+	for i := range p.Rules {
+		if p.Rules[i].matches(tool, args) {
+			decision = approvalDecision{Action: p.Rules[i].Action, Rule: p.Rules[i].String()}
+			break
+		}
+	}
+	if decision.Action != approvalAsk {
+		return decision
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, approved := range p.session {
+		if approved == tool {
+			return approvalDecision{Action: approvalAllow, Rule: tool + " approved for this session"}
+		}
+	}
+	return decision
+}
+
+func (p *approvalPolicy) approveForSession(tool string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.session = append(p.session, tool)
+}
+
+// resetSession forgets the tools approved for the session. A nil policy has
+// nothing to forget.
+func (p *approvalPolicy) resetSession() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.session = nil
+}
+
+func (p *approvalPolicy) print() {
+	fmt.Printf("\n%s%s=== Tool Approval Policy ===%s\n", ColorBold, ColorCyan, ColorReset)
+	for i := range p.Rules {
+		fmt.Printf("%s%d. %s%s\n", ColorPurple, i+1, p.Rules[i].String(), ColorReset)
+	}
+	p.mu.Lock()
+	for _, tool := range p.session {
+		fmt.Printf("%s•  %s → allow (this session)%s\n", ColorGreen, tool, ColorReset)
+	}
+	p.mu.Unlock()
+	fmt.Printf("%sDefault: %s%s\n", ColorGray, p.Default, ColorReset)
+	fmt.Printf("%s%s=== End Policy ===%s\n\n", ColorBold, ColorCyan, ColorReset)
+}
+
+// approve applies the policy to a function call before it is dispatched. It
+// returns the arguments to call the tool with, possibly edited by the user,
+// or the structured error to report to the model instead of calling it, and
+// how that was decided.
+func (a *Agent) approve(tool string, args map[string]any) (callArgs, refusal map[string]any, outcome string) {
+	edited := false
+	approved := func(outcome string) (map[string]any, map[string]any, string) {
+		if edited {
+			outcome = decisionEdited
+		}
+		return args, nil, outcome
+	}
+	for {
+		decision := a.approval.decide(tool, args)
+		switch decision.Action {
+		case approvalAllow:
+			return approved(decisionAllowed)
+		case approvalDeny:
+			fmt.Printf("%s⛔ Denied call to '%s' (policy: %s)%s\n", ColorRed, tool, decision.Rule, ColorReset)
+			return nil, map[string]any{
+				"error":  "Tool call denied by the client's approval policy",
+				"denied": true,
+				"policy": decision.Rule,
+			}, decisionDenied
+		}
+
+		if a.readLine == nil {
+			return nil, map[string]any{
+				"error":    "Tool call requires approval, but no one is available to approve it",
+				"rejected": true,
+				"policy":   decision.Rule,
+			}, decisionRejected
+		}
+		argsJSON, _ := json.Marshal(args)
+		fmt.Printf("\n%s⚠️  Approval required for '%s' (policy: %s)%s\n", ColorYellow, tool, decision.Rule, ColorReset)
+		fmt.Printf("%s   %s%s\n", ColorWhite, argsJSON, ColorReset)
+		answer, ok := a.readLine(fmt.Sprintf("%s   [a]pprove, [A]pprove '%s' for this session, [e]dit arguments, [r]eject: %s", ColorBold, tool, ColorReset))
+		if !ok {
+			answer = "r"
+		}
+		switch answer {
+		case "a", "y", "yes", "approve":
+			return approved(decisionApproved)
+		case "A":
+			a.approval.approveForSession(tool)
+			return approved(decisionSession)
+		case "e", "edit":
+			line, ok := a.readLine(fmt.Sprintf("%s   New arguments as JSON: %s", ColorBold, ColorReset))
+			if !ok {
+				continue
+			}
+			var newArgs map[string]any
+			if err := json.Unmarshal([]byte(line), &newArgs); err != nil {
+				fmt.Printf("%s   Invalid JSON object: %v%s\n", ColorRed, err, ColorReset)
+				continue
+			}
+			// Check the edited call against the policy again.
+			args, edited = newArgs, true
+		case "r", "n", "no", "reject":
+			reason, _ := a.readLine(fmt.Sprintf("%s   Reason for the model (optional): %s", ColorBold, ColorReset))
+			rejection := map[string]any{
+				"error":    "Tool call rejected by the user",
+				"rejected": true,
+			}
+			if reason != "" {
+				rejection["reason"] = reason
+			}
+			return nil, rejection, decisionRejected
+		default:
+			fmt.Printf("%s   Please answer a, A, e or r.%s\n", ColorGray, ColorReset)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// loadTestPolicy loads an approval policy from the JSON text policy.
+func loadTestPolicy(t *testing.T, policy string) *approvalPolicy {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "mcp_approval.json")
+	if err := os.WriteFile(path, []byte(policy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MCP_APPROVAL_POLICY", path)
+	p, err := loadApprovalPolicy(approvalAsk)
+	if err != nil {
+		t.Fatalf("loadApprovalPolicy: %v", err)
+	}
+	return p
+}
+
+func TestApprovalPolicyDecide(t *testing.T) {
+	const policy = `{
+		"default": "ask",
+		"rules": [
+			{"tool": "shell.get_os_info", "action": "allow"},
+			{"tool": "shell.execute_shell", "args": {"cmd": "rm -rf"}, "action": "deny"},
+			{"tool": "shell.execute_shell", "args": {"cmd": "^(ls|pwd) "}, "action": "allow"},
+			{"tool": "shell.*", "args": {"timeout": "^[0-9]{4,}$"}, "action": "deny"},
+			{"tool": "files.list", "args": {"recursive": "^true$"}, "action": "ask"},
+			{"tool": "files.*", "action": "allow"},
+			{"tool": "*.delete_*", "action": "deny"}
+		]
+	}`
+	tests := []struct {
+		name    string
+		tool    string
+		args    map[string]any
+		session []string
+		want    string
+		rule    string
+	}{
+		{"allow rule", "shell.get_os_info", nil, nil, approvalAllow, "shell.get_os_info → allow"},
+		{"first matching rule wins", "shell.execute_shell", map[string]any{"cmd": "ls && rm -rf /"}, nil, approvalDeny, "shell.execute_shell cmd=~/rm -rf/ → deny"},
+		{"later rule when earlier args do not match", "shell.execute_shell", map[string]any{"cmd": "ls -l"}, nil, approvalAllow, "shell.execute_shell cmd=~/^(ls|pwd) / → allow"},
+		{"missing argument does not match", "shell.execute_shell", map[string]any{}, nil, approvalAsk, "default → ask"},
+		{"number argument matched as JSON", "shell.run", map[string]any{"timeout": 60000.0}, nil, approvalDeny, "shell.* timeout=~/^[0-9]{4,}$/ → deny"},
+		{"short number argument", "shell.run", map[string]any{"timeout": 60.0}, nil, approvalAsk, "default → ask"},
+		{"bool argument matched as JSON", "files.list", map[string]any{"recursive": true}, nil, approvalAsk, "files.list recursive=~/^true$/ → ask"},
+		{"bool argument not matching", "files.list", map[string]any{"recursive": false}, nil, approvalAllow, "files.* → allow"},
+		{"glob on the server", "files.read", nil, nil, approvalAllow, "files.* → allow"},
+		{"glob on the tool", "db.delete_row", nil, nil, approvalDeny, "*.delete_* → deny"},
+		{"default", "db.query", nil, nil, approvalAsk, "default → ask"},
+		{"session approval over the default", "db.query", nil, []string{"db.query"}, approvalAllow, "db.query approved for this session"},
+		{"session approval over an ask rule", "files.list", map[string]any{"recursive": true}, []string{"files.list"}, approvalAllow, "files.list approved for this session"},
+		{"deny rule over session approval", "shell.execute_shell", map[string]any{"cmd": "rm -rf /"}, []string{"shell.execute_shell"}, approvalDeny, "shell.execute_shell cmd=~/rm -rf/ → deny"},
+		{"session approval of another tool", "db.query", nil, []string{"db.insert"}, approvalAsk, "default → ask"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := loadTestPolicy(t, policy)
+			for _, tool := range test.session {
+				p.approveForSession(tool)
+			}
+			got := p.decide(test.tool, test.args)
+			if got.Action != test.want || got.Rule != test.rule {
+				t.Errorf("decide(%s, %v) = %+v, want %s by %q", test.tool, test.args, got, test.want, test.rule)
+			}
+		})
+	}
+}
+
+func TestApprovalPolicyDefaultAction(t *testing.T) {
+	p := loadTestPolicy(t, `{"default": "deny"}`)
+	if got := p.decide("shell.get_os_info", nil); got.Action != approvalDeny {
+		t.Errorf("decide = %+v, want the configured default deny", got)
+	}
+	p.approveForSession("shell.get_os_info")
+	if got := p.decide("shell.get_os_info", nil); got.Action != approvalDeny {
+		t.Errorf("decide = %+v, want a deny default to override session approval", got)
+	}
+
+	p = loadTestPolicy(t, `{"rules": []}`)
+	if p.Default != approvalAsk {
+		t.Errorf("default = %q, want the caller's %q", p.Default, approvalAsk)
+	}
+
+	t.Setenv("MCP_APPROVAL_POLICY", "")
+	t.Chdir(t.TempDir())
+	p, err := loadApprovalPolicy(approvalAllow)
+	if err != nil {
+		t.Fatalf("loadApprovalPolicy without a file: %v", err)
+	}
+	if got := p.decide("anything", nil); got.Action != approvalAllow {
+		t.Errorf("decide = %+v, want allow without a policy file", got)
+	}
+}
+
+func TestApprovalPolicyRejectsInvalidRules(t *testing.T) {
+	for _, policy := range []string{
+		`{"default": "maybe"}`,
+		`{"rules": [{"tool": "shell.*", "action": "sometimes"}]}`,
+		`{"rules": [{"tool": "", "action": "allow"}]}`,
+		`{"rules": [{"tool": "[", "action": "allow"}]}`,
+		`{"rules": [{"tool": "shell.*", "args": {"cmd": "("}, "action": "deny"}]}`,
+	} {
+		path := filepath.Join(t.TempDir(), "mcp_approval.json")
+		if err := os.WriteFile(path, []byte(policy), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("MCP_APPROVAL_POLICY", path)
+		if _, err := loadApprovalPolicy(approvalAsk); err == nil {
+			t.Errorf("loadApprovalPolicy accepted %s", policy)
+		}
+	}
+}
+
+func TestApprovalPolicyDocumentedExample(t *testing.T) {
+	// The example in the approvalPolicy doc comment.
+	p := loadTestPolicy(t, `{
+		"default": "ask",
+		"rules": [
+			{"tool": "shell.execute_shell", "args": {"cmd": "rm -rf"}, "action": "deny"},
+			{"tool": "shell.get_os_info", "action": "allow"},
+			{"tool": "shell.execute_shell", "args": {"cmd": "^(ls|pwd|cat)( [^;&|`+"`"+`$<>]*)?$"}, "action": "allow"}
+		]
+	}`)
+	for cmd, want := range map[string]string{
+		"ls":                approvalAllow,
+		"ls -l /tmp":        approvalAllow,
+		"cat notes.txt":     approvalAllow,
+		"ls ; rm -rf /":     approvalDeny,
+		"ls; rm -r /":       approvalAsk,
+		"cat a && curl x":   approvalAsk,
+		"ls | sh":           approvalAsk,
+		"cat $(whoami)":     approvalAsk,
+		"cat `whoami`":      approvalAsk,
+		"cat a > /etc/motd": approvalAsk,
+		"lsblk":             approvalAsk,
+	} {
+		if got := p.decide("shell.execute_shell", map[string]any{"cmd": cmd}); got.Action != want {
+			t.Errorf("decide(%q) = %+v, want %s", cmd, got, want)
+		}
+	}
+}
+
+func TestSessionApprovalsEndWithTheConversation(t *testing.T) {
+	dir := t.TempDir()
+	saved := newSessionAgent(t, dir)
+	saved.conversationHistory = testHistory("hello")
+	saved.persist()
+
+	agent := newSessionAgent(t, dir)
+	agent.approval = &approvalPolicy{Default: approvalAsk}
+	approved := func() bool { return agent.approval.decide("shell.execute_shell", nil).Action == approvalAllow }
+
+	agent.approval.approveForSession("shell.execute_shell")
+	if !approved() {
+		t.Fatal("session approval did not apply")
+	}
+	if err := agent.clearConversation(); err != nil {
+		t.Fatalf("clear: %v", err)
+	}
+	if approved() {
+		t.Error("session approval survived clear")
+	}
+
+	agent.approval.approveForSession("shell.execute_shell")
+	if err := agent.resumeSession(saved.sessionName, false); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	if approved() {
+		t.Error("session approval survived resuming another session")
+	}
+
+	agent.approval.approveForSession("shell.execute_shell")
+	if err := agent.resumeSession(saved.sessionName, true); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if approved() {
+		t.Error("session approval survived loading another session")
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// auditEntry records one function call the model asked for, whether it ran
+// or was refused.
+type auditEntry struct {
+	Time        time.Time      `json:"time"`
+	Session     string         `json:"session"`
+	Server      string         `json:"server,omitempty"`
+	Tool        string         `json:"tool"`
+	Arguments   map[string]any `json:"arguments"`
+	Decision    string         `json:"decision"`
+	ResultBytes int            `json:"result_bytes"`
+	Error       string         `json:"error,omitempty"`
+	DurationMS  int64          `json:"duration_ms"`
+}
+
+// auditLog appends entries to a JSON lines file. A nil *auditLog records
+// nothing.
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+}
+
+// auditLogPath returns MCP_AUDIT_LOG, defaulting to gemini-mcp-client/audit.jsonl
+// under the user's config directory. "off" disables the log.
+func auditLogPath() string {
+	if path := os.Getenv("MCP_AUDIT_LOG"); path != "" {
+		return path
+	}
+	base, err := os.UserConfigDir()
+	if err != nil {
+		base = os.TempDir()
+	}
+	return filepath.Join(base, "gemini-mcp-client", "audit.jsonl")
+}
+
+func newAuditLog() *auditLog {
+	path := auditLogPath()
+	if path == "off" {
+		return nil
+	}
+	return &auditLog{path: path}
+}
+
+// record appends entry to the log. The file is opened for every entry so
+// that it can be rotated or inspected while the client runs.
+func (l *auditLog) record(entry auditEntry) {
+	if l == nil {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		fmt.Printf("%sWarning: failed to encode audit entry: %v%s\n", ColorYellow, err, ColorReset)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o700); err != nil {
+		fmt.Printf("%sWarning: failed to create audit log directory: %v%s\n", ColorYellow, err, ColorReset)
+		return
+	}
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		fmt.Printf("%sWarning: failed to open audit log: %v%s\n", ColorYellow, err, ColorReset)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		fmt.Printf("%sWarning: failed to write audit log: %v%s\n", ColorYellow, err, ColorReset)
+	}
+}
+
+// toolServer returns the server a function call goes to, if known.
+func (a *Agent) toolServer(name string, args map[string]any) string {
+	if name == readResourceFunction {
+		uri, _ := args["uri"].(string)
+		server, _ := args["server"].(string)
+		server, _ = a.resourceServer(uri, server)
+		return server
+	}
+	if tool, ok := a.findTool(name); ok {
+		return tool.Server
+	}
+	return ""
+}
+
+// auditCall records a function call and its response.
+func (a *Agent) auditCall(name string, args map[string]any, decision string, response map[string]any, elapsed time.Duration) {
+	entry := auditEntry{
+		Time:        time.Now().UTC(),
+		Session:     a.sessionName,
+		Server:      a.toolServer(name, args),
+		Tool:        name,
+		Arguments:   args,
+		Decision:    decision,
+		ResultBytes: jsonSize(response),
+		DurationMS:  elapsed.Milliseconds(),
+	}
+	if message, ok := response["error"]; ok {
+		entry.Error = fmt.Sprint(message)
+	}
+	a.audit.record(entry)
+}
+
+// auditFilter selects entries for the audit subcommand.
+type auditFilter struct {
+	session  string
+	server   string
+	tool     string
+	decision string
+	since    time.Time
+	errors   bool
+}
+
+func (f auditFilter) matches(entry auditEntry) bool {
+	if f.session != "" && entry.Session != f.session {
+		return false
+	}
+	if f.server != "" && entry.Server != f.server {
+		return false
+	}
+	if f.tool != "" {
+		if ok, _ := path.Match(f.tool, entry.Tool); !ok {
+			return false
+		}
+	}
+	if f.decision != "" && entry.Decision != f.decision {
+		return false
+	}
+	if !f.since.IsZero() && entry.Time.Before(f.since) {
+		return false
+	}
+	if f.errors && entry.Error == "" {
+		return false
+	}
+	return true
+}
+
+// parseSince accepts a duration back from now ("2h"), a date ("2025-08-05")
+// or an RFC 3339 time.
+func parseSince(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid -since %q, want a duration like 2h, a date or an RFC 3339 time", value)
+}
+
+// runAuditCommand implements "gemini-mcp-client audit [flags]", which prints
+// the audit log entries matching the flags. It returns the exit code.
+func runAuditCommand(args []string) int {
+	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s audit [flags]\n\nQuery the tool call audit log (env MCP_AUDIT_LOG).\n\n", filepath.Base(os.Args[0]))
+		flags.PrintDefaults()
+	}
+	logPath := flags.String("log", auditLogPath(), "audit log to read")
+	var filter auditFilter
+	flags.StringVar(&filter.session, "session", "", "only calls from this session")
+	flags.StringVar(&filter.server, "server", "", "only calls to this MCP server")
+	flags.StringVar(&filter.tool, "tool", "", "only calls to tools matching this glob, e.g. 'shell.*'")
+	flags.StringVar(&filter.decision, "decision", "", "only calls with this approval decision: allowed, approved, approved-session, edited, denied or rejected")
+	flags.BoolVar(&filter.errors, "errors", false, "only calls that failed or were refused")
+	since := flags.String("since", "", "only calls since a duration ago (2h), a date or an RFC 3339 time")
+	limit := flags.Int("limit", 0, "show only the last n matching calls, 0 for all")
+	asJSON := flags.Bool("json", false, "print matching entries as JSON lines")
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	var err error
+	if filter.since, err = parseSince(*since); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	file, err := os.Open(*logPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open audit log: %v\n", err)
+		return 1
+	}
+	defer file.Close()
+
+	var entries []auditEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			fmt.Fprintf(os.Stderr, "skipping line %d of %s: %v\n", line, *logPath, err)
+			continue
+		}
+		if filter.matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read audit log: %v\n", err)
+		return 1
+	}
+	if *limit > 0 && len(entries) > *limit {
+		entries = entries[len(entries)-*limit:]
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, entry := range entries {
+			encoder.Encode(entry)
+		}
+		return 0
+	}
+	for _, entry := range entries {
+		args, _ := json.Marshal(entry.Arguments)
+		outcome := fmt.Sprintf("%d bytes", entry.ResultBytes)
+		if entry.Error != "" {
+			outcome = "error: " + strings.ReplaceAll(entry.Error, "\n", " ")
+		}
+		fmt.Printf("%s  %-24s %-16s %-30s %6dms  %s  %s\n",
+			entry.Time.Local().Format("2006-01-02 15:04:05"), entry.Session, entry.Decision,
+			entry.Tool, entry.DurationMS, truncate(string(args), 60), truncate(outcome, 80))
+	}
+	fmt.Printf("%d call(s)\n", len(entries))
+	return 0
+}
+
+// truncate shortens s to n characters, marking the cut with "...".
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n-3]) + "..."
+}
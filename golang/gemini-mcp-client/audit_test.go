@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"gemini-mcp-bash/internal/mockllm"
+)
+
+var auditTime = time.Date(2025, 8, 5, 12, 0, 0, 0, time.UTC)
+
+func TestAuditFilterMatches(t *testing.T) {
+	entry := auditEntry{
+		Time:     auditTime,
+		Session:  "20250805-120000-0123abcd",
+		Server:   "shell",
+		Tool:     "shell.execute_shell",
+		Decision: "denied",
+		Error:    "denied by policy",
+	}
+	tests := []struct {
+		name   string
+		filter auditFilter
+		want   bool
+	}{
+		{"no filter", auditFilter{}, true},
+		{"session", auditFilter{session: entry.Session}, true},
+		{"other session", auditFilter{session: "other"}, false},
+		{"server", auditFilter{server: "shell"}, true},
+		{"other server", auditFilter{server: "fs"}, false},
+		{"tool glob", auditFilter{tool: "shell.*"}, true},
+		{"exact tool", auditFilter{tool: "shell.execute_shell"}, true},
+		{"other tool", auditFilter{tool: "fs.*"}, false},
+		{"decision", auditFilter{decision: "denied"}, true},
+		{"other decision", auditFilter{decision: "allowed"}, false},
+		{"since before", auditFilter{since: auditTime.Add(-time.Minute)}, true},
+		{"since the same time", auditFilter{since: auditTime}, true},
+		{"since after", auditFilter{since: auditTime.Add(time.Minute)}, false},
+		{"errors", auditFilter{errors: true}, true},
+		{"all of them", auditFilter{session: entry.Session, server: "shell", tool: "*", decision: "denied", since: auditTime, errors: true}, true},
+		{"all but one", auditFilter{session: entry.Session, server: "shell", tool: "*", decision: "allowed", since: auditTime, errors: true}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.filter.matches(entry); got != test.want {
+				t.Errorf("matches = %v, want %v", got, test.want)
+			}
+		})
+	}
+	if (auditFilter{errors: true}).matches(auditEntry{Tool: "shell.execute_shell"}) {
+		t.Error("-errors matched a call without an error")
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	if got, err := parseSince(""); err != nil || !got.IsZero() {
+		t.Errorf(`parseSince("") = %v, %v, want the zero time`, got, err)
+	}
+	before := time.Now().Add(-2 * time.Hour)
+	got, err := parseSince("2h")
+	if err != nil || got.Before(before) || got.After(time.Now().Add(-2*time.Hour)) {
+		t.Errorf(`parseSince("2h") = %v, %v, want two hours ago`, got, err)
+	}
+	if got, err := parseSince("2025-08-05"); err != nil || !got.Equal(time.Date(2025, 8, 5, 0, 0, 0, 0, time.Local)) {
+		t.Errorf(`parseSince("2025-08-05") = %v, %v, want local midnight`, got, err)
+	}
+	if got, err := parseSince("2025-08-05T12:00:00Z"); err != nil || !got.Equal(auditTime) {
+		t.Errorf(`parseSince(RFC 3339) = %v, %v, want %v`, got, err, auditTime)
+	}
+	for _, value := range []string{"yesterday", "2025-13-01", "12:00"} {
+		if _, err := parseSince(value); err == nil {
+			t.Errorf("parseSince(%q) succeeded", value)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	for _, test := range []struct{ s, want string }{
+		{"short", "short"},
+		{"exactly10!", "exactly10!"},
+		{"one too long", "one too..."},
+		{"日本語のテキストです", "日本語のテキストです"},
+		{"日本語のテキストですね", "日本語のテキス..."},
+	} {
+		got := truncate(test.s, 10)
+		if got != test.want || !utf8.ValidString(got) {
+			t.Errorf("truncate(%q, 10) = %q, want %q", test.s, got, test.want)
+		}
+	}
+}
+
+// writeAuditLog records entries in a new audit log and returns its path.
+func writeAuditLog(t *testing.T, entries ...auditEntry) string {
+	t.Helper()
+	log := &auditLog{path: filepath.Join(t.TempDir(), "audit", "audit.jsonl")}
+	for _, entry := range entries {
+		log.record(entry)
+	}
+	return log.path
+}
+
+// runAudit runs the audit subcommand and returns its exit code and output.
+func runAudit(t *testing.T, args ...string) (int, string) {
+	t.Helper()
+	var code int
+	output := mockllm.RunMain(t, func() { code = runAuditCommand(args) }, "")
+	return code, output
+}
+
+func TestRunAuditCommand(t *testing.T) {
+	session := "20250805-120000-0123abcd"
+	path := writeAuditLog(t,
+		auditEntry{Time: auditTime, Session: session, Server: "shell", Tool: "shell.execute_shell", Arguments: map[string]any{"cmd": "ls"}, Decision: "allowed", ResultBytes: 42, DurationMS: 7},
+		auditEntry{Time: auditTime.Add(time.Minute), Session: session, Server: "fs", Tool: "fs.read_file", Arguments: map[string]any{"path": strings.Repeat("路径", 40)}, Decision: "denied", Error: "denied\nby policy"},
+		auditEntry{Time: auditTime.Add(2 * time.Minute), Session: "other", Server: "shell", Tool: "shell.get_os_info", Decision: "approved"},
+	)
+	if file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0); err != nil {
+		t.Fatal(err)
+	} else {
+		file.WriteString("not json\n")
+		file.Close()
+	}
+
+	code, output := runAudit(t, "-log", path)
+	lines := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+	if code != 0 || len(lines) != 4 || lines[3] != "3 call(s)" {
+		t.Fatalf("audit = %d with output:\n%s\nwant 3 calls", code, output)
+	}
+	// Full session names fit their column, so the columns line up.
+	if !strings.Contains(lines[0], "  "+session+" allowed ") || strings.Index(lines[0], "allowed") != strings.Index(lines[2], "approved") {
+		t.Errorf("columns do not line up:\n%s", output)
+	}
+	if !strings.Contains(lines[0], `{"cmd":"ls"}  42 bytes`) {
+		t.Errorf("first call shows %q, want its arguments and result size", lines[0])
+	}
+	if !utf8.ValidString(lines[1]) || !strings.Contains(lines[1], "...  error: denied by policy") {
+		t.Errorf("second call shows %q, want shortened arguments and the error on one line", lines[1])
+	}
+
+	for _, test := range []struct {
+		args  []string
+		tools []string
+	}{
+		{[]string{"-session", session}, []string{"shell.execute_shell", "fs.read_file"}},
+		{[]string{"-tool", "shell.*"}, []string{"shell.execute_shell", "shell.get_os_info"}},
+		{[]string{"-errors"}, []string{"fs.read_file"}},
+		{[]string{"-since", "2025-08-05T12:01:00Z"}, []string{"fs.read_file", "shell.get_os_info"}},
+		{[]string{"-limit", "1"}, []string{"shell.get_os_info"}},
+		{[]string{"-decision", "edited"}, nil},
+	} {
+		args := append([]string{"-log", path, "-json"}, test.args...)
+		code, output := runAudit(t, args...)
+		var tools []string
+		for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+			if line == "" {
+				continue
+			}
+			var entry auditEntry
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("audit %q printed %q: %v", test.args, line, err)
+			}
+			tools = append(tools, entry.Tool)
+		}
+		if code != 0 || strings.Join(tools, " ") != strings.Join(test.tools, " ") {
+			t.Errorf("audit %q = %d, %q, want %q", test.args, code, tools, test.tools)
+		}
+	}
+
+	if code, _ := runAudit(t, "-log", path, "-since", "soon"); code != 2 {
+		t.Errorf("audit with an invalid -since = %d, want 2", code)
+	}
+	if code, _ := runAudit(t, "-log", filepath.Join(t.TempDir(), "missing.jsonl")); code != 1 {
+		t.Errorf("audit of a missing log = %d, want 1", code)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/liuzl/ai/gemini"
+)
+
+// Exit codes of the client, so that scripts can tell what went wrong.
+const (
+	exitOK = 0
+	// exitFailed means the turn failed, or every prompt of a batch did.
+	exitFailed = 1
+	// exitUsage means the flags or the configuration are invalid.
+	exitUsage = 2
+	// exitPartial means some prompts of a batch failed.
+	exitPartial = 3
+	// exitTimeout means a one-shot turn ran out of time, as timeout(1) reports.
+	exitTimeout = 124
+	// exitInterrupted means the client was stopped by a signal.
+	exitInterrupted = 130
+)
+
+// batchItem is one line of a batch file. The prompt is taken from "prompt",
+// or else built from "title" and "body" so that backlog files such as
+// requests.jsonl can be fed as they are.
+type batchItem struct {
+	ID        string `json:"id"`
+	RequestID string `json:"request_id"`
+	Prompt    string `json:"prompt"`
+	Title     string `json:"title"`
+	Body      string `json:"body"`
+}
+
+// batchResult is written as one line of JSON for every prompt of a batch.
+type batchResult struct {
+	ID         string `json:"id"`
+	Line       int    `json:"line"`
+	Status     string `json:"status"`
+	Response   string `json:"response,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Session    string `json:"session,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// Statuses of a batch result.
+const (
+	batchOK      = "ok"
+	batchError   = "error"
+	batchTimeout = "timeout"
+)
+
+func (item batchItem) id(line int) string {
+	switch {
+	case item.ID != "":
+		return item.ID
+	case item.RequestID != "":
+		return item.RequestID
+	}
+	return fmt.Sprintf("line-%d", line)
+}
+
+func (item batchItem) prompt() string {
+	if item.Prompt != "" {
+		return item.Prompt
+	}
+	return strings.TrimSpace(item.Title + "\n\n" + item.Body)
+}
+
+// responseText returns the text of a model response.
+func responseText(response *gemini.GenerateContentResponse) string {
+	var b strings.Builder
+	for _, candidate := range response.Candidates {
+		for _, part := range candidate.Content.Parts {
+			if part.Text != nil {
+				b.WriteString(*part.Text)
+			}
+		}
+	}
+	return b.String()
+}
+
+// promptTurn runs a turn for a non-interactive prompt and returns the answer,
+// or an error and the exit code that describes it.
+func promptTurn(ctx context.Context, agent *Agent, turns *turnController, prompt string) (string, int, error) {
+	turnCtx, endTurn := turns.begin(ctx)
+	response, err := agent.agentLoop(turnCtx, []gemini.Content{userMessage(prompt)})
+	turnErr := turnCtx.Err()
+	endTurn()
+	code := exitFailed
+	switch {
+	case err == nil:
+		agent.persist()
+		answer := responseText(response)
+		agent.events.finish(answer, agent.sessionName, nil)
+		return answer, exitOK, nil
+	case errors.Is(turnErr, context.DeadlineExceeded):
+		code, err = exitTimeout, fmt.Errorf("turn timed out after %v", turns.timeout)
+	case errors.Is(turnErr, context.Canceled):
+		code, err = exitInterrupted, errors.New("turn cancelled")
+	}
+	agent.events.finish("", agent.sessionName, err)
+	return "", code, err
+}
+
+// runOneShot answers a single prompt, writing the answer to results. A prompt
+// of "-" is read from stdin.
+func runOneShot(ctx context.Context, agent *Agent, turns *turnController, prompt string, results io.Writer) int {
+	if prompt == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Printf("%sError: failed to read the prompt: %v%s\n", ColorRed, err, ColorReset)
+			return exitUsage
+		}
+		prompt = string(data)
+	}
+	if strings.TrimSpace(prompt) == "" {
+		fmt.Printf("%sError: the prompt is empty%s\n", ColorRed, ColorReset)
+		return exitUsage
+	}
+	answer, code, err := promptTurn(ctx, agent, turns, prompt)
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", ColorRed, err, ColorReset)
+		return code
+	}
+	if agent.events == nil {
+		// The JSON formats have already written the answer.
+		fmt.Fprintln(results, answer)
+	}
+	return exitOK
+}
+
+// runBatch answers every prompt of a JSONL file ("-" for stdin), each in a
+// fresh conversation, and writes a batchResult line per prompt to results.
+// Prompts that fail are reported and the batch goes on; an interrupt stops it.
+func runBatch(ctx context.Context, agent *Agent, turns *turnController, path string, results io.Writer) int {
+	input := os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Printf("%sError: failed to open batch file: %v%s\n", ColorRed, err, ColorReset)
+			return exitUsage
+		}
+		defer f.Close()
+		input = f
+	}
+
+	batchName, err := agent.sessions.newName()
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", ColorRed, err, ColorReset)
+		return exitFailed
+	}
+	encoder := json.NewEncoder(results)
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	line, total, failed := 0, 0, 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		total++
+		var item batchItem
+		result := batchResult{Line: line, Status: batchError}
+		if err := json.Unmarshal([]byte(text), &item); err != nil {
+			result.ID = item.id(line)
+			result.Error = fmt.Sprintf("invalid batch line: %v", err)
+		} else if result.ID = item.id(line); item.prompt() == "" {
+			result.Error = "the prompt is empty"
+		} else {
+			fmt.Printf("%s--- Batch prompt %s (line %d) ---%s\n", ColorBold, result.ID, line, ColorReset)
+			agent.resetConversation()
+			if name := batchName + "-" + result.ID; sessionNamePattern.MatchString(name) {
+				agent.sessionName = name
+			} else {
+				agent.sessionName = fmt.Sprintf("%s-%d", batchName, line)
+			}
+			start := time.Now()
+			answer, code, err := promptTurn(ctx, agent, turns, item.prompt())
+			result.DurationMS = time.Since(start).Milliseconds()
+			switch {
+			case err == nil:
+				result.Status, result.Response, result.Session = batchOK, answer, agent.sessionName
+			case code == exitTimeout:
+				result.Status, result.Error = batchTimeout, strings.TrimSpace(err.Error())
+			default:
+				result.Error = strings.TrimSpace(err.Error())
+			}
+			if code == exitInterrupted {
+				encoder.Encode(result)
+				fmt.Printf("%sBatch interrupted at line %d.%s\n", ColorYellow, line, ColorReset)
+				return exitInterrupted
+			}
+		}
+		if result.Status != batchOK {
+			failed++
+			fmt.Printf("%sPrompt %s failed: %s%s\n", ColorRed, result.ID, result.Error, ColorReset)
+		}
+		if err := encoder.Encode(result); err != nil {
+			fmt.Printf("%sError: failed to write result: %v%s\n", ColorRed, err, ColorReset)
+			return exitFailed
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Printf("%sError: failed to read batch file: %v%s\n", ColorRed, err, ColorReset)
+		return exitFailed
+	}
+
+	fmt.Printf("%sBatch finished: %d prompt(s), %d failed.%s\n", ColorBold, total, failed, ColorReset)
+	switch {
+	case failed == 0:
+		return exitOK
+	case failed < total:
+		return exitPartial
+	}
+	return exitFailed
+}
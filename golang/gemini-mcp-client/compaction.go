@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/liuzl/ai/gemini"
+)
+
+// Compaction strategies, tried in this order until the history fits the
+// context budget.
+const (
+	compactTruncate  = "truncate"
+	compactSummarize = "summarize"
+	compactDrop      = "drop"
+)
+
+const (
+	// compactedMarker starts every message that compaction writes, so it
+	// stands out in the history.
+	compactedMarker = "[Compacted]"
+	// truncatedResponseChars is how much of an old tool response survives
+	// truncation.
+	truncatedResponseChars = 300
+	// summaryKeepTurns is how many recent turns summarization leaves intact.
+	summaryKeepTurns = 2
+	// inlineDataTokens approximates what Gemini charges for an image or other
+	// inline part.
+	inlineDataTokens = 258
+)
+
+// parseCompaction validates a comma separated list of compaction strategies.
+func parseCompaction(value string) ([]string, error) {
+	var strategies []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		switch name {
+		case "":
+		case compactTruncate, compactSummarize, compactDrop:
+			strategies = append(strategies, name)
+		default:
+			return nil, fmt.Errorf("unknown compaction strategy %q, want %s, %s or %s", name, compactTruncate, compactSummarize, compactDrop)
+		}
+	}
+	return strategies, nil
+}
+
+// estimateTokens roughly counts the tokens of contents at four bytes per
+// token, the usual rule of thumb for English text and JSON.
+func estimateTokens(contents []gemini.Content) int {
+	var bytes, inline int
+	for _, content := range contents {
+		for _, part := range content.Parts {
+			switch {
+			case part.Text != nil:
+				bytes += len(*part.Text)
+			case part.FunctionCall != nil:
+				bytes += jsonSize(part.FunctionCall)
+			case part.FunctionResponse != nil:
+				bytes += jsonSize(part.FunctionResponse)
+			case part.InlineData != nil:
+				inline++
+			}
+		}
+	}
+	return bytes/4 + inline*inlineDataTokens
+}
+
+func jsonSize(v any) int {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return 0
+	}
+	return len(data)
+}
+
+// requestOverhead estimates the tokens a request spends besides its contents.
+func requestOverhead(request *gemini.GenerateContentRequest) int {
+	tokens := jsonSize(request.Tools) / 4
+	if request.SystemInstruction != nil {
+		tokens += estimateTokens([]gemini.Content{*request.SystemInstruction})
+	}
+	return tokens
+}
+
+// contextTokens estimates the prompt tokens of base carrying the current
+// history, scaled by how far off earlier estimates were from the counts
+// Gemini reported.
+func (a *Agent) contextTokens(base *gemini.GenerateContentRequest) int {
+	raw := estimateTokens(a.conversationHistory) + requestOverhead(base)
+	return int(float64(raw) * a.tokenScale)
+}
+
+// recordUsage calibrates token estimates against the prompt token count
+// Gemini reported for request, and reports the usage as an event.
+func (a *Agent) recordUsage(request *gemini.GenerateContentRequest, response *gemini.GenerateContentResponse) {
+	a.usage.record(response.UsageMetadata)
+	a.events.tokens(response.UsageMetadata)
+	if response.UsageMetadata == nil || response.UsageMetadata.PromptTokenCount == 0 {
+		return
+	}
+	a.lastPromptTokens = response.UsageMetadata.PromptTokenCount
+	raw := estimateTokens(request.Contents) + requestOverhead(request)
+	if raw > 0 {
+		a.tokenScale = min(max(float64(a.lastPromptTokens)/float64(raw), 0.25), 4)
+	}
+}
+
+// fitContext compacts the history before a request until it fits the context
+// budget. Messages from turnStart on belong to the turn in progress and are
+// only ever truncated; turnStart is moved along when earlier messages go.
+func (a *Agent) fitContext(ctx context.Context, base *gemini.GenerateContentRequest, turnStart *int) {
+	if a.contextBudget <= 0 {
+		return
+	}
+	before := a.contextTokens(base)
+	if before <= a.contextBudget {
+		return
+	}
+	for _, strategy := range a.compaction {
+		var event string
+		switch strategy {
+		case compactTruncate:
+			event = a.truncateToolResponses(base)
+		case compactSummarize:
+			event = a.summarizeTurns(ctx, turnStart)
+		case compactDrop:
+			event = a.dropTurns(base, turnStart)
+		}
+		if event == "" {
+			continue
+		}
+		after := a.contextTokens(base)
+		event = fmt.Sprintf("%s (≈%d → ≈%d tokens)", event, before, after)
+		a.compactions = append(a.compactions, event)
+		fmt.Printf("\n%s🗜️  Compacted history: %s%s\n", ColorYellow, event, ColorReset)
+		before = after
+		if after <= a.contextBudget {
+			return
+		}
+	}
+	fmt.Printf("\n%sWarning: History still needs ≈%d tokens, over the budget of %d.%s\n", ColorYellow, before, a.contextBudget, ColorReset)
+}
+
+// truncateToolResponses shortens tool responses and drops inline data, oldest
+// first, sparing the newest message.
+func (a *Agent) truncateToolResponses(base *gemini.GenerateContentRequest) string {
+	var truncated int
+	for i := 0; i < len(a.conversationHistory)-1 && a.contextTokens(base) > a.contextBudget; i++ {
+		content := a.conversationHistory[i]
+		parts := slices.Clone(content.Parts)
+		changed := false
+		for j, part := range parts {
+			switch {
+			case part.FunctionResponse != nil && part.FunctionResponse.Response["compacted"] == nil:
+				data, _ := json.Marshal(part.FunctionResponse.Response)
+				if len(data) <= truncatedResponseChars {
+					continue
+				}
+				// Cut at the start of a character, not in the middle of one.
+				cut := truncatedResponseChars
+				for cut > 0 && !utf8.RuneStart(data[cut]) {
+					cut--
+				}
+				parts[j] = gemini.Part{FunctionResponse: &gemini.FunctionResponse{
+					Name: part.FunctionResponse.Name,
+					Response: map[string]any{
+						"compacted": true,
+						"excerpt":   string(data[:cut]) + "...",
+						"note":      fmt.Sprintf("%s Truncated from %d bytes to fit the context window.", compactedMarker, len(data)),
+					},
+				}}
+			case part.InlineData != nil:
+				parts[j] = gemini.Part{Text: gemini.StringPtr(fmt.Sprintf("%s %s inline data removed to fit the context window.", compactedMarker, part.InlineData.MimeType))}
+			default:
+				continue
+			}
+			changed = true
+			truncated++
+		}
+		if changed {
+			a.conversationHistory[i].Parts = parts
+		}
+	}
+	if truncated == 0 {
+		return ""
+	}
+	return fmt.Sprintf("truncated %d old tool response(s) and attachment(s)", truncated)
+}
+
+// turnStarts returns the indexes of the user messages that begin turns.
+func (a *Agent) turnStarts() []int {
+	var starts []int
+	for i, content := range a.conversationHistory {
+		if content.Role == nil || *content.Role != "user" {
+			continue
+		}
+		for _, part := range content.Parts {
+			if part.Text != nil {
+				starts = append(starts, i)
+				break
+			}
+		}
+	}
+	return starts
+}
+
+// summarizeTurns asks the model to summarize all but the last few complete
+// turns, and replaces them with the summary.
+func (a *Agent) summarizeTurns(ctx context.Context, turnStart *int) string {
+	var starts []int
+	for _, start := range a.turnStarts() {
+		if start < *turnStart {
+			starts = append(starts, start)
+		}
+	}
+	if len(starts) <= summaryKeepTurns {
+		return ""
+	}
+	end := starts[len(starts)-summaryKeepTurns]
+	old := a.conversationHistory[:end]
+
+	request := &gemini.GenerateContentRequest{Contents: []gemini.Content{{
+		Role: gemini.StringPtr("user"),
+		Parts: []gemini.Part{{Text: gemini.StringPtr(
+			"Summarize the following conversation between a user and an AI assistant that uses tools. " +
+				"Keep every fact, decision, file name, command and result that later turns may rely on, and note open questions. " +
+				"Reply with the summary only.\n\n" + transcript(old))}},
+	}}}
+	response, err := a.provider.Generate(ctx, request)
+	if err == nil {
+		a.usage.record(response.UsageMetadata)
+	}
+	if err != nil || len(response.Candidates) == 0 {
+		fmt.Printf("\n%sWarning: Failed to summarize earlier turns: %v%s\n", ColorYellow, err, ColorReset)
+		return ""
+	}
+	var summary strings.Builder
+	for _, part := range response.Candidates[0].Content.Parts {
+		if part.Text != nil {
+			summary.WriteString(*part.Text)
+		}
+	}
+	if strings.TrimSpace(summary.String()) == "" {
+		return ""
+	}
+
+	summaryMessage := gemini.Content{
+		Role: gemini.StringPtr("user"),
+		Parts: []gemini.Part{{Text: gemini.StringPtr(fmt.Sprintf("%s Summary of %d earlier messages:\n%s",
+			compactedMarker, len(old), summary.String()))}},
+	}
+	a.replaceHistory(0, end, []gemini.Content{summaryMessage}, turnStart)
+	return fmt.Sprintf("summarized %d earlier message(s)", len(old))
+}
+
+// dropTurns removes the oldest complete turns.
+func (a *Agent) dropTurns(base *gemini.GenerateContentRequest, turnStart *int) string {
+	var dropped int
+	for a.contextTokens(base) > a.contextBudget {
+		starts := a.turnStarts()
+		first := 0
+		if len(starts) > 0 && isDropNote(a.conversationHistory[starts[0]]) {
+			// Keep the note about earlier drops in front.
+			first = starts[0] + 1
+			starts = starts[1:]
+		}
+		if len(starts) < 2 || starts[1] > *turnStart {
+			break
+		}
+		end := starts[1]
+		dropped += end - first
+		a.replaceHistory(first, end, nil, turnStart)
+	}
+	if dropped == 0 {
+		return ""
+	}
+
+	// Tell the model that something came before, keeping one running note.
+	a.droppedMessages += dropped
+	replace := 0
+	if len(a.conversationHistory) > 0 && isDropNote(a.conversationHistory[0]) {
+		replace = 1
+	}
+	a.replaceHistory(0, replace, []gemini.Content{dropNote(a.droppedMessages)}, turnStart)
+	return fmt.Sprintf("dropped %d oldest message(s)", dropped)
+}
+
+const dropNoteSuffix = "earlier messages were dropped to fit the context window."
+
+func dropNote(dropped int) gemini.Content {
+	return gemini.Content{
+		Role:  gemini.StringPtr("user"),
+		Parts: []gemini.Part{{Text: gemini.StringPtr(fmt.Sprintf("%s %d %s", compactedMarker, dropped, dropNoteSuffix))}},
+	}
+}
+
+func isDropNote(content gemini.Content) bool {
+	return len(content.Parts) == 1 && content.Parts[0].Text != nil &&
+		strings.HasPrefix(*content.Parts[0].Text, compactedMarker) &&
+		strings.HasSuffix(*content.Parts[0].Text, dropNoteSuffix)
+}
+
+// droppedBefore returns how many messages the drop note in front of history
+// says were dropped, so a resumed session keeps counting from there.
+func droppedBefore(history []gemini.Content) int {
+	if len(history) == 0 || !isDropNote(history[0]) {
+		return 0
+	}
+	count, _, _ := strings.Cut(strings.TrimPrefix(*history[0].Parts[0].Text, compactedMarker+" "), " ")
+	dropped, _ := strconv.Atoi(count)
+	return dropped
+}
+
+// replaceHistory replaces the messages in [from, to) and keeps turnStart
+// pointing at the same message.
+func (a *Agent) replaceHistory(from, to int, with []gemini.Content, turnStart *int) {
+	history := slices.Clone(a.conversationHistory[:from])
+	history = append(history, with...)
+	history = append(history, a.conversationHistory[to:]...)
+	a.conversationHistory = history
+	if *turnStart >= to {
+		*turnStart += len(with) - (to - from)
+	}
+}
+
+// transcript renders messages as plain text for the summarization request.
+func transcript(contents []gemini.Content) string {
+	var b strings.Builder
+	for _, content := range contents {
+		role := "unknown"
+		if content.Role != nil {
+			role = *content.Role
+		}
+		for _, part := range content.Parts {
+			switch {
+			case part.Text != nil:
+				fmt.Fprintf(&b, "%s: %s\n", role, *part.Text)
+			case part.FunctionCall != nil:
+				args, _ := json.Marshal(part.FunctionCall.Args)
+				fmt.Fprintf(&b, "%s called %s(%s)\n", role, part.FunctionCall.Name, args)
+			case part.FunctionResponse != nil:
+				response, _ := json.Marshal(part.FunctionResponse.Response)
+				if len(response) > 2000 {
+					response = append(response[:2000], "..."...)
+				}
+				fmt.Fprintf(&b, "%s returned from %s: %s\n", role, part.FunctionResponse.Name, response)
+			case part.InlineData != nil:
+				fmt.Fprintf(&b, "%s attached %s data\n", role, part.InlineData.MimeType)
+			}
+		}
+	}
+	return b.String()
+}
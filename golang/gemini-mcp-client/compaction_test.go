@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/liuzl/ai/gemini"
+)
+
+// stubProvider answers every request with reply, or fails with err.
+type stubProvider struct {
+	reply    string
+	err      error
+	requests []*gemini.GenerateContentRequest
+}
+
+func (p *stubProvider) Name() string  { return "Stub" }
+func (p *stubProvider) Model() string { return "stub-model" }
+
+func (p *stubProvider) Generate(ctx context.Context, request *gemini.GenerateContentRequest) (*gemini.GenerateContentResponse, error) {
+	p.requests = append(p.requests, request)
+	if p.err != nil {
+		return nil, p.err
+	}
+	return &gemini.GenerateContentResponse{Candidates: []gemini.Candidate{{
+		Content: gemini.Content{Role: gemini.StringPtr("model"), Parts: []gemini.Part{{Text: gemini.StringPtr(p.reply)}}},
+	}}}, nil
+}
+
+func (p *stubProvider) GenerateStream(ctx context.Context, request *gemini.GenerateContentRequest) iter.Seq2[*gemini.GenerateContentResponse, error] {
+	return func(yield func(*gemini.GenerateContentResponse, error) bool) {
+		yield(p.Generate(ctx, request))
+	}
+}
+
+func newCompactionAgent(t *testing.T, provider Provider, history []gemini.Content) *Agent {
+	t.Helper()
+	t.Setenv("AGENT_SESSION_DIR", t.TempDir())
+	t.Setenv("MCP_AUDIT_LOG", "off")
+	agent, err := NewAgent(provider, newServerPool())
+	if err != nil {
+		t.Fatalf("NewAgent: %v", err)
+	}
+	agent.conversationHistory = history
+	return agent
+}
+
+// testTurn is a complete turn: a prompt, a tool call with a response of
+// responseBytes bytes, and the answer.
+func testTurn(prompt string, responseBytes int) []gemini.Content {
+	return []gemini.Content{
+		userMessage(prompt),
+		{Role: gemini.StringPtr("model"), Parts: []gemini.Part{{FunctionCall: &gemini.FunctionCall{Name: "test.read", Args: map[string]any{"name": prompt}}}}},
+		{Role: gemini.StringPtr("user"), Parts: []gemini.Part{{FunctionResponse: &gemini.FunctionResponse{
+			Name: "test.read", Response: map[string]any{"content": strings.Repeat("x", responseBytes)},
+		}}}},
+		{Role: gemini.StringPtr("model"), Parts: []gemini.Part{{Text: gemini.StringPtr("answer to " + prompt)}}},
+	}
+}
+
+func testTurns(prompts ...string) []gemini.Content {
+	var history []gemini.Content
+	for _, prompt := range prompts {
+		history = append(history, testTurn(prompt, 100)...)
+	}
+	return history
+}
+
+// describe renders a history as one short line per message.
+func describe(history []gemini.Content) []string {
+	var lines []string
+	for _, content := range history {
+		var parts []string
+		for _, part := range content.Parts {
+			switch {
+			case part.Text != nil:
+				text, _, _ := strings.Cut(*part.Text, "\n")
+				parts = append(parts, text)
+			case part.FunctionCall != nil:
+				parts = append(parts, "call "+part.FunctionCall.Name)
+			case part.FunctionResponse != nil && part.FunctionResponse.Response["compacted"] != nil:
+				parts = append(parts, "truncated "+part.FunctionResponse.Name)
+			case part.FunctionResponse != nil:
+				parts = append(parts, "response "+part.FunctionResponse.Name)
+			case part.InlineData != nil:
+				parts = append(parts, "inline "+part.InlineData.MimeType)
+			}
+		}
+		role := "?"
+		if content.Role != nil {
+			role = *content.Role
+		}
+		lines = append(lines, role+": "+strings.Join(parts, ", "))
+	}
+	return lines
+}
+
+// budgetFor returns the context budget that history just fits in.
+func budgetFor(agent *Agent, base *gemini.GenerateContentRequest, history []gemini.Content) int {
+	saved := agent.conversationHistory
+	agent.conversationHistory = history
+	defer func() { agent.conversationHistory = saved }()
+	return agent.contextTokens(base)
+}
+
+func TestTruncateToolResponses(t *testing.T) {
+	image := gemini.Content{Role: gemini.StringPtr("user"), Parts: []gemini.Part{
+		{InlineData: &gemini.Blob{MimeType: "image/png", Data: "aGVsbG8="}},
+		{Text: gemini.StringPtr("what is this?")},
+	}}
+	history := func() []gemini.Content {
+		var h []gemini.Content
+		h = append(h, testTurn("a", 5000)...)
+		h = append(h, testTurn("b", 100)...)
+		h = append(h, image)
+		h = append(h, testTurn("c", 5000)[1:3]...)
+		return h
+	}
+	base := &gemini.GenerateContentRequest{}
+	tests := []struct {
+		name   string
+		budget func(agent *Agent) int
+		want   []string
+		event  string
+	}{
+		{
+			name:   "everything but the newest message",
+			budget: func(*Agent) int { return 1 },
+			want: []string{
+				"user: a", "model: call test.read", "user: truncated test.read", "model: answer to a",
+				"user: b", "model: call test.read", "user: response test.read", "model: answer to b",
+				"user: [Compacted] image/png inline data removed to fit the context window., what is this?",
+				"model: call test.read", "user: response test.read",
+			},
+			event: "truncated 2 old tool response(s) and attachment(s)",
+		},
+		{
+			name:   "oldest first until it fits",
+			budget: func(agent *Agent) int { return agent.contextTokens(base) - 1 },
+			want: []string{
+				"user: a", "model: call test.read", "user: truncated test.read", "model: answer to a",
+				"user: b", "model: call test.read", "user: response test.read", "model: answer to b",
+				"user: inline image/png, what is this?",
+				"model: call test.read", "user: response test.read",
+			},
+			event: "truncated 1 old tool response(s) and attachment(s)",
+		},
+		{
+			name:   "within the budget",
+			budget: func(agent *Agent) int { return agent.contextTokens(base) },
+			want: []string{
+				"user: a", "model: call test.read", "user: response test.read", "model: answer to a",
+				"user: b", "model: call test.read", "user: response test.read", "model: answer to b",
+				"user: inline image/png, what is this?",
+				"model: call test.read", "user: response test.read",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := newCompactionAgent(t, &stubProvider{}, history())
+			agent.contextBudget = test.budget(agent)
+			event := agent.truncateToolResponses(base)
+			if event != test.event {
+				t.Errorf("event = %q, want %q", event, test.event)
+			}
+			if got := describe(agent.conversationHistory); !slices.Equal(got, test.want) {
+				t.Errorf("history:\n got %q\nwant %q", got, test.want)
+			}
+		})
+	}
+
+	// A truncated response is not truncated again.
+	agent := newCompactionAgent(t, &stubProvider{}, history())
+	agent.contextBudget = 1
+	agent.truncateToolResponses(base)
+	if event := agent.truncateToolResponses(base); event != "" {
+		t.Errorf("second truncation = %q, want nothing to do", event)
+	}
+}
+
+func TestDropTurns(t *testing.T) {
+	base := &gemini.GenerateContentRequest{}
+	current := userMessage("now")
+	tests := []struct {
+		name         string
+		history      []gemini.Content
+		dropped      int
+		budget       func(agent *Agent) int
+		want         []string
+		turnStart    int
+		totalDropped int
+		event        string
+	}{
+		{
+			name:    "every complete turn",
+			history: append(testTurns("a", "b", "c"), current),
+			budget:  func(*Agent) int { return 1 },
+			want: []string{
+				"user: [Compacted] 12 earlier messages were dropped to fit the context window.",
+				"user: now",
+			},
+			turnStart:    1,
+			totalDropped: 12,
+			event:        "dropped 12 oldest message(s)",
+		},
+		{
+			name:    "oldest first until it fits",
+			history: append(testTurns("a", "b", "c"), current),
+			budget: func(agent *Agent) int {
+				return budgetFor(agent, base, append(testTurns("b", "c"), current))
+			},
+			want: append([]string{"user: [Compacted] 4 earlier messages were dropped to fit the context window."},
+				describe(append(testTurns("b", "c"), current))...),
+			turnStart:    9,
+			totalDropped: 4,
+			event:        "dropped 4 oldest message(s)",
+		},
+		{
+			name:    "keeps one running note",
+			history: append(append([]gemini.Content{dropNote(5)}, testTurns("a", "b")...), current),
+			dropped: 5,
+			budget:  func(*Agent) int { return 1 },
+			want: []string{
+				"user: [Compacted] 13 earlier messages were dropped to fit the context window.",
+				"user: now",
+			},
+			turnStart:    1,
+			totalDropped: 13,
+			event:        "dropped 8 oldest message(s)",
+		},
+		{
+			name:         "never the turn in progress",
+			history:      append([]gemini.Content{current}, testTurn("now", 100)[1:]...),
+			budget:       func(*Agent) int { return 1 },
+			want:         describe(append([]gemini.Content{current}, testTurn("now", 100)[1:]...)),
+			turnStart:    0,
+			totalDropped: 0,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := newCompactionAgent(t, &stubProvider{}, test.history)
+			agent.droppedMessages = test.dropped
+			agent.contextBudget = test.budget(agent)
+			turnStart := slices.IndexFunc(agent.conversationHistory, func(c gemini.Content) bool {
+				return len(c.Parts) == 1 && c.Parts[0].Text != nil && *c.Parts[0].Text == "now"
+			})
+			event := agent.dropTurns(base, &turnStart)
+			if event != test.event {
+				t.Errorf("event = %q, want %q", event, test.event)
+			}
+			if got := describe(agent.conversationHistory); !slices.Equal(got, test.want) {
+				t.Errorf("history:\n got %q\nwant %q", got, test.want)
+			}
+			if turnStart != test.turnStart {
+				t.Errorf("turnStart = %d, want %d", turnStart, test.turnStart)
+			}
+			if agent.droppedMessages != test.totalDropped {
+				t.Errorf("droppedMessages = %d, want %d", agent.droppedMessages, test.totalDropped)
+			}
+		})
+	}
+}
+
+func TestSummarizeTurns(t *testing.T) {
+	summary := "user: [Compacted] Summary of 8 earlier messages:"
+	tests := []struct {
+		name      string
+		history   []gemini.Content
+		provider  *stubProvider
+		turnStart int
+		want      []string
+		wantStart int
+		event     string
+	}{
+		{
+			name:      "all but the last two turns",
+			history:   append(testTurns("a", "b", "c", "d"), userMessage("now")),
+			provider:  &stubProvider{reply: "a and b happened"},
+			turnStart: 16,
+			want:      append([]string{summary}, describe(append(testTurns("c", "d"), userMessage("now")))...),
+			wantStart: 9,
+			event:     "summarized 8 earlier message(s)",
+		},
+		{
+			name:      "turn in progress after its function calls",
+			history:   append(testTurns("a", "b", "c", "d"), testTurn("now", 100)[:3]...),
+			provider:  &stubProvider{reply: "a and b happened"},
+			turnStart: 16,
+			want:      append([]string{summary}, describe(append(testTurns("c", "d"), testTurn("now", 100)[:3]...))...),
+			wantStart: 9,
+			event:     "summarized 8 earlier message(s)",
+		},
+		{
+			name:      "too few turns",
+			history:   append(testTurns("a", "b"), userMessage("now")),
+			provider:  &stubProvider{reply: "unused"},
+			turnStart: 8,
+			want:      describe(append(testTurns("a", "b"), userMessage("now"))),
+			wantStart: 8,
+		},
+		{
+			name:      "provider error",
+			history:   append(testTurns("a", "b", "c"), userMessage("now")),
+			provider:  &stubProvider{err: errors.New("unavailable")},
+			turnStart: 12,
+			want:      describe(append(testTurns("a", "b", "c"), userMessage("now"))),
+			wantStart: 12,
+		},
+		{
+			name:      "empty summary",
+			history:   append(testTurns("a", "b", "c"), userMessage("now")),
+			provider:  &stubProvider{reply: "  "},
+			turnStart: 12,
+			want:      describe(append(testTurns("a", "b", "c"), userMessage("now"))),
+			wantStart: 12,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := newCompactionAgent(t, test.provider, test.history)
+			turnStart := test.turnStart
+			event := agent.summarizeTurns(context.Background(), &turnStart)
+			if event != test.event {
+				t.Errorf("event = %q, want %q", event, test.event)
+			}
+			if got := describe(agent.conversationHistory); !slices.Equal(got, test.want) {
+				t.Errorf("history:\n got %q\nwant %q", got, test.want)
+			}
+			if turnStart != test.wantStart {
+				t.Errorf("turnStart = %d, want %d", turnStart, test.wantStart)
+			}
+			if event == "" {
+				return
+			}
+			text := *agent.conversationHistory[0].Parts[0].Text
+			if !strings.HasSuffix(text, test.provider.reply) {
+				t.Errorf("summary message %q does not end with the summary", text)
+			}
+			if len(test.provider.requests) != 1 {
+				t.Fatalf("%d summarization request(s), want 1", len(test.provider.requests))
+			}
+			request := *test.provider.requests[0].Contents[0].Parts[0].Text
+			if !strings.Contains(request, "user: b\n") || strings.Contains(request, "user: c\n") {
+				t.Errorf("summarization request does not cover exactly turns a and b:\n%s", request)
+			}
+		})
+	}
+}
+
+func TestFailedTurnRestoresDropCount(t *testing.T) {
+	agent := newCompactionAgent(t, &stubProvider{err: errors.New("unavailable")}, testTurns("a", "b", "c"))
+	agent.approval = &approvalPolicy{Default: approvalAllow}
+	agent.compaction = []string{compactDrop}
+	agent.contextBudget = 1
+	agent.droppedMessages = 3
+	saved := describe(agent.conversationHistory)
+
+	if _, err := agent.agentLoop(context.Background(), []gemini.Content{userMessage("now")}); err == nil {
+		t.Fatal("agentLoop succeeded with a failing provider")
+	}
+	if got := describe(agent.conversationHistory); !slices.Equal(got, saved) {
+		t.Errorf("history was not rolled back:\n got %q\nwant %q", got, saved)
+	}
+	if agent.droppedMessages != 3 {
+		t.Errorf("droppedMessages = %d after the rollback, want 3", agent.droppedMessages)
+	}
+}
+
+func TestTruncationKeepsCharactersWhole(t *testing.T) {
+	// The excerpt starts with `{"content":"x`, so a cut at a fixed byte count
+	// lands inside one of the three byte characters.
+	response := gemini.Content{Role: gemini.StringPtr("user"), Parts: []gemini.Part{{FunctionResponse: &gemini.FunctionResponse{
+		Name: "test.read", Response: map[string]any{"content": "x" + strings.Repeat("日本", 500)},
+	}}}}
+	agent := newCompactionAgent(t, &stubProvider{}, []gemini.Content{response, userMessage("next")})
+	agent.contextBudget = 1
+	agent.truncateToolResponses(&gemini.GenerateContentRequest{})
+	excerpt, _ := agent.conversationHistory[0].Parts[0].FunctionResponse.Response["excerpt"].(string)
+	if !utf8.ValidString(excerpt) || !strings.HasSuffix(excerpt, "...") || len(excerpt) > truncatedResponseChars+len("...") {
+		t.Errorf("excerpt = %q, want at most %d bytes of whole characters", excerpt, truncatedResponseChars)
+	}
+}
+
+func TestResumeKeepsDropCount(t *testing.T) {
+	history := append([]gemini.Content{dropNote(5)}, testTurns("a", "b", "c")...)
+	original := newCompactionAgent(t, &stubProvider{}, history)
+	original.persist()
+
+	resumed := newSessionAgent(t, original.sessions.dir)
+	if err := resumed.resumeSession(resumeLast, false); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	if resumed.droppedMessages != 5 {
+		t.Errorf("droppedMessages = %d after resuming, want the 5 of the drop note", resumed.droppedMessages)
+	}
+	turnStart := len(resumed.conversationHistory)
+	resumed.contextBudget = 1
+	resumed.dropTurns(&gemini.GenerateContentRequest{}, &turnStart)
+	if got := describe(resumed.conversationHistory[:1]); got[0] != "user: [Compacted] 13 "+dropNoteSuffix {
+		t.Errorf("drop note = %q, want 5 earlier and 8 new messages counted", got[0])
+	}
+
+	if n := droppedBefore(testTurns("a")); n != 0 {
+		t.Errorf("droppedBefore a history without a note = %d, want 0", n)
+	}
+}
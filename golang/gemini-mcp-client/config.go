@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// defaultServerName is used for the single server configured via MCP_SERVER_URL
+// when no config file is present.
+const defaultServerName = "default"
+
+// ServerConfig describes how to reach one MCP server. It mirrors an entry of
+// the "mcpServers" map in py/mcp_servers.json. Remote servers set URL; local
+// servers set Command (plus optional Args and Env) and are spawned as child
+// processes speaking MCP over stdio.
+type ServerConfig struct {
+	Transport string            `json:"transport,omitempty"`
+	URL       string            `json:"url,omitempty"`
+	Command   string            `json:"command,omitempty"`
+	Args      []string          `json:"args,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// MCPConfig is the top-level layout of mcp_servers.json.
+type MCPConfig struct {
+	MCPServers map[string]ServerConfig `json:"mcpServers"`
+}
+
+// loadMCPConfig reads the server config file named by MCP_SERVERS_CONFIG
+// (default "mcp_servers.json"). If the file does not exist it falls back to a
+// single streamable HTTP server at MCP_SERVER_URL.
+func loadMCPConfig() (*MCPConfig, error) {
+	path := os.Getenv("MCP_SERVERS_CONFIG")
+	if path == "" {
+		path = "mcp_servers.json"
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		mcpServerURL := os.Getenv("MCP_SERVER_URL")
+		if mcpServerURL == "" {
+			mcpServerURL = "http://localhost:8080/mcp"
+		}
+		return &MCPConfig{MCPServers: map[string]ServerConfig{
+			defaultServerName: {Transport: "streamable-http", URL: mcpServerURL},
+		}}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+
+	var config MCPConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	for name := range config.MCPServers {
+		if name == "" || strings.Contains(name, ".") {
+			return nil, fmt.Errorf("invalid server name %q in %s: names must be non-empty and contain no '.'", name, path)
+		}
+	}
+	return &config, nil
+}
+
+// serverNames returns the configured server names in a stable order.
+func (c *MCPConfig) serverNames() []string {
+	names := make([]string, 0, len(c.MCPServers))
+	for name := range c.MCPServers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isStdio reports whether the server is spawned locally over stdio.
+func (sc ServerConfig) isStdio() bool {
+	return sc.Transport == "stdio" || (sc.Transport == "" && sc.Command != "")
+}
+
+// newTransport builds the MCP client transport described by the config entry,
+// wrapped so that info learns about the server. For stdio servers the returned
+// closer releases the stderr log file and must be called after the session
+// has been closed; it is nil otherwise.
+func (sc ServerConfig) newTransport(name string, info *serverInfo) (mcp.Transport, io.Closer, error) {
+	if sc.isStdio() {
+		transport, closer, err := sc.newCommandTransport(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &observedTransport{Transport: transport, info: info}, closer, nil
+	}
+	if sc.URL == "" {
+		return nil, nil, fmt.Errorf("missing url")
+	}
+	if _, err := url.Parse(sc.URL); err != nil {
+		return nil, nil, fmt.Errorf("invalid url %q: %v", sc.URL, err)
+	}
+	httpClient := &http.Client{Transport: &protocolVersionTransport{base: mcpBaseTransport, info: info}}
+	var transport mcp.Transport
+	switch sc.Transport {
+	case "", "streamable-http", "http":
+		transport = mcp.NewStreamableClientTransport(sc.URL, &mcp.StreamableClientTransportOptions{HTTPClient: httpClient})
+	case "sse":
+		transport = mcp.NewSSEClientTransport(sc.URL, &mcp.SSEClientTransportOptions{HTTPClient: httpClient})
+	default:
+		return nil, nil, fmt.Errorf("unsupported transport %q", sc.Transport)
+	}
+	return &observedTransport{Transport: transport, info: info}, nil, nil
+}
+
+// newCommandTransport prepares the child process for a stdio server. The
+// process inherits our environment plus the configured Env (values may
+// reference other variables as $VAR), and its stderr goes to a log file.
+func (sc ServerConfig) newCommandTransport(name string) (mcp.Transport, io.Closer, error) {
+	if sc.Command == "" {
+		return nil, nil, fmt.Errorf("missing command")
+	}
+	logFile, err := openServerLog(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cmd := exec.Command(sc.Command, sc.Args...)
+	cmd.Env = os.Environ()
+	for key, value := range sc.Env {
+		cmd.Env = append(cmd.Env, key+"="+os.ExpandEnv(value))
+	}
+	cmd.Stderr = logFile
+	return mcp.NewCommandTransport(cmd), logFile, nil
+}
+
+// serverLogPath returns where the stderr of a spawned server is written:
+// <MCP_LOG_DIR>/<name>.log, with MCP_LOG_DIR defaulting to a directory under
+// the system temp dir.
+func serverLogPath(name string) string {
+	dir := os.Getenv("MCP_LOG_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "gemini-mcp-client")
+	}
+	return filepath.Join(dir, name+".log")
+}
+
+func openServerLog(name string) (*os.File, error) {
+	path := serverLogPath(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %v", err)
+	}
+	logFile, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open server log: %v", err)
+	}
+	return logFile, nil
+}
+
+// describe returns a short human-readable description of the server endpoint.
+func (sc ServerConfig) describe() string {
+	if sc.isStdio() {
+		return strings.Join(append([]string{sc.Command}, sc.Args...), " ") + " (stdio)"
+	}
+	return sc.URL
+}
+
+// envString returns the value of an environment variable, or def if unset.
+func envString(name, def string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return def
+}
+
+// envInt returns the integer value of the named environment variable, or def
+// if it is unset or not a valid integer.
+func envInt(name string, def int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+// envFloat returns the floating point value of the named environment
+// variable, or def if it is unset or not a valid number.
+func envFloat(name string, def float64) float64 {
+	value, err := strconv.ParseFloat(os.Getenv(name), 64)
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+// envDuration returns the duration value (e.g. "90s") of the named
+// environment variable, or def if it is unset or invalid.
+func envDuration(name string, def time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return value
+}
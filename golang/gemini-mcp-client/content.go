@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/liuzl/ai/gemini"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// convertToolResult maps every content item of an MCP tool result onto what
+// Gemini can consume. Text is concatenated into "result" (or "error" when the
+// tool failed), structured content is passed through unchanged, embedded text
+// resources and resource links are summarized, and binary media is returned as
+// inline data parts to be sent alongside the function response.
+func convertToolResult(toolName string, result *mcp.CallToolResult) (map[string]any, []gemini.Part) {
+	response := make(map[string]any)
+	var texts []string
+	var resources, links, attachments []map[string]any
+	var inlineParts []gemini.Part
+
+	attach := func(kind, mimeType string, data []byte, extra map[string]any) {
+		attachment := map[string]any{"type": kind, "mimeType": mimeType, "bytes": len(data)}
+		for key, value := range extra {
+			attachment[key] = value
+		}
+		if inlineSupported(mimeType) {
+			attachment["attached"] = true
+			inlineParts = append(inlineParts, gemini.Part{InlineData: &gemini.Blob{
+				MimeType: mimeType,
+				Data:     base64.StdEncoding.EncodeToString(data),
+			}})
+		} else {
+			attachment["attached"] = false
+		}
+		attachments = append(attachments, attachment)
+	}
+
+	for _, content := range result.Content {
+		switch c := content.(type) {
+		case *mcp.TextContent:
+			texts = append(texts, c.Text)
+		case *mcp.ImageContent:
+			attach("image", c.MIMEType, c.Data, nil)
+		case *mcp.AudioContent:
+			attach("audio", c.MIMEType, c.Data, nil)
+		case *mcp.EmbeddedResource:
+			if c.Resource == nil {
+				continue
+			}
+			if c.Resource.Blob != nil {
+				attach("resource", c.Resource.MIMEType, c.Resource.Blob, map[string]any{"uri": c.Resource.URI})
+				continue
+			}
+			resource := map[string]any{"uri": c.Resource.URI, "text": c.Resource.Text}
+			if c.Resource.MIMEType != "" {
+				resource["mimeType"] = c.Resource.MIMEType
+			}
+			resources = append(resources, resource)
+		case *mcp.ResourceLink:
+			links = append(links, resourceLinkSummary(c))
+		default:
+			texts = append(texts, fmt.Sprintf("[unsupported content type %T]", content))
+		}
+	}
+
+	key := "result"
+	if result.IsError {
+		key = "error"
+	}
+	if len(texts) > 0 || len(result.Content) == 0 {
+		response[key] = strings.Join(texts, "\n")
+	}
+	if result.StructuredContent != nil {
+		response["structuredContent"] = result.StructuredContent
+	}
+	if len(resources) > 0 {
+		response["resources"] = resources
+	}
+	if len(links) > 0 {
+		response["resourceLinks"] = links
+	}
+	if len(attachments) > 0 {
+		response["attachments"] = attachments
+		if len(inlineParts) > 0 {
+			response["note"] = fmt.Sprintf("%d attachment(s) from %s follow as inline data.", len(inlineParts), toolName)
+		}
+	}
+	if result.IsError && response[key] == nil {
+		response[key] = "Tool reported an error"
+	}
+	return response, inlineParts
+}
+
+func resourceLinkSummary(link *mcp.ResourceLink) map[string]any {
+	summary := map[string]any{"uri": link.URI, "name": link.Name}
+	if link.Title != "" {
+		summary["title"] = link.Title
+	}
+	if link.Description != "" {
+		summary["description"] = link.Description
+	}
+	if link.MIMEType != "" {
+		summary["mimeType"] = link.MIMEType
+	}
+	if link.Size != nil {
+		summary["size"] = *link.Size
+	}
+	return summary
+}
+
+// inlineSupported reports whether Gemini accepts the MIME type as inline data.
+func inlineSupported(mimeType string) bool {
+	for _, prefix := range []string{"image/", "audio/", "video/", "text/"} {
+		if strings.HasPrefix(mimeType, prefix) {
+			return true
+		}
+	}
+	return mimeType == "application/pdf"
+}
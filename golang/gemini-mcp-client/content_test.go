@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+
+	"github.com/liuzl/ai/gemini"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+func TestConvertToolResult(t *testing.T) {
+	png := []byte("\x89PNG")
+	wav := []byte("RIFF")
+	size := int64(2048)
+	tests := []struct {
+		name   string
+		result *mcp.CallToolResult
+		want   map[string]any
+		inline []gemini.Blob
+	}{
+		{
+			name:   "no content",
+			result: &mcp.CallToolResult{},
+			want:   map[string]any{"result": ""},
+		},
+		{
+			name:   "text parts are joined",
+			result: &mcp.CallToolResult{Content: []mcp.Content{&mcp.TextContent{Text: "one"}, &mcp.TextContent{Text: "two"}}},
+			want:   map[string]any{"result": "one\ntwo"},
+		},
+		{
+			name:   "error text",
+			result: &mcp.CallToolResult{IsError: true, Content: []mcp.Content{&mcp.TextContent{Text: "no such file"}}},
+			want:   map[string]any{"error": "no such file"},
+		},
+		{
+			name:   "error without text",
+			result: &mcp.CallToolResult{IsError: true, Content: []mcp.Content{&mcp.ImageContent{MIMEType: "application/x-unknown", Data: png}}},
+			want: map[string]any{
+				"error":       "Tool reported an error",
+				"attachments": []map[string]any{{"type": "image", "mimeType": "application/x-unknown", "bytes": 4, "attached": false}},
+			},
+		},
+		{
+			name:   "image and audio follow as inline data",
+			result: &mcp.CallToolResult{Content: []mcp.Content{&mcp.TextContent{Text: "here"}, &mcp.ImageContent{MIMEType: "image/png", Data: png}, &mcp.AudioContent{MIMEType: "audio/wav", Data: wav}}},
+			want: map[string]any{
+				"result": "here",
+				"attachments": []map[string]any{
+					{"type": "image", "mimeType": "image/png", "bytes": 4, "attached": true},
+					{"type": "audio", "mimeType": "audio/wav", "bytes": 4, "attached": true},
+				},
+				"note": "2 attachment(s) from test.tool follow as inline data.",
+			},
+			inline: []gemini.Blob{
+				{MimeType: "image/png", Data: base64.StdEncoding.EncodeToString(png)},
+				{MimeType: "audio/wav", Data: base64.StdEncoding.EncodeToString(wav)},
+			},
+		},
+		{
+			name: "embedded resources",
+			result: &mcp.CallToolResult{Content: []mcp.Content{
+				&mcp.EmbeddedResource{Resource: &mcp.ResourceContents{URI: "file:///notes.md", MIMEType: "text/markdown", Text: "# Notes"}},
+				&mcp.EmbeddedResource{Resource: &mcp.ResourceContents{URI: "file:///plain", Text: "plain"}},
+				&mcp.EmbeddedResource{Resource: &mcp.ResourceContents{URI: "file:///report.pdf", MIMEType: "application/pdf", Blob: []byte("%PDF")}},
+				&mcp.EmbeddedResource{Resource: &mcp.ResourceContents{URI: "file:///data.bin", MIMEType: "application/octet-stream", Blob: []byte{0, 1}}},
+				&mcp.EmbeddedResource{},
+			}},
+			want: map[string]any{
+				"resources": []map[string]any{
+					{"uri": "file:///notes.md", "mimeType": "text/markdown", "text": "# Notes"},
+					{"uri": "file:///plain", "text": "plain"},
+				},
+				"attachments": []map[string]any{
+					{"type": "resource", "uri": "file:///report.pdf", "mimeType": "application/pdf", "bytes": 4, "attached": true},
+					{"type": "resource", "uri": "file:///data.bin", "mimeType": "application/octet-stream", "bytes": 2, "attached": false},
+				},
+				"note": "1 attachment(s) from test.tool follow as inline data.",
+			},
+			inline: []gemini.Blob{{MimeType: "application/pdf", Data: base64.StdEncoding.EncodeToString([]byte("%PDF"))}},
+		},
+		{
+			name: "resource links",
+			result: &mcp.CallToolResult{Content: []mcp.Content{
+				&mcp.ResourceLink{URI: "file:///big.log", Name: "big.log", Title: "Big log", Description: "Server log", MIMEType: "text/plain", Size: &size},
+				&mcp.ResourceLink{URI: "file:///other", Name: "other"},
+			}},
+			want: map[string]any{
+				"resourceLinks": []map[string]any{
+					{"uri": "file:///big.log", "name": "big.log", "title": "Big log", "description": "Server log", "mimeType": "text/plain", "size": size},
+					{"uri": "file:///other", "name": "other"},
+				},
+			},
+		},
+		{
+			name: "structured content",
+			result: &mcp.CallToolResult{
+				Content:           []mcp.Content{&mcp.TextContent{Text: `{"temperature": 21}`}},
+				StructuredContent: map[string]any{"temperature": 21},
+			},
+			want: map[string]any{
+				"result":            `{"temperature": 21}`,
+				"structuredContent": map[string]any{"temperature": 21},
+			},
+		},
+		{
+			name:   "structured content alone",
+			result: &mcp.CallToolResult{StructuredContent: []any{"a", "b"}},
+			want:   map[string]any{"result": "", "structuredContent": []any{"a", "b"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, parts := convertToolResult("test.tool", test.result)
+			if !reflect.DeepEqual(response, test.want) {
+				t.Errorf("response:\n got %#v\nwant %#v", response, test.want)
+			}
+			var inline []gemini.Blob
+			for _, part := range parts {
+				if part.InlineData == nil {
+					t.Errorf("part %+v is not inline data", part)
+					continue
+				}
+				inline = append(inline, *part.InlineData)
+			}
+			if !reflect.DeepEqual(inline, test.inline) {
+				t.Errorf("inline data = %+v, want %+v", inline, test.inline)
+			}
+		})
+	}
+}
@@ -3,13 +3,23 @@ package main
 import (
 	"bufio"
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"slices"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"gemini-mcp-bash/internal/httpretry"
+	"gemini-mcp-bash/internal/sysprompt"
+
 	_ "github.com/joho/godotenv/autoload"
 	"github.com/liuzl/ai/gemini"
+	"github.com/modelcontextprotocol/go-sdk/jsonschema"
 	"github.com/modelcontextprotocol/go-sdk/mcp"
 )
 
@@ -27,10 +37,15 @@ const (
 	ColorReset  = "\033[0m"
 )
 
-// Tool represents a discovered MCP tool
+// Tool represents a discovered MCP tool. Name is namespaced as "server.tool"
+// so that tools from different servers cannot collide; MCPName is the name
+// the owning server knows it by.
 type Tool struct {
-	Name        string `json:"name"`
-	Description string `json:"description"`
+	Name        string             `json:"name"`
+	Server      string             `json:"server"`
+	MCPName     string             `json:"mcpName"`
+	Description string             `json:"description"`
+	InputSchema *jsonschema.Schema `json:"inputSchema,omitempty"`
 }
 
 // conversationStats holds statistics about the conversation.
@@ -40,45 +55,99 @@ type conversationStats struct {
 	FunctionCalls     int
 	FunctionResponses int
 	TotalMessages     int
+	// Usage counts the tokens of the session's model requests.
+	Usage tokenCounts
 }
 
 // Agent holds the state for a chat session, including conversation history and tools.
 type Agent struct {
-	geminiClient        *gemini.Client
-	mcpSession          *mcp.ClientSession
+	provider            Provider
+	servers             *serverPool
 	conversationHistory []gemini.Content
 	discoveredTools     []Tool
+	discoveredResources []Resource
+	discoveredPrompts   []Prompt
+	// pendingParts holds attached resources waiting for the next user message.
+	pendingParts []gemini.Part
+	// resourceMu guards the subscription state, which resources/updated
+	// notifications change from another goroutine.
+	resourceMu       sync.Mutex
+	subscriptions    map[string]string
+	updatedResources map[string]bool
+	// maxParallelToolCalls bounds how many function calls from a single model
+	// turn are dispatched to MCP servers concurrently.
+	maxParallelToolCalls int
+	// toolTimeout bounds each MCP tool call; zero means no limit.
+	toolTimeout time.Duration
+	// progress shows the progress servers report for running tool calls.
+	progress *progressDisplay
+	// streaming prints model text as it is generated instead of after the turn.
+	streaming bool
+	// systemTemplate is rendered into the system instruction of each request.
+	systemTemplate string
+	// contextBudget caps the estimated prompt tokens of a request; older
+	// history is compacted with the compaction strategies to stay under it.
+	contextBudget    int
+	compaction       []string
+	tokenScale       float64
+	lastPromptTokens int
+	compactions      []string
+	// droppedMessages counts the messages the drop strategy has removed since
+	// the conversation was started or resumed, for the note that replaces them.
+	droppedMessages int
+	// sessions persists the conversation after every turn as sessionName.
+	sessions    sessionStore
+	sessionName string
+	// approval decides which function calls run, need the user's approval
+	// through readLine, or are refused. Without readLine calls that need
+	// approval are rejected.
+	approval *approvalPolicy
+	readLine func(label string) (string, bool)
+	// audit records every function call; nil when auditing is off.
+	audit *auditLog
+	// events receives the structured events of each turn; nil for text output.
+	events *eventOutput
+	// usage accounts the tokens and cost of the session against its budget.
+	usage *usageTracker
 }
 
-// NewAgent creates and initializes a new Agent.
-func NewAgent(geminiClient *gemini.Client, mcpSession *mcp.ClientSession) *Agent {
+// NewAgent creates and initializes a new Agent using the connected MCP servers.
+// It fails if the session store cannot name the new session.
+func NewAgent(provider Provider, servers *serverPool) (*Agent, error) {
+	sessions := newSessionStore()
+	sessionName, err := sessions.newName()
+	if err != nil {
+		return nil, err
+	}
 	agent := &Agent{
-		geminiClient:    geminiClient,
-		mcpSession:      mcpSession,
-		discoveredTools: []Tool{},
+		provider:             provider,
+		servers:              servers,
+		subscriptions:        make(map[string]string),
+		updatedResources:     make(map[string]bool),
+		discoveredTools:      []Tool{},
+		maxParallelToolCalls: envInt("MCP_TOOL_CONCURRENCY", 4),
+		progress:             newProgressDisplay(),
+		tokenScale:           1,
+		systemTemplate:       sysprompt.Default,
+		sessions:             sessions,
+		sessionName:          sessionName,
+		audit:                newAuditLog(),
+		usage:                newUsageTracker(provider.Model(), defaultPrices),
 	}
 	agent.initializeConversation()
-	return agent
+	return agent, nil
 }
 
-// initializeConversation sets up the initial system message.
+// initializeConversation starts an empty conversation. The system prompt is
+// not part of the history; it is sent with every request instead.
 func (a *Agent) initializeConversation() {
-	systemMessage := fmt.Sprintf(`You are a helpful AI assistant connected to multiple external systems via MCP tools.
-The current date is %s.
-You can use tools to help users with their requests.
-Always be helpful and provide clear, accurate responses.`, time.Now().Format("2006-01-02"))
-
-	a.conversationHistory = []gemini.Content{
-		{
-			Parts: []gemini.Part{{Text: gemini.StringPtr(systemMessage)}},
-			Role:  gemini.StringPtr("user"),
-		},
-	}
+	a.conversationHistory = nil
+	a.droppedMessages = 0
 }
 
 // getStats calculates and returns statistics about the conversation.
 func (a *Agent) getStats() conversationStats {
-	stats := conversationStats{TotalMessages: len(a.conversationHistory)}
+	stats := conversationStats{TotalMessages: len(a.conversationHistory), Usage: a.usage.total}
 	for _, content := range a.conversationHistory {
 		role := "unknown"
 		if content.Role != nil {
@@ -135,7 +204,15 @@ func (a *Agent) printConversationHistory() {
 				hasContent = true
 			}
 			if part.FunctionResponse != nil {
-				fmt.Printf("%s[Function Response: %s]%s", ColorGreen, part.FunctionResponse.Name, ColorReset)
+				if part.FunctionResponse.Response["compacted"] != nil {
+					fmt.Printf("%s[Function Response: %s (compacted)]%s", ColorYellow, part.FunctionResponse.Name, ColorReset)
+				} else {
+					fmt.Printf("%s[Function Response: %s]%s", ColorGreen, part.FunctionResponse.Name, ColorReset)
+				}
+				hasContent = true
+			}
+			if part.InlineData != nil {
+				fmt.Printf("%s[Inline Data: %s]%s", ColorPurple, part.InlineData.MimeType, ColorReset)
 				hasContent = true
 			}
 		}
@@ -149,128 +226,451 @@ func (a *Agent) printConversationHistory() {
 	fmt.Printf("%s----------------------------------------%s\n", ColorBold, ColorReset)
 	fmt.Printf("%sStatistics: %d user messages, %d model responses, %d function calls, %d function responses%s\n",
 		ColorPurple, stats.UserMessages, stats.ModelResponses, stats.FunctionCalls, stats.FunctionResponses, ColorReset)
+	a.printContextUsage()
+	for _, event := range a.compactions {
+		fmt.Printf("%s🗜️  %s%s\n", ColorYellow, event, ColorReset)
+	}
+}
+
+// printContextUsage shows the estimated size of the history against the budget.
+func (a *Agent) printContextUsage() {
+	tokens := int(float64(estimateTokens(a.conversationHistory)) * a.tokenScale)
+	budget := "no budget"
+	if a.contextBudget > 0 {
+		budget = fmt.Sprintf("budget %d", a.contextBudget)
+	}
+	fmt.Printf("%sContext: ≈%d tokens of history (%s), %d compaction(s)%s\n", ColorCyan, tokens, budget, len(a.compactions), ColorReset)
+	if a.lastPromptTokens > 0 {
+		fmt.Printf("%sLast request: %d prompt tokens reported by %s%s\n", ColorCyan, a.lastPromptTokens, a.provider.Name(), ColorReset)
+	}
 }
 
 // showConversationStats displays conversation statistics.
 func (a *Agent) showConversationStats() {
-	if len(a.conversationHistory) == 0 {
+	stats := a.getStats()
+	if stats.TotalMessages == 0 && stats.Usage.Requests == 0 {
 		fmt.Printf("%sNo conversation history.%s\n", ColorGray, ColorReset)
 		return
 	}
-	stats := a.getStats()
 	fmt.Printf("%s--- Conversation Statistics ---%s\n", ColorBold, ColorReset)
 	fmt.Printf("%sTotal messages: %d%s\n", ColorCyan, stats.TotalMessages, ColorReset)
 	fmt.Printf("%sUser messages: %d%s\n", ColorBlue, stats.UserMessages, ColorReset)
 	fmt.Printf("%sModel responses: %d%s\n", ColorGreen, stats.ModelResponses, ColorReset)
 	fmt.Printf("%sFunction calls: %d%s\n", ColorYellow, stats.FunctionCalls, ColorReset)
 	fmt.Printf("%sFunction responses: %d%s\n", ColorPurple, stats.FunctionResponses, ColorReset)
+	a.printContextUsage()
+	a.usage.print()
 	fmt.Printf("%s------------------------------%s\n", ColorBold, ColorReset)
 }
 
-// clearConversationHistory clears the conversation history.
-func (a *Agent) clearConversation() {
-	a.initializeConversation()
+// clearConversation clears the conversation history and starts a new session.
+func (a *Agent) clearConversation() error {
+	name, err := a.sessions.newName()
+	if err != nil {
+		return err
+	}
+	a.resetConversation()
+	a.sessionName = name
 	fmt.Printf("%sConversation history cleared.%s\n", ColorGreen, ColorReset)
+	return nil
 }
 
-// discoverTools connects to MCP servers and registers their tools.
-func (a *Agent) discoverTools() error {
-	if a.mcpSession == nil {
+// resetConversation forgets everything about the conversation but the name
+// of its session.
+func (a *Agent) resetConversation() {
+	a.initializeConversation()
+	a.pendingParts = nil
+	a.compactions = nil
+	a.usage.reset()
+	a.approval.resetSession()
+}
+
+// discoverCapabilities registers the tools, resources and resource templates
+// of every connected MCP server.
+func (a *Agent) discoverCapabilities(ctx context.Context) error {
+	if len(a.servers.names()) == 0 {
 		return nil
 	}
 	fmt.Printf("%s🤖 Starting dynamic discovery of all MCP server capabilities...%s\n", ColorBold, ColorReset)
 
-	ctx := context.Background()
-	tools, err := a.mcpSession.ListTools(ctx, &mcp.ListToolsParams{})
-	if err != nil {
-		return fmt.Errorf("failed to list tools: %v", err)
+	var failed []string
+	for _, server := range a.servers.names() {
+		if err := a.discoverTools(ctx, server); err != nil {
+			fmt.Printf("  %s❌ Failed to list tools on '%s': %v%s\n", ColorRed, server, err, ColorReset)
+			failed = append(failed, server)
+		}
+		if err := a.discoverResources(ctx, server); err != nil {
+			fmt.Printf("  %s❌ Failed to list resources on '%s': %v%s\n", ColorRed, server, err, ColorReset)
+			failed = append(failed, server)
+		}
+		if err := a.discoverPrompts(ctx, server); err != nil {
+			fmt.Printf("  %s❌ Failed to list prompts on '%s': %v%s\n", ColorRed, server, err, ColorReset)
+			failed = append(failed, server)
+		}
 	}
 
-	if len(tools.Tools) == 0 {
-		fmt.Printf("%s⚠️ No tools found on any connected servers.%s\n", ColorYellow, ColorReset)
-		return nil
+	if len(a.discoveredTools) == 0 && len(a.discoveredResources) == 0 {
+		fmt.Printf("%s⚠️ No tools or resources found on any connected servers.%s\n", ColorYellow, ColorReset)
+	} else {
+		fmt.Printf("%s✨ Capability discovery complete!%s\n", ColorGreen, ColorReset)
 	}
+	if len(failed) > 0 {
+		return fmt.Errorf("discovery failed on: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
 
-	for _, tool := range tools.Tools {
-		a.discoveredTools = append(a.discoveredTools, Tool{
-			Name:        tool.Name,
+// discoverTools registers the tools of one MCP server.
+func (a *Agent) discoverTools(ctx context.Context, server string) error {
+	tools, err := a.listTools(ctx, server)
+	if err != nil {
+		return err
+	}
+	a.discoveredTools = append(a.discoveredTools, tools...)
+	for _, tool := range tools {
+		fmt.Printf("  %s✅ Discovered and registered tool: %s%s\n", ColorGreen, tool.Name, ColorReset)
+		printSchemaWarnings(tool)
+	}
+	return nil
+}
+
+// listTools fetches the tools of one MCP server.
+func (a *Agent) listTools(ctx context.Context, server string) ([]Tool, error) {
+	session, ok := a.servers.session(server)
+	if !ok {
+		return nil, fmt.Errorf("MCP server '%s' is not connected", server)
+	}
+	result, err := session.ListTools(ctx, &mcp.ListToolsParams{})
+	if err != nil {
+		return nil, err
+	}
+	tools := make([]Tool, 0, len(result.Tools))
+	for _, tool := range result.Tools {
+		tools = append(tools, Tool{
+			Name:        server + "." + tool.Name,
+			Server:      server,
+			MCPName:     tool.Name,
 			Description: tool.Description,
+			InputSchema: tool.InputSchema,
 		})
-		fmt.Printf("  %s✅ Discovered and registered tool: %s%s\n", ColorGreen, tool.Name, ColorReset)
 	}
+	return tools, nil
+}
 
-	fmt.Printf("%s✨ Capability discovery complete!%s\n", ColorGreen, ColorReset)
-	return nil
+func printSchemaWarnings(tool Tool) {
+	_, warnings := convertInputSchema(tool.InputSchema)
+	for _, warning := range warnings {
+		fmt.Printf("    %s⚠️ Schema simplified for Gemini: %s%s\n", ColorYellow, warning, ColorReset)
+	}
+}
+
+// availableTools returns the discovered tools whose server is connected;
+// tools of a server that is reconnecting are withheld from the model.
+func (a *Agent) availableTools() []Tool {
+	var tools []Tool
+	for _, tool := range a.discoveredTools {
+		if !a.servers.isDown(tool.Server) {
+			tools = append(tools, tool)
+		}
+	}
+	return tools
+}
+
+// findTool looks up a discovered tool by its namespaced name.
+func (a *Agent) findTool(name string) (Tool, bool) {
+	for _, tool := range a.discoveredTools {
+		if tool.Name == name {
+			return tool, true
+		}
+	}
+	return Tool{}, false
 }
 
 // convertToGeminiTools converts MCP tools to Gemini function declarations.
 func (a *Agent) convertToGeminiTools() []gemini.FunctionDeclaration {
 	var functionDeclarations []gemini.FunctionDeclaration
-	for _, tool := range a.discoveredTools {
+	for _, tool := range a.availableTools() {
+		// Warnings were already reported during discovery.
+		parameters, _ := convertInputSchema(tool.InputSchema)
 		functionDecl := gemini.FunctionDeclaration{
 			Name:        tool.Name,
 			Description: tool.Description,
-			Parameters:  &gemini.Schema{Type: "object"}, // Use a simple object schema for all tools
+			Parameters:  parameters,
 		}
 		functionDeclarations = append(functionDeclarations, functionDecl)
 	}
+	if len(a.availableResources()) > 0 {
+		functionDeclarations = append(functionDeclarations, a.readResourceDeclaration())
+	}
 	return functionDeclarations
 }
 
-// callMCPTool calls a specific MCP tool and returns the result.
-func (a *Agent) callMCPTool(toolName string, args map[string]any) (map[string]any, error) {
-	ctx := context.Background()
-	toolResult, err := a.mcpSession.CallTool(ctx, &mcp.CallToolParams{
-		Name:      toolName,
-		Arguments: args,
-	})
+// callMCPTool calls a specific MCP tool on the server that owns it and
+// returns the function response for Gemini, plus any inline data parts
+// (images, audio, ...) that must be sent alongside it. toolName is the
+// namespaced "server.tool" name. The call is bounded by toolTimeout; if ctx is
+// cancelled the SDK notifies the server.
+func (a *Agent) callMCPTool(ctx context.Context, toolName string, args map[string]any) (map[string]any, []gemini.Part, error) {
+	if toolName == readResourceFunction && len(a.discoveredResources) > 0 {
+		return a.callReadResource(ctx, args)
+	}
+	tool, ok := a.findTool(toolName)
+	if !ok {
+		return map[string]any{"error": fmt.Sprintf("Unknown tool: %s", toolName)}, nil, nil
+	}
+	session, ok := a.servers.session(tool.Server)
+	if !ok {
+		if a.servers.isDown(tool.Server) {
+			return map[string]any{"error": fmt.Sprintf("MCP server '%s' is disconnected and reconnecting; try again later", tool.Server)}, nil, nil
+		}
+		return map[string]any{"error": fmt.Sprintf("MCP server '%s' is not connected", tool.Server)}, nil, nil
+	}
+
+	callCtx := ctx
+	if a.toolTimeout > 0 {
+		var cancel context.CancelFunc
+		callCtx, cancel = context.WithTimeout(ctx, a.toolTimeout)
+		defer cancel()
+	}
+	// SetProgressToken loses the token unless Meta is already allocated.
+	params := &mcp.CallToolParams{Meta: mcp.Meta{}, Name: tool.MCPName, Arguments: args}
+	token := a.progress.start(toolName)
+	defer a.progress.done(token)
+	params.SetProgressToken(token)
+	toolResult, err := session.CallTool(callCtx, params)
 	if err != nil {
-		return map[string]any{"error": fmt.Sprintf("Tool execution failed: %v", err)}, nil
+		if ctx.Err() != nil {
+			// The whole turn was cancelled; let the caller abort it.
+			return nil, nil, ctx.Err()
+		}
+		if errors.Is(callCtx.Err(), context.DeadlineExceeded) {
+			return map[string]any{"error": fmt.Sprintf("Tool execution timed out after %v", a.toolTimeout)}, nil, nil
+		}
+		// The server may be gone; have it checked now rather than at the
+		// next health check.
+		a.servers.check(tool.Server)
+		return map[string]any{"error": fmt.Sprintf("Tool execution failed: %v", err)}, nil, nil
+	}
+
+	response, inlineParts := convertToolResult(toolName, toolResult)
+	return response, inlineParts, nil
+}
+
+// executeFunctionCalls runs the function calls from one model turn, up to
+// maxParallelToolCalls at a time, and returns their responses in the order
+// the calls were made, followed by any inline data the tools produced.
+func (a *Agent) executeFunctionCalls(ctx context.Context, functionCalls []gemini.FunctionCall) []gemini.Part {
+	limit := a.maxParallelToolCalls
+	if limit < 1 {
+		limit = 1
+	}
+	fmt.Printf("%sProcessing %d function call(s) (up to %d in parallel)...%s\n", ColorCyan, len(functionCalls), min(limit, len(functionCalls)), ColorReset)
+
+	// Ask about the calls one at a time before any of them is dispatched.
+	callArgs := make([]map[string]any, len(functionCalls))
+	refusals := make([]map[string]any, len(functionCalls))
+	decisions := make([]string, len(functionCalls))
+	ids := make([]string, len(functionCalls))
+	for i, fc := range functionCalls {
+		args := fc.Args
+		if args == nil {
+			args = make(map[string]any)
+		}
+		callArgs[i], refusals[i], decisions[i] = a.approve(fc.Name, args)
+		ids[i] = a.events.callID()
+		if callArgs[i] != nil {
+			args = callArgs[i]
+		}
+		a.events.emit(outputEvent{Type: eventToolCall, ID: ids[i], Name: fc.Name, Args: args, Decision: decisions[i]})
+		if refusals[i] != nil {
+			a.auditCall(fc.Name, args, decisions[i], refusals[i], 0)
+			a.events.emit(outputEvent{Type: eventToolResult, ID: ids[i], Name: fc.Name, Response: refusals[i], Error: fmt.Sprint(refusals[i]["error"])})
+		}
 	}
 
-	if toolResult.IsError {
-		errorText := ""
-		for _, content := range toolResult.Content {
-			if textContent, ok := content.(*mcp.TextContent); ok {
-				errorText = textContent.Text
-				break
+	toolResponseParts := make([]gemini.Part, len(functionCalls))
+	inlineParts := make([][]gemini.Part, len(functionCalls))
+	semaphore := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i, fc := range functionCalls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if refusals[i] != nil {
+				toolResponseParts[i] = gemini.Part{
+					FunctionResponse: &gemini.FunctionResponse{Name: fc.Name, Response: refusals[i]},
+				}
+				return
+			}
+			select {
+			case semaphore <- struct{}{}:
+				defer func() { <-semaphore }()
+			case <-ctx.Done():
+				return
+			}
+
+			args := callArgs[i]
+			fmt.Printf("%sAttempting to call MCP tool: '%s' with args: %v%s\n", ColorCyan, fc.Name, args, ColorReset)
+
+			start := time.Now()
+			toolResponse, extraParts, err := a.callMCPTool(ctx, fc.Name, args)
+			elapsed := time.Since(start).Round(time.Millisecond)
+			result := outputEvent{Type: eventToolResult, ID: ids[i], Name: fc.Name, DurationMS: elapsed.Milliseconds()}
+			if err != nil {
+				fmt.Printf("%sMCP tool '%s' execution failed after %v: %v%s\n", ColorRed, fc.Name, elapsed, err, ColorReset)
+				toolResponse = map[string]any{"error": fmt.Sprintf("Tool execution failed: %v", err)}
+				result.Error = err.Error()
+			} else {
+				fmt.Printf("%sMCP tool '%s' executed successfully in %v%s\n", ColorGreen, fc.Name, elapsed, ColorReset)
+			}
+			a.auditCall(fc.Name, args, decisions[i], toolResponse, elapsed)
+			result.Response = toolResponse
+			a.events.emit(result)
+			inlineParts[i] = extraParts
+			toolResponseParts[i] = gemini.Part{
+				FunctionResponse: &gemini.FunctionResponse{
+					Name:     fc.Name,
+					Response: toolResponse,
+				},
+			}
+		}()
+	}
+	wg.Wait()
+	for _, parts := range inlineParts {
+		toolResponseParts = append(toolResponseParts, parts...)
+	}
+	return toolResponseParts
+}
+
+// generate sends one request to the model provider. When streaming is enabled, text is
+// printed as it arrives and the streamed chunks are merged into a single
+// response, so callers see the same shape either way.
+func (a *Agent) generate(ctx context.Context, request *gemini.GenerateContentRequest) (*gemini.GenerateContentResponse, error) {
+	if !a.streaming {
+		response, err := a.provider.Generate(ctx, request)
+		if err == nil && len(response.Candidates) > 0 {
+			for _, part := range response.Candidates[0].Content.Parts {
+				if isTextPart(part) {
+					a.events.text(*part.Text)
+				}
 			}
 		}
-		return map[string]any{"error": errorText}, nil
+		return response, err
 	}
 
-	var resultText string
-	for _, content := range toolResult.Content {
-		if textContent, ok := content.(*mcp.TextContent); ok {
-			resultText = textContent.Text
-			break
+	merged := &gemini.GenerateContentResponse{}
+	content := gemini.Content{Role: gemini.StringPtr("model")}
+	gotCandidate, printedText, gotFunctionCall := false, false, false
+	for chunk, err := range a.provider.GenerateStream(ctx, request) {
+		if err != nil {
+			if printedText {
+				fmt.Println()
+			}
+			return nil, err
+		}
+		if chunk.UsageMetadata != nil {
+			merged.UsageMetadata = chunk.UsageMetadata
+		}
+		if len(chunk.Candidates) == 0 {
+			continue
+		}
+		gotCandidate = true
+		for _, part := range chunk.Candidates[0].Content.Parts {
+			if isTextPart(part) {
+				fmt.Printf("%s%s%s", ColorGreen, *part.Text, ColorReset)
+				a.events.text(*part.Text)
+				printedText = printedText || *part.Text != ""
+				appendText(&content, *part.Text)
+				continue
+			}
+			// Function calls and any other parts arrive whole in a single chunk.
+			gotFunctionCall = gotFunctionCall || part.FunctionCall != nil
+			content.Parts = append(content.Parts, part)
 		}
 	}
-	return map[string]any{"result": resultText}, nil
+	if printedText && gotFunctionCall {
+		// Keep tool progress output off the line of streamed text.
+		fmt.Println()
+	}
+	if gotCandidate {
+		merged.Candidates = []gemini.Candidate{{Content: content}}
+	}
+	return merged, nil
 }
 
-// agentLoop handles the conversation loop, including function calling.
-func (a *Agent) agentLoop(prompt string) (*gemini.GenerateContentResponse, error) {
-	ctx := context.Background()
-	geminiTools := a.convertToGeminiTools()
+// isTextPart reports whether part carries only text.
+func isTextPart(part gemini.Part) bool {
+	return part.Text != nil && part.FunctionCall == nil && part.FunctionResponse == nil
+}
+
+// appendText adds streamed text to content, extending its last part when that
+// part is also text so that a streamed answer is stored as one part.
+func appendText(content *gemini.Content, text string) {
+	if n := len(content.Parts); n > 0 && isTextPart(content.Parts[n-1]) {
+		merged := *content.Parts[n-1].Text + text
+		content.Parts[n-1].Text = &merged
+		return
+	}
+	content.Parts = append(content.Parts, gemini.Part{Text: gemini.StringPtr(text)})
+}
 
-	// Add user message to conversation history
-	userContent := gemini.Content{
+// userMessage wraps a prompt typed by the user as a conversation message.
+func userMessage(prompt string) gemini.Content {
+	return gemini.Content{
 		Parts: []gemini.Part{{Text: gemini.StringPtr(prompt)}},
 		Role:  gemini.StringPtr("user"),
 	}
-	a.conversationHistory = append(a.conversationHistory, userContent)
+}
+
+// requestBase returns what every request sends besides the history: the
+// system instruction and the tools of the connected servers.
+func (a *Agent) requestBase() *gemini.GenerateContentRequest {
+	base := &gemini.GenerateContentRequest{SystemInstruction: a.systemInstruction()}
+	if geminiTools := a.convertToGeminiTools(); len(geminiTools) > 0 {
+		base.Tools = []gemini.Tool{{FunctionDeclarations: geminiTools}}
+	}
+	return base
+}
 
-	// Initial request
-	request := &gemini.GenerateContentRequest{Contents: a.conversationHistory}
-	if len(geminiTools) > 0 {
-		request.Tools = []gemini.Tool{{FunctionDeclarations: geminiTools}}
+// agentLoop handles the conversation loop, including function calling, for a
+// turn that starts by adding messages to the conversation; the last of them
+// must be from the user. If the turn fails or ctx is cancelled, the history is
+// rolled back to where it was before the turn so that no dangling function
+// calls are left behind.
+func (a *Agent) agentLoop(ctx context.Context, messages []gemini.Content) (response *gemini.GenerateContentResponse, err error) {
+	if reason := a.usage.exhausted(); reason != "" {
+		return nil, fmt.Errorf("session budget exhausted: %s; 'clear' starts a new session", reason)
 	}
+	a.usage.startTurn()
+	a.refreshServers(ctx)
+	base := a.requestBase()
+	// Compaction may rewrite earlier messages too, so keep the whole history.
+	saved, savedDropped := slices.Clone(a.conversationHistory), a.droppedMessages
+	defer func() {
+		if err != nil {
+			a.conversationHistory, a.droppedMessages = saved, savedDropped
+		} else {
+			a.pendingParts = nil
+		}
+	}()
+
+	// Add the messages to conversation history, with any attached resources
+	// leading the user's message
+	messages = slices.Clone(messages)
+	last := &messages[len(messages)-1]
+	last.Parts = append(slices.Clone(a.pendingParts), last.Parts...)
+	turnStart := len(a.conversationHistory)
+	a.conversationHistory = append(a.conversationHistory, messages...)
+	a.events.user(messages)
 
-	response, err := a.geminiClient.GenerateContent(ctx, os.Getenv("GEMINI_MODEL"), request)
+	// Initial request
+	a.fitContext(ctx, base, &turnStart)
+	request := &gemini.GenerateContentRequest{Contents: a.conversationHistory, Tools: base.Tools, SystemInstruction: base.SystemInstruction}
+	response, err = a.generate(ctx, request)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate initial content: %v", err)
 	}
+	a.recordUsage(request, response)
 
 	if len(response.Candidates) > 0 {
 		a.conversationHistory = append(a.conversationHistory, response.Candidates[0].Content)
@@ -291,60 +691,111 @@ func (a *Agent) agentLoop(prompt string) (*gemini.GenerateContentResponse, error
 		if len(functionCalls) == 0 {
 			break // No more function calls, exit loop
 		}
-
-		fmt.Printf("%sProcessing %d function call(s)...%s\n", ColorCyan, len(functionCalls), ColorReset)
-
-		var toolResponseParts []gemini.Part
-		for _, fc := range functionCalls {
-			args := fc.Args
-			if args == nil {
-				args = make(map[string]any)
+		if reason := a.usage.exhausted(); reason != "" {
+			// Answer the calls so that the history stays valid, but do not
+			// go back to the model.
+			fmt.Printf("%sStopping the tool loop: %s.%s\n", ColorYellow, reason, ColorReset)
+			skipped := make([]gemini.Part, len(functionCalls))
+			for i, fc := range functionCalls {
+				skipped[i] = gemini.Part{FunctionResponse: &gemini.FunctionResponse{
+					Name:     fc.Name,
+					Response: map[string]any{"error": "Tool call skipped: " + reason},
+				}}
 			}
-			fmt.Printf("%sAttempting to call MCP tool: '%s' with args: %v%s\n", ColorCyan, fc.Name, args, ColorReset)
+			a.conversationHistory = append(a.conversationHistory, gemini.Content{Parts: skipped, Role: gemini.StringPtr("tool")})
+			break
+		}
 
-			toolResponse, err := a.callMCPTool(fc.Name, args)
-			if err != nil {
-				fmt.Printf("%sMCP tool '%s' execution failed: %v%s\n", ColorRed, fc.Name, err, ColorReset)
-				toolResponse = map[string]any{"error": fmt.Sprintf("Tool execution failed: %v", err)}
-			} else {
-				fmt.Printf("%sMCP tool '%s' executed successfully%s\n", ColorGreen, fc.Name, ColorReset)
-			}
-			toolResponseParts = append(toolResponseParts, gemini.Part{
-				FunctionResponse: &gemini.FunctionResponse{
-					Name:     fc.Name,
-					Response: toolResponse,
-				},
-			})
+		toolResponseParts := a.executeFunctionCalls(ctx, functionCalls)
+		if err := ctx.Err(); err != nil {
+			return nil, err
 		}
 		// Add tool response to history with the correct 'tool' role
 		a.conversationHistory = append(a.conversationHistory, gemini.Content{
 			Parts: toolResponseParts,
 			Role:  gemini.StringPtr("tool"),
 		})
-		// Make the next call to the model
-		nextRequest := &gemini.GenerateContentRequest{Contents: a.conversationHistory}
-		if len(geminiTools) > 0 {
-			nextRequest.Tools = []gemini.Tool{{FunctionDeclarations: geminiTools}}
-		}
-		response, err = a.geminiClient.GenerateContent(ctx, os.Getenv("GEMINI_MODEL"), nextRequest)
+		// Make the next call to the model, offering the tools of the servers
+		// that are connected now
+		a.refreshServers(ctx)
+		base = a.requestBase()
+		a.fitContext(ctx, base, &turnStart)
+		nextRequest := &gemini.GenerateContentRequest{Contents: a.conversationHistory, Tools: base.Tools, SystemInstruction: base.SystemInstruction}
+		response, err = a.generate(ctx, nextRequest)
 		if err != nil {
 			return nil, fmt.Errorf("failed to generate content with tool result: %v", err)
 		}
+		a.recordUsage(nextRequest, response)
 		if len(response.Candidates) > 0 {
 			a.conversationHistory = append(a.conversationHistory, response.Candidates[0].Content)
 		}
 	}
 
+	if a.streaming && len(response.Candidates) > 0 {
+		// End the line of streamed text.
+		fmt.Println()
+	}
 	fmt.Printf("%sMCP tool calling loop finished.%s\n", ColorGreen, ColorReset)
 	return response, nil
 }
 
-// runChatLoop starts the interactive read-eval-print loop.
-func runChatLoop(agent *Agent) {
+// turnController tracks the in-flight agent turn so that an interrupt can
+// cancel just that turn instead of the whole process.
+type turnController struct {
+	timeout time.Duration
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+}
+
+// begin starts a new turn derived from ctx, bounded by the turn timeout. The
+// returned function must be called when the turn is over.
+func (t *turnController) begin(ctx context.Context) (context.Context, func()) {
+	var cancel context.CancelFunc
+	if t.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	t.mu.Lock()
+	t.cancel = cancel
+	t.mu.Unlock()
+	return ctx, func() {
+		t.mu.Lock()
+		t.cancel = nil
+		t.mu.Unlock()
+		cancel()
+	}
+}
+
+// interrupt cancels the in-flight turn, reporting whether there was one.
+func (t *turnController) interrupt() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cancel == nil {
+		return false
+	}
+	t.cancel()
+	t.cancel = nil
+	return true
+}
+
+// runChatLoop starts the interactive read-eval-print loop. Every turn runs
+// under a context derived from ctx and registered with turns.
+func runChatLoop(ctx context.Context, agent *Agent, turns *turnController) {
 	fmt.Printf("%s🤖 Universal MCP Agent Ready. Type 'exit' to quit.%s\n", ColorBold, ColorReset)
-	fmt.Printf("%sCommands: 'exit', 'history', 'clear', 'stats'%s\n\n", ColorGray, ColorReset)
+	fmt.Printf("%sCommands: 'exit', 'history', 'clear', 'stats',%s\n", ColorGray, ColorReset)
+	fmt.Printf("%s          '/system', '/policy', '/sessions', '/save [name]', '/load <name>', '/resume [name]', '/prompts', '/resources', '/attach <uri>', '/subscribe <uri>', '/unsubscribe <uri>', '/loglevel [level]'%s\n\n", ColorGray, ColorReset)
 
 	scanner := bufio.NewScanner(os.Stdin)
+	readLine := func(label string) (string, bool) {
+		fmt.Print(label)
+		if !scanner.Scan() {
+			return "", false
+		}
+		return strings.TrimSpace(scanner.Text()), true
+	}
+	agent.readLine = readLine
 	for {
 		fmt.Printf("%s%sYou: %s", ColorBold, ColorBlue, ColorReset)
 		if !scanner.Scan() {
@@ -359,25 +810,77 @@ func runChatLoop(agent *Agent) {
 		if userInput == "" {
 			continue
 		}
+		agent.refreshServers(ctx)
 		switch strings.ToLower(userInput) {
 		case "history":
 			agent.printConversationHistory()
 			continue
 		case "clear":
-			agent.clearConversation()
+			if err := agent.clearConversation(); err != nil {
+				fmt.Printf("%sError: %v%s\n", ColorRed, err, ColorReset)
+			}
 			continue
 		case "stats":
 			agent.showConversationStats()
 			continue
 		}
+		messages := []gemini.Content{userMessage(userInput)}
+		if strings.HasPrefix(userInput, "/") {
+			switch strings.ToLower(userInput) {
+			case "/prompts":
+				agent.printPrompts()
+				continue
+			case "/policy":
+				agent.approval.print()
+				continue
+			}
+			if agent.runSystemCommand(userInput) || agent.runSessionCommand(userInput) || agent.runResourceCommand(ctx, userInput) || agent.runLogLevelCommand(ctx, userInput) {
+				continue
+			}
+			promptMessages, handled := agent.runPromptCommand(ctx, userInput, readLine)
+			if handled {
+				if len(promptMessages) == 0 {
+					continue
+				}
+				if *promptMessages[len(promptMessages)-1].Role != "user" {
+					// Nothing for the model to answer yet; the prompt just
+					// seeds the conversation.
+					agent.conversationHistory = append(agent.conversationHistory, promptMessages...)
+					agent.persist()
+					continue
+				}
+				messages = promptMessages
+			}
+		}
 
-		fmt.Printf("%s%sGemini: %s", ColorBold, ColorGreen, ColorReset)
-		response, err := agent.agentLoop(userInput)
-		if err != nil {
+		runTurn(ctx, agent, turns, messages)
+	}
+}
+
+// runTurn sends messages to the agent and prints its reply.
+func runTurn(ctx context.Context, agent *Agent, turns *turnController, messages []gemini.Content) {
+	fmt.Printf("%s%s%s: %s", ColorBold, ColorGreen, agent.provider.Name(), ColorReset)
+	turnCtx, endTurn := turns.begin(ctx)
+	response, err := agent.agentLoop(turnCtx, messages)
+	turnErr := turnCtx.Err()
+	endTurn()
+	if err != nil {
+		agent.events.finish("", agent.sessionName, err)
+		switch {
+		case errors.Is(turnErr, context.DeadlineExceeded):
+			fmt.Printf("\n%sTurn timed out after %v and was discarded.%s\n", ColorYellow, turns.timeout, ColorReset)
+		case errors.Is(turnErr, context.Canceled):
+			fmt.Printf("\n%sTurn cancelled and discarded.%s\n", ColorYellow, ColorReset)
+		default:
 			fmt.Printf("%sError: %v%s\n", ColorRed, err, ColorReset)
-			continue
 		}
+		return
+	}
+	agent.persist()
+	agent.events.finish(responseText(response), agent.sessionName, nil)
 
+	// Streamed text has already been printed as it arrived.
+	if !agent.streaming {
 		for _, candidate := range response.Candidates {
 			for _, part := range candidate.Content.Parts {
 				if part.Text != nil && *part.Text != "" {
@@ -390,32 +893,152 @@ func runChatLoop(agent *Agent) {
 }
 
 func main() {
-	fmt.Printf("%s--- Gemini Universal MCP Client ---%s\n", ColorBold, ColorReset)
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		os.Exit(runAuditCommand(os.Args[2:]))
+	}
 
-	// Initialize Gemini client
-	geminiClient := gemini.NewClient(os.Getenv("GEMINI_API_KEY"), gemini.WithBaseURL(os.Getenv("GEMINI_BASE_URL")))
+	turnTimeout := flag.Duration("turn-timeout", envDuration("AGENT_TURN_TIMEOUT", 10*time.Minute),
+		"maximum duration of one agent turn, 0 for no limit (env AGENT_TURN_TIMEOUT)")
+	toolTimeout := flag.Duration("tool-timeout", envDuration("MCP_TOOL_TIMEOUT", 2*time.Minute),
+		"maximum duration of one MCP tool call, 0 for no limit (env MCP_TOOL_TIMEOUT)")
+	stream := flag.Bool("stream", os.Getenv("GEMINI_STREAM") != "false",
+		"stream model output as it is generated (env GEMINI_STREAM=false to disable)")
+	contextBudget := flag.Int("context-budget", envInt("GEMINI_CONTEXT_BUDGET", 128000),
+		"estimated prompt tokens above which history is compacted, 0 for no limit (env GEMINI_CONTEXT_BUDGET)")
+	compaction := flag.String("compaction", envString("GEMINI_COMPACTION", "truncate,summarize,drop"),
+		"compaction strategies to apply in order: truncate, summarize, drop (env GEMINI_COMPACTION)")
+	systemPrompt := flag.String("system-prompt", os.Getenv(sysprompt.EnvFile),
+		"file holding the system prompt template (env "+sysprompt.EnvFile+")")
+	approvalDefault := flag.String("approval", envString("MCP_APPROVAL_DEFAULT", approvalAsk),
+		"action for tool calls no approval rule matches: allow, deny or ask (env MCP_APPROVAL_DEFAULT; rules are read from env MCP_APPROVAL_POLICY, default mcp_approval.json)")
+	tokenBudget := flag.Int("token-budget", envInt("AGENT_TOKEN_BUDGET", 0),
+		"tokens a session may use before the tool loop is stopped, 0 for no limit (env AGENT_TOKEN_BUDGET)")
+	costBudget := flag.Float64("cost-budget", envFloat("AGENT_COST_BUDGET", 0),
+		"estimated US dollars a session may spend before the tool loop is stopped, 0 for no limit (env AGENT_COST_BUDGET; prices are read from env MODEL_PRICES, default model_prices.json)")
+	resume := flag.String("resume", "",
+		"resume a saved session by name, or 'last' for the most recent one (sessions are kept in env AGENT_SESSION_DIR)")
+	prompt := flag.String("p", "",
+		"answer this prompt and exit, printing only the answer on stdout; '-' reads the prompt from stdin")
+	batch := flag.String("batch", "",
+		"answer every prompt of this JSONL file ('-' for stdin), each in a fresh conversation, and print one JSON result per line")
+	output := flag.String("output", envString("AGENT_OUTPUT", outputText),
+		"output format: text, json (one object per turn) or stream-json (one event per line) (env AGENT_OUTPUT)")
+	mcpLogLevel := flag.String("mcp-log-level", envString("MCP_LOG_LEVEL", "info"),
+		"lowest level of MCP server log messages to request and show: debug, info, notice, warning, error, critical, alert, emergency or off (env MCP_LOG_LEVEL)")
+	flag.Parse()
+	if *prompt != "" && *batch != "" {
+		fmt.Fprintln(os.Stderr, "Error: -p and -batch cannot be used together")
+		os.Exit(exitUsage)
+	}
+	if level := strings.ToLower(*mcpLogLevel); logLevelRank(level) < 0 && level != logLevelOff {
+		fmt.Fprintf(os.Stderr, "Error: unknown -mcp-log-level %q\n", *mcpLogLevel)
+		os.Exit(exitUsage)
+	}
+	if *batch != "" && *output != outputText {
+		fmt.Fprintln(os.Stderr, "Error: -batch always writes JSON results; -output applies to the chat and -p")
+		os.Exit(exitUsage)
+	}
+
+	// Without a REPL, or with a JSON output format, stdout carries only the
+	// results; everything else the client prints goes to stderr. Without a
+	// REPL, tool calls the approval policy would ask about are rejected,
+	// since nobody is there to answer.
+	results := os.Stdout
+	events, err := newEventOutput(*output, results)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitUsage)
+	}
+	interactive := *prompt == "" && *batch == ""
+	if !interactive || events != nil {
+		os.Stdout = os.Stderr
+	}
+
+	fmt.Printf("%s--- Gemini Universal MCP Client ---%s\n", ColorBold, ColorReset)
+	ctx := context.Background()
 
-	// Initialize MCP client and session
-	mcpClient := mcp.NewClient(&mcp.Implementation{Name: "gemini-mcp-client", Version: "v1.0.0"}, nil)
-	mcpServerURL := os.Getenv("MCP_SERVER_URL")
-	if mcpServerURL == "" {
-		mcpServerURL = "http://localhost:8080/mcp"
+	// Initialize the model provider chosen by AI_PROVIDER, retrying failed
+	// model requests
+	retry := httpretry.New(mcpBaseTransport)
+	retry.Logf = func(format string, args ...any) {
+		fmt.Printf("\n%s⏳ %s%s\n", ColorYellow, fmt.Sprintf(format, args...), ColorReset)
+	}
+	provider, err := newProvider(retry)
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", ColorRed, err, ColorReset)
+		os.Exit(exitUsage)
 	}
 
-	fmt.Printf("%sConnecting to MCP server: %s%s\n", ColorCyan, mcpServerURL, ColorReset)
-	transport := mcp.NewStreamableClientTransport(mcpServerURL, nil)
-	session, err := mcpClient.Connect(context.Background(), transport)
+	// Initialize MCP client and one session per configured server
+	config, err := loadMCPConfig()
 	if err != nil {
-		fmt.Printf("%sWarning: Failed to connect to MCP server: %v%s\n", ColorYellow, err, ColorReset)
+		fmt.Printf("%sWarning: %v%s\n", ColorYellow, err, ColorReset)
+		config = &MCPConfig{}
+	}
+
+	pool := connectMCPServers(ctx, config)
+	defer pool.Close()
+	if err := pool.setLogLevel(ctx, strings.ToLower(*mcpLogLevel)); err != nil {
+		fmt.Printf("%sWarning: %v%s\n", ColorYellow, err, ColorReset)
+	}
+	if len(pool.names()) == 0 {
 		fmt.Printf("%sContinuing without MCP tools...%s\n", ColorYellow, ColorReset)
-	} else {
-		defer session.Close()
-		fmt.Printf("%s✅ Successfully connected to MCP server%s\n", ColorGreen, ColorReset)
 	}
 
+	// Ctrl-C cancels the in-flight turn. At the prompt, or on SIGTERM, make
+	// sure spawned servers are shut down cleanly before exiting.
+	turns := &turnController{timeout: *turnTimeout}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for sig := range signals {
+			if sig == os.Interrupt && turns.interrupt() {
+				continue
+			}
+			fmt.Printf("\n%sShutting down MCP servers...%s\n", ColorGray, ColorReset)
+			pool.Close()
+			os.Exit(exitInterrupted)
+		}
+	}()
+
 	// Create and configure the agent
-	agent := NewAgent(geminiClient, session)
-	if err := agent.discoverTools(); err != nil {
+	agent, err := NewAgent(provider, pool)
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", ColorRed, err, ColorReset)
+		pool.Close()
+		os.Exit(exitUsage)
+	}
+	pool.handle(notificationResourceUpdated, agent.resourceUpdated)
+	pool.handle(notificationProgress, agent.progress.update)
+	pool.handle(notificationLoggingMessage, agent.serverLog)
+	agent.progress.inPlace = interactive && events == nil
+	agent.toolTimeout = *toolTimeout
+	agent.events = events
+	agent.streaming = *stream
+	agent.contextBudget = *contextBudget
+	if agent.systemTemplate, err = sysprompt.Load(*systemPrompt); err != nil {
+		fmt.Printf("%sError: %v%s\n", ColorRed, err, ColorReset)
+		os.Exit(exitUsage)
+	}
+	if agent.compaction, err = parseCompaction(*compaction); err != nil {
+		fmt.Printf("%sError: %v%s\n", ColorRed, err, ColorReset)
+		os.Exit(exitUsage)
+	}
+	if agent.approval, err = loadApprovalPolicy(*approvalDefault); err != nil {
+		fmt.Printf("%sError: %v%s\n", ColorRed, err, ColorReset)
+		os.Exit(exitUsage)
+	}
+	prices, err := loadPrices()
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", ColorRed, err, ColorReset)
+		os.Exit(exitUsage)
+	}
+	agent.usage = newUsageTracker(provider.Model(), prices)
+	agent.usage.tokenBudget, agent.usage.costBudget = *tokenBudget, *costBudget
+	if agent.usage.costBudget > 0 && !agent.usage.priced {
+		fmt.Printf("%sWarning: no price for model %q, the cost budget cannot be enforced.%s\n", ColorYellow, provider.Model(), ColorReset)
+	}
+	if err := agent.discoverCapabilities(ctx); err != nil {
 		fmt.Printf("%sWarning: Failed to discover capabilities: %v%s\n", ColorYellow, err, ColorReset)
 	}
 
@@ -425,10 +1048,31 @@ func main() {
 			fmt.Printf("%s- %s: %s%s\n", ColorGreen, tool.Name, tool.Description, ColorReset)
 		}
 		fmt.Printf("------------------------\n\n")
-	} else {
+	} else if len(agent.discoveredResources) == 0 {
 		fmt.Printf("%sNo MCP tools available. Running in basic chat mode.%s\n", ColorYellow, ColorReset)
 	}
+	if len(agent.discoveredResources) > 0 {
+		fmt.Printf("%s%d MCP resource(s) available; type '/resources' to browse them.%s\n\n", ColorCyan, len(agent.discoveredResources), ColorReset)
+	}
+
+	if *resume != "" {
+		if err := agent.resumeSession(*resume, false); err != nil {
+			fmt.Printf("%sWarning: Failed to resume session: %v%s\n", ColorYellow, err, ColorReset)
+		}
+	}
+
+	if !interactive {
+		var code int
+		if *prompt != "" {
+			code = runOneShot(ctx, agent, turns, *prompt, results)
+		} else {
+			code = runBatch(ctx, agent, turns, *batch, results)
+		}
+		// os.Exit skips deferred calls, so shut the servers down first.
+		pool.Close()
+		os.Exit(code)
+	}
 
 	// Start interactive chat
-	runChatLoop(agent)
+	runChatLoop(ctx, agent, turns)
 }
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// logLevels are the MCP logging levels from the least to the most severe.
+var logLevels = []string{"debug", "info", "notice", "warning", "error", "critical", "alert", "emergency"}
+
+// logLevelOff turns server logging off.
+const logLevelOff = "off"
+
+// logLevelRank returns the position of level in logLevels, or -1.
+func logLevelRank(level string) int {
+	return slices.Index(logLevels, level)
+}
+
+// progressBarWidth is the number of cells of a progress bar.
+const progressBarWidth = 24
+
+// progressDisplay shows the notifications/progress of running tool calls.
+// Each call is sent with its own progress token. In place, the latest update
+// is drawn as a bar on the current line, which server log messages clear
+// before they are printed; otherwise each update is a line of its own.
+type progressDisplay struct {
+	inPlace bool
+
+	mu    sync.Mutex
+	next  int
+	calls map[string]string
+	shown bool
+}
+
+func newProgressDisplay() *progressDisplay {
+	return &progressDisplay{calls: make(map[string]string)}
+}
+
+// start returns the progress token for a call of tool.
+func (d *progressDisplay) start(tool string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.next++
+	token := fmt.Sprintf("call-%d", d.next)
+	d.calls[token] = tool
+	return token
+}
+
+// done forgets the call with token, removing its bar.
+func (d *progressDisplay) done(token string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.calls, token)
+	d.clearLine()
+}
+
+// clearLine removes the bar from the current line; d.mu must be held.
+func (d *progressDisplay) clearLine() {
+	if d.shown {
+		fmt.Print("\r\033[K")
+		d.shown = false
+	}
+}
+
+// update handles notifications/progress.
+func (d *progressDisplay) update(server string, params json.RawMessage) {
+	var progress mcp.ProgressNotificationParams
+	if err := json.Unmarshal(params, &progress); err != nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	tool, ok := d.calls[fmt.Sprint(progress.ProgressToken)]
+	if !ok {
+		// The call is over, or the token is not ours.
+		return
+	}
+
+	line := fmt.Sprintf("  ⏳ %s %s", tool, progressBar(progress.Progress, progress.Total))
+	if progress.Message != "" {
+		line += " " + progress.Message
+	}
+	if d.inPlace {
+		fmt.Printf("\r\033[K%s%s%s", ColorCyan, line, ColorReset)
+		d.shown = true
+	} else {
+		fmt.Printf("%s%s%s\n", ColorCyan, line, ColorReset)
+	}
+}
+
+// progressBar renders progress out of total, or just the progress made when
+// the total is unknown.
+func progressBar(progress, total float64) string {
+	if total <= 0 {
+		return fmt.Sprintf("%g done", progress)
+	}
+	fraction := math.Max(0, math.Min(1, progress/total))
+	filled := int(fraction * progressBarWidth)
+	return fmt.Sprintf("[%s%s] %3.0f%% (%g/%g)",
+		strings.Repeat("█", filled), strings.Repeat("░", progressBarWidth-filled), fraction*100, progress, total)
+}
+
+// serverLog handles notifications/message, printing the messages at or above
+// the requested logging level.
+func (a *Agent) serverLog(server string, params json.RawMessage) {
+	var message mcp.LoggingMessageParams
+	if err := json.Unmarshal(params, &message); err != nil {
+		return
+	}
+	level := string(message.Level)
+	requested := a.servers.level()
+	if requested == logLevelOff || logLevelRank(level) < logLevelRank(requested) {
+		return
+	}
+
+	text, ok := message.Data.(string)
+	if !ok {
+		data, _ := json.Marshal(message.Data)
+		text = string(data)
+	}
+	source := server
+	if message.Logger != "" {
+		source += "/" + message.Logger
+	}
+	color := ColorGray
+	switch rank := logLevelRank(level); {
+	case rank >= logLevelRank("error"):
+		color = ColorRed
+	case rank >= logLevelRank("warning"):
+		color = ColorYellow
+	case rank >= logLevelRank("notice"):
+		color = ColorCyan
+	}
+
+	a.progress.mu.Lock()
+	defer a.progress.mu.Unlock()
+	a.progress.clearLine()
+	fmt.Printf("%s📋 [%s] %s: %s%s\n", color, source, strings.ToUpper(level), text, ColorReset)
+}
+
+// runLogLevelCommand handles "/loglevel [level]", showing or changing the
+// level of the server log messages shown.
+func (a *Agent) runLogLevelCommand(ctx context.Context, input string) bool {
+	fields := strings.Fields(input)
+	if strings.ToLower(fields[0]) != "/loglevel" {
+		return false
+	}
+	if len(fields) == 1 {
+		fmt.Printf("%sServer log level: %s (one of %s, or %s)%s\n", ColorCyan, a.servers.level(), strings.Join(logLevels, ", "), logLevelOff, ColorReset)
+		return true
+	}
+	if err := a.servers.setLogLevel(ctx, strings.ToLower(fields[1])); err != nil {
+		fmt.Printf("%sError: %v%s\n", ColorRed, err, ColorReset)
+		return true
+	}
+	fmt.Printf("%sServer log level set to %s.%s\n", ColorGreen, a.servers.level(), ColorReset)
+	return true
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"iter"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gemini-mcp-bash/internal/httpretry"
+
+	"github.com/liuzl/ai/gemini"
+)
+
+// openAIProvider talks to the OpenAI chat completions API, or any endpoint
+// compatible with it, configured with OPENAI_API_KEY, OPENAI_BASE_URL and
+// OPENAI_MODEL.
+type openAIProvider struct {
+	client   *http.Client
+	apiKey   string
+	endpoint string
+	model    string
+}
+
+func newOpenAIProvider(transport http.RoundTripper) *openAIProvider {
+	baseURL := os.Getenv("OPENAI_BASE_URL")
+	if baseURL == "" {
+		baseURL = "https://api.openai.com"
+	}
+	// Like the ai package, take the base URL with or without the API version.
+	baseURL = strings.TrimSuffix(strings.TrimRight(baseURL, "/"), "/v1")
+	model := os.Getenv("OPENAI_MODEL")
+	if model == "" {
+		model = "gpt-4o-mini"
+	}
+	return &openAIProvider{
+		client:   &http.Client{Transport: transport},
+		apiKey:   os.Getenv("OPENAI_API_KEY"),
+		endpoint: baseURL + "/v1/chat/completions",
+		model:    model,
+	}
+}
+
+func (p *openAIProvider) Name() string { return "OpenAI" }
+
+func (p *openAIProvider) Model() string { return p.model }
+
+// Chat completions wire format.
+type openAIRequest struct {
+	Model         string               `json:"model"`
+	Messages      []openAIMessage      `json:"messages"`
+	Tools         []openAITool         `json:"tools,omitempty"`
+	Stream        bool                 `json:"stream,omitempty"`
+	StreamOptions *openAIStreamOptions `json:"stream_options,omitempty"`
+}
+
+type openAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type openAIMessage struct {
+	Role string `json:"role"`
+	// Content is a string, or a list of openAIContentPart for messages with
+	// images.
+	Content    any              `json:"content,omitempty"`
+	ToolCalls  []openAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+
+type openAIContentPart struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	ImageURL *openAIImageURL `json:"image_url,omitempty"`
+}
+
+type openAIImageURL struct {
+	URL string `json:"url"`
+}
+
+type openAIToolCall struct {
+	// Index identifies the call a streamed fragment belongs to.
+	Index    *int               `json:"index,omitempty"`
+	ID       string             `json:"id,omitempty"`
+	Type     string             `json:"type,omitempty"`
+	Function openAIFunctionCall `json:"function"`
+}
+
+type openAIFunctionCall struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
+
+type openAITool struct {
+	Type     string             `json:"type"`
+	Function openAIFunctionDecl `json:"function"`
+}
+
+type openAIFunctionDecl struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Parameters  map[string]any `json:"parameters"`
+}
+
+type openAIResponse struct {
+	Choices []struct {
+		Message      openAIReply `json:"message"`
+		Delta        openAIReply `json:"delta"`
+		FinishReason *string     `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *openAIUsage `json:"usage"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type openAIReply struct {
+	Content   *string          `json:"content"`
+	ToolCalls []openAIToolCall `json:"tool_calls"`
+}
+
+type openAIUsage struct {
+	PromptTokens        int `json:"prompt_tokens"`
+	CompletionTokens    int `json:"completion_tokens"`
+	TotalTokens         int `json:"total_tokens"`
+	PromptTokensDetails struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"prompt_tokens_details"`
+	CompletionTokensDetails struct {
+		ReasoningTokens int `json:"reasoning_tokens"`
+	} `json:"completion_tokens_details"`
+}
+
+// openAIUsageMetadata converts OpenAI usage to Gemini's, which counts
+// reasoning tokens apart from the candidates.
+func openAIUsageMetadata(usage *openAIUsage) *gemini.UsageMetadata {
+	reasoning := usage.CompletionTokensDetails.ReasoningTokens
+	return &gemini.UsageMetadata{
+		PromptTokenCount:        usage.PromptTokens,
+		CachedContentTokenCount: usage.PromptTokensDetails.CachedTokens,
+		CandidatesTokenCount:    usage.CompletionTokens - reasoning,
+		ThoughtsTokenCount:      reasoning,
+		TotalTokenCount:         usage.TotalTokens,
+	}
+}
+
+// openAIFinishReasons maps OpenAI finish reasons to Gemini's.
+var openAIFinishReasons = map[string]string{
+	"stop":           "STOP",
+	"tool_calls":     "STOP",
+	"length":         "MAX_TOKENS",
+	"content_filter": "SAFETY",
+}
+
+var invalidFunctionNameChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// maxFunctionName is the longest function name OpenAI and Anthropic accept.
+const maxFunctionName = 64
+
+// safeFunctionName makes a namespaced "server.tool" name acceptable to OpenAI
+// and Anthropic, which only allow letters, digits, '_' and '-'.
+func safeFunctionName(name string) string {
+	return invalidFunctionNameChars.ReplaceAllString(strings.ReplaceAll(name, ".", "__"), "_")
+}
+
+// functionNames renames the functions of one request for OpenAI or Anthropic
+// and maps the names the model calls back. Different names can make the same
+// safe name ("a.b" and "a__b", "a-b!" and "a-b_"), and safe names can be too
+// long, so those get a suffix made from a hash of the original name.
+type functionNames struct {
+	safe     map[string]string // original name to safe name
+	original map[string]string // safe name to original name
+}
+
+func newFunctionNames() *functionNames {
+	return &functionNames{safe: make(map[string]string), original: make(map[string]string)}
+}
+
+// rename returns the safe name of a function, the same one every time.
+func (n *functionNames) rename(name string) string {
+	if renamed, ok := n.safe[name]; ok {
+		return renamed
+	}
+	renamed := safeFunctionName(name)
+	if _, taken := n.original[renamed]; taken || len(renamed) > maxFunctionName {
+		hash := fnv.New32a()
+		hash.Write([]byte(name))
+		suffix := fmt.Sprintf("_%08x", hash.Sum32())
+		// Leave room for a counter after the suffix.
+		base := renamed[:min(len(renamed), maxFunctionName-len(suffix)-3)]
+		renamed = base + suffix
+		// A hash collision as well is all but impossible, but stay unique.
+		for i := 2; ; i++ {
+			if _, taken := n.original[renamed]; !taken {
+				break
+			}
+			renamed = fmt.Sprintf("%s%s_%d", base, suffix, i)
+		}
+	}
+	n.safe[name] = renamed
+	n.original[renamed] = name
+	return renamed
+}
+
+// lookup maps a name the model called back to the original function name.
+// Names that were never renamed are returned as they are.
+func (n *functionNames) lookup(renamed string) string {
+	if name, ok := n.original[renamed]; ok {
+		return name
+	}
+	return renamed
+}
+
+// openAIConversation is a Gemini request translated for OpenAI, with the
+// function names it renamed so they can be mapped back.
+type openAIConversation struct {
+	request *openAIRequest
+	names   *functionNames
+}
+
+func (p *openAIProvider) translate(request *gemini.GenerateContentRequest) *openAIConversation {
+	c := &openAIConversation{
+		request: &openAIRequest{Model: p.model},
+		names:   newFunctionNames(),
+	}
+	rename := c.names.rename
+
+	if request.SystemInstruction != nil {
+		if text := contentText(*request.SystemInstruction); text != "" {
+			c.request.Messages = append(c.request.Messages, openAIMessage{Role: "system", Content: text})
+		}
+	}
+	for _, tool := range request.Tools {
+		for _, decl := range tool.FunctionDeclarations {
+			c.request.Tools = append(c.request.Tools, openAITool{
+				Type: "function",
+				Function: openAIFunctionDecl{
+					Name:        rename(decl.Name),
+					Description: decl.Description,
+					Parameters:  jsonSchema(decl.Parameters),
+				},
+			})
+		}
+	}
+
+	// Gemini pairs function responses with calls by name and order, OpenAI by
+	// ID, so give every call an ID and hand them out to the responses.
+	callIDs := make(map[string][]string)
+	for i, content := range request.Contents {
+		if content.Role != nil && *content.Role == "model" {
+			message := openAIMessage{Role: "assistant"}
+			if text := contentText(content); text != "" {
+				message.Content = text
+			}
+			for j, part := range content.Parts {
+				if part.FunctionCall == nil {
+					continue
+				}
+				id := fmt.Sprintf("call_%d_%d", i, j)
+				callIDs[part.FunctionCall.Name] = append(callIDs[part.FunctionCall.Name], id)
+				args, _ := json.Marshal(part.FunctionCall.Args)
+				if part.FunctionCall.Args == nil {
+					args = []byte("{}")
+				}
+				message.ToolCalls = append(message.ToolCalls, openAIToolCall{
+					ID:       id,
+					Type:     "function",
+					Function: openAIFunctionCall{Name: rename(part.FunctionCall.Name), Arguments: string(args)},
+				})
+			}
+			c.request.Messages = append(c.request.Messages, message)
+			continue
+		}
+
+		var parts []openAIContentPart
+		hasImage := false
+		for j, part := range content.Parts {
+			switch {
+			case part.FunctionResponse != nil:
+				name := part.FunctionResponse.Name
+				id := fmt.Sprintf("call_%d_%d", i, j)
+				if ids := callIDs[name]; len(ids) > 0 {
+					id, callIDs[name] = ids[0], ids[1:]
+				}
+				response, _ := json.Marshal(part.FunctionResponse.Response)
+				c.request.Messages = append(c.request.Messages, openAIMessage{Role: "tool", ToolCallID: id, Content: string(response)})
+			case part.InlineData != nil && strings.HasPrefix(part.InlineData.MimeType, "image/"):
+				hasImage = true
+				parts = append(parts, openAIContentPart{
+					Type:     "image_url",
+					ImageURL: &openAIImageURL{URL: "data:" + part.InlineData.MimeType + ";base64," + part.InlineData.Data},
+				})
+			case part.InlineData != nil:
+				parts = append(parts, openAIContentPart{
+					Type: "text",
+					Text: fmt.Sprintf("[%s attachment omitted: not supported by this provider]", part.InlineData.MimeType),
+				})
+			case part.Text != nil:
+				parts = append(parts, openAIContentPart{Type: "text", Text: *part.Text})
+			}
+		}
+		if len(parts) == 0 {
+			continue
+		}
+		// Images sent by tools follow their responses as a user message,
+		// since tool messages can only carry text.
+		message := openAIMessage{Role: "user", Content: parts}
+		if !hasImage {
+			texts := make([]string, len(parts))
+			for k, part := range parts {
+				texts[k] = part.Text
+			}
+			message.Content = strings.Join(texts, "\n")
+		}
+		c.request.Messages = append(c.request.Messages, message)
+	}
+	return c
+}
+
+// contentText joins the text parts of content.
+func contentText(content gemini.Content) string {
+	var texts []string
+	for _, part := range content.Parts {
+		if part.Text != nil && *part.Text != "" {
+			texts = append(texts, *part.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// jsonSchema converts Gemini function parameters back into JSON Schema.
+func jsonSchema(s *gemini.Schema) map[string]any {
+	if s == nil {
+		return map[string]any{"type": "object", "properties": map[string]any{}}
+	}
+	schema := map[string]any{}
+	if s.Type != "" {
+		schema["type"] = s.Type
+	}
+	if s.Description != "" {
+		schema["description"] = s.Description
+	}
+	if s.Format != "" && s.Format != "enum" {
+		schema["format"] = s.Format
+	}
+	if len(s.Enum) > 0 {
+		schema["enum"] = s.Enum
+	}
+	if s.Items != nil {
+		schema["items"] = jsonSchema(s.Items)
+	}
+	if s.Type == "object" {
+		properties := map[string]any{}
+		for name, property := range s.Properties {
+			properties[name] = jsonSchema(property)
+		}
+		schema["properties"] = properties
+		if len(s.Required) > 0 {
+			schema["required"] = s.Required
+		}
+	}
+	return schema
+}
+
+// post sends a chat completions request.
+func (p *openAIProvider) post(ctx context.Context, request *openAIRequest) (*http.Response, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request: %v", err)
+	}
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	if p.apiKey != "" {
+		httpRequest.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+	httpResponse, err := p.client.Do(httpRequest)
+	if err != nil {
+		return nil, err
+	}
+	if httpResponse.StatusCode >= 400 {
+		defer httpResponse.Body.Close()
+		data, _ := io.ReadAll(httpResponse.Body)
+		return nil, fmt.Errorf("OpenAI API error: %v", httpretry.NewStatusError(httpResponse, data))
+	}
+	return httpResponse, nil
+}
+
+func (p *openAIProvider) Generate(ctx context.Context, request *gemini.GenerateContentRequest) (*gemini.GenerateContentResponse, error) {
+	conversation := p.translate(request)
+	httpResponse, err := p.post(ctx, conversation.request)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+	var response openAIResponse
+	if err := json.NewDecoder(httpResponse.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %v", err)
+	}
+
+	result := &gemini.GenerateContentResponse{}
+	if response.Usage != nil {
+		result.UsageMetadata = openAIUsageMetadata(response.Usage)
+	}
+	if len(response.Choices) == 0 {
+		return result, nil
+	}
+	choice := response.Choices[0]
+	content := gemini.Content{Role: gemini.StringPtr("model")}
+	if choice.Message.Content != nil && *choice.Message.Content != "" {
+		content.Parts = append(content.Parts, gemini.Part{Text: choice.Message.Content})
+	}
+	content.Parts = append(content.Parts, conversation.functionCalls(choice.Message.ToolCalls)...)
+	candidate := gemini.Candidate{Content: content}
+	if choice.FinishReason != nil {
+		candidate.FinishReason = openAIFinishReasons[*choice.FinishReason]
+	}
+	result.Candidates = []gemini.Candidate{candidate}
+	return result, nil
+}
+
+// functionCalls converts tool calls back into Gemini function calls.
+func (c *openAIConversation) functionCalls(calls []openAIToolCall) []gemini.Part {
+	var parts []gemini.Part
+	for _, call := range calls {
+		name := c.names.lookup(call.Function.Name)
+		var args map[string]any
+		if strings.TrimSpace(call.Function.Arguments) != "" {
+			if err := json.Unmarshal([]byte(call.Function.Arguments), &args); err != nil {
+				// Let the tool report what it was given rather than dropping the call.
+				args = map[string]any{"invalid_arguments": call.Function.Arguments}
+			}
+		}
+		parts = append(parts, gemini.Part{FunctionCall: &gemini.FunctionCall{Name: name, Args: args}})
+	}
+	return parts
+}
+
+// GenerateStream streams text deltas as they arrive. Tool call fragments are
+// collected and emitted whole once the choice finishes.
+func (p *openAIProvider) GenerateStream(ctx context.Context, request *gemini.GenerateContentRequest) iter.Seq2[*gemini.GenerateContentResponse, error] {
+	return func(yield func(*gemini.GenerateContentResponse, error) bool) {
+		conversation := p.translate(request)
+		conversation.request.Stream = true
+		conversation.request.StreamOptions = &openAIStreamOptions{IncludeUsage: true}
+		httpResponse, err := p.post(ctx, conversation.request)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		defer httpResponse.Body.Close()
+
+		chunk := func(parts ...gemini.Part) *gemini.GenerateContentResponse {
+			return &gemini.GenerateContentResponse{Candidates: []gemini.Candidate{{
+				Content: gemini.Content{Role: gemini.StringPtr("model"), Parts: parts},
+			}}}
+		}
+		calls := make(map[int]*openAIToolCall)
+		flush := func() bool {
+			if len(calls) == 0 {
+				return true
+			}
+			indexes := make([]int, 0, len(calls))
+			for index := range calls {
+				indexes = append(indexes, index)
+			}
+			sort.Ints(indexes)
+			ordered := make([]openAIToolCall, len(indexes))
+			for k, index := range indexes {
+				ordered[k] = *calls[index]
+			}
+			clear(calls)
+			return yield(chunk(conversation.functionCalls(ordered)...), nil)
+		}
+
+		scanner := bufio.NewScanner(httpResponse.Body)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data:")
+			if !ok {
+				continue
+			}
+			data = strings.TrimSpace(data)
+			if data == "[DONE]" {
+				break
+			}
+			var response openAIResponse
+			if err := json.Unmarshal([]byte(data), &response); err != nil {
+				yield(nil, fmt.Errorf("failed to decode stream chunk: %v", err))
+				return
+			}
+			if response.Error != nil {
+				yield(nil, fmt.Errorf("OpenAI API error: %s", response.Error.Message))
+				return
+			}
+			for _, choice := range response.Choices {
+				if choice.Delta.Content != nil && *choice.Delta.Content != "" {
+					if !yield(chunk(gemini.Part{Text: choice.Delta.Content}), nil) {
+						return
+					}
+				}
+				for _, fragment := range choice.Delta.ToolCalls {
+					index := len(calls)
+					if fragment.Index != nil {
+						index = *fragment.Index
+					}
+					call, ok := calls[index]
+					if !ok {
+						call = &openAIToolCall{}
+						calls[index] = call
+					}
+					if fragment.ID != "" {
+						call.ID = fragment.ID
+					}
+					call.Function.Name += fragment.Function.Name
+					call.Function.Arguments += fragment.Function.Arguments
+				}
+				if choice.FinishReason != nil && !flush() {
+					return
+				}
+			}
+			if response.Usage != nil {
+				usage := &gemini.GenerateContentResponse{UsageMetadata: openAIUsageMetadata(response.Usage)}
+				if !yield(usage, nil) {
+					return
+				}
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			yield(nil, err)
+			return
+		}
+		flush()
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/liuzl/ai/gemini"
+)
+
+func TestFunctionNames(t *testing.T) {
+	long := "server." + strings.Repeat("x", 70)
+	tests := []struct {
+		name  string
+		names []string
+		want  []string // "" when only the properties below are checked
+	}{
+		{
+			name:  "namespaced names",
+			names: []string{"shell.execute_shell", "fs.read-file", "web.fetch url!"},
+			want:  []string{"shell__execute_shell", "fs__read-file", "web__fetch_url_"},
+		},
+		{
+			name:  "'.' and '__' collide",
+			names: []string{"a.b", "a__b"},
+			want:  []string{"a__b", ""},
+		},
+		{
+			name:  "replaced characters collide",
+			names: []string{"s.a-b!", "s.a-b_", "s.a-b?"},
+			want:  []string{"s__a-b_", "", ""},
+		},
+		{
+			name:  "names too long",
+			names: []string{long, long + "y"},
+			want:  []string{"", ""},
+		},
+		{
+			name:  "exactly the longest name",
+			names: []string{strings.Repeat("x", maxFunctionName)},
+			want:  []string{strings.Repeat("x", maxFunctionName)},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			names := newFunctionNames()
+			seen := make(map[string]string)
+			for i, name := range test.names {
+				renamed := names.rename(name)
+				if test.want[i] != "" && renamed != test.want[i] {
+					t.Errorf("rename(%q) = %q, want %q", name, renamed, test.want[i])
+				}
+				if len(renamed) > maxFunctionName || invalidFunctionNameChars.MatchString(renamed) {
+					t.Errorf("rename(%q) = %q, not a valid function name", name, renamed)
+				}
+				if other, ok := seen[renamed]; ok {
+					t.Errorf("%q and %q are both renamed to %q", other, name, renamed)
+				}
+				seen[renamed] = name
+				if again := names.rename(name); again != renamed {
+					t.Errorf("rename(%q) = %q, then %q", name, renamed, again)
+				}
+			}
+			for renamed, name := range seen {
+				if got := names.lookup(renamed); got != name {
+					t.Errorf("lookup(%q) = %q, want %q", renamed, got, name)
+				}
+			}
+		})
+	}
+	if got := newFunctionNames().lookup("unknown"); got != "unknown" {
+		t.Errorf("lookup(unknown) = %q, want it unchanged", got)
+	}
+}
+
+func TestOpenAIMapsCollidingNamesBack(t *testing.T) {
+	request := &gemini.GenerateContentRequest{Tools: []gemini.Tool{{FunctionDeclarations: []gemini.FunctionDeclaration{
+		{Name: "a.b"}, {Name: "a__b"},
+	}}}}
+	c := (&openAIProvider{model: "test-model"}).translate(request)
+	if len(c.request.Tools) != 2 {
+		t.Fatalf("translated %d tools, want 2", len(c.request.Tools))
+	}
+	var calls []openAIToolCall
+	for _, tool := range c.request.Tools {
+		calls = append(calls, openAIToolCall{Function: openAIFunctionCall{Name: tool.Function.Name, Arguments: "{}"}})
+	}
+	parts := c.functionCalls(calls)
+	if len(parts) != 2 || parts[0].FunctionCall.Name != "a.b" || parts[1].FunctionCall.Name != "a__b" {
+		t.Errorf("calls mapped back to %+v, want a.b and a__b", parts)
+	}
+}
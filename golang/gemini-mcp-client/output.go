@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/liuzl/ai/gemini"
+)
+
+// Output formats. In the JSON formats stdout carries only events and all
+// other output goes to stderr.
+const (
+	outputText = "text"
+	// outputJSON writes one turnOutput per turn, once the turn is over.
+	outputJSON = "json"
+	// outputStreamJSON writes every event as a line of JSON as it happens.
+	outputStreamJSON = "stream-json"
+)
+
+// Event types.
+const (
+	eventUser       = "user"
+	eventText       = "text"
+	eventToolCall   = "tool_call"
+	eventToolResult = "tool_result"
+	eventUsage      = "usage"
+	eventFinal      = "final"
+	eventError      = "error"
+)
+
+// outputEvent is something that happened during a turn. Text events carry
+// the model's text as it is generated; tool_call and tool_result events of the
+// same call share an ID.
+type outputEvent struct {
+	Type       string         `json:"type"`
+	Time       time.Time      `json:"time"`
+	Text       string         `json:"text,omitempty"`
+	ID         string         `json:"id,omitempty"`
+	Name       string         `json:"name,omitempty"`
+	Args       map[string]any `json:"args,omitempty"`
+	Decision   string         `json:"decision,omitempty"`
+	Response   map[string]any `json:"response,omitempty"`
+	DurationMS int64          `json:"duration_ms,omitempty"`
+	Usage      *tokenUsage    `json:"usage,omitempty"`
+	Session    string         `json:"session,omitempty"`
+	Error      string         `json:"error,omitempty"`
+}
+
+// tokenUsage is the token count of one model response, or of a whole turn.
+type tokenUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CachedTokens     int `json:"cached_tokens,omitempty"`
+	CompletionTokens int `json:"completion_tokens"`
+	ThinkingTokens   int `json:"thinking_tokens,omitempty"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// turnOutput is what the json format writes for a turn.
+type turnOutput struct {
+	Text    string        `json:"text"`
+	Error   string        `json:"error,omitempty"`
+	Session string        `json:"session,omitempty"`
+	Usage   tokenUsage    `json:"usage"`
+	Events  []outputEvent `json:"events"`
+}
+
+// eventOutput writes the events of turns in one of the JSON formats. A nil
+// *eventOutput, used for the text format, discards events. Tool calls run
+// concurrently, so events may be emitted from several goroutines.
+type eventOutput struct {
+	format  string
+	encoder *json.Encoder
+
+	mu     sync.Mutex
+	events []outputEvent
+	usage  tokenUsage
+	calls  int
+}
+
+// newEventOutput returns the event output for format, writing to w; the
+// text format needs none.
+func newEventOutput(format string, w io.Writer) (*eventOutput, error) {
+	switch format {
+	case outputText:
+		return nil, nil
+	case outputJSON, outputStreamJSON:
+		return &eventOutput{format: format, encoder: json.NewEncoder(w)}, nil
+	}
+	return nil, fmt.Errorf("unknown output format %q (want %s, %s or %s)", format, outputText, outputJSON, outputStreamJSON)
+}
+
+func (o *eventOutput) emit(event outputEvent) {
+	if o == nil {
+		return
+	}
+	event.Time = time.Now()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if event.Usage != nil {
+		o.usage.PromptTokens += event.Usage.PromptTokens
+		o.usage.CachedTokens += event.Usage.CachedTokens
+		o.usage.CompletionTokens += event.Usage.CompletionTokens
+		o.usage.ThinkingTokens += event.Usage.ThinkingTokens
+		o.usage.TotalTokens += event.Usage.TotalTokens
+	}
+	if o.format == outputStreamJSON {
+		o.encoder.Encode(event)
+		return
+	}
+	o.events = append(o.events, event)
+}
+
+// callID returns a new ID for a tool call of the current turn.
+func (o *eventOutput) callID() string {
+	if o == nil {
+		return ""
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.calls++
+	return fmt.Sprintf("call_%d", o.calls)
+}
+
+// user emits the text of the user messages that start a turn.
+func (o *eventOutput) user(messages []gemini.Content) {
+	for _, message := range messages {
+		if message.Role == nil || *message.Role != "user" {
+			continue
+		}
+		var texts []string
+		for _, part := range message.Parts {
+			if part.Text != nil {
+				texts = append(texts, *part.Text)
+			}
+		}
+		o.emit(outputEvent{Type: eventUser, Text: strings.Join(texts, "\n")})
+	}
+}
+
+func (o *eventOutput) text(text string) {
+	if text != "" {
+		o.emit(outputEvent{Type: eventText, Text: text})
+	}
+}
+
+func (o *eventOutput) tokens(usage *gemini.UsageMetadata) {
+	if usage == nil {
+		return
+	}
+	o.emit(outputEvent{Type: eventUsage, Usage: &tokenUsage{
+		PromptTokens:     usage.PromptTokenCount,
+		CachedTokens:     usage.CachedContentTokenCount,
+		CompletionTokens: usage.CandidatesTokenCount,
+		ThinkingTokens:   usage.ThoughtsTokenCount,
+		TotalTokens:      usage.TotalTokenCount,
+	}})
+}
+
+// finish ends a turn with its answer or error, writing the turn in the json
+// format.
+func (o *eventOutput) finish(text, session string, err error) {
+	if o == nil {
+		return
+	}
+	if err != nil {
+		o.emit(outputEvent{Type: eventError, Error: strings.TrimSpace(err.Error()), Session: session})
+	} else {
+		o.emit(outputEvent{Type: eventFinal, Text: text, Session: session})
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.format == outputJSON {
+		turn := turnOutput{Text: text, Session: session, Usage: o.usage, Events: o.events}
+		if err != nil {
+			turn.Error = strings.TrimSpace(err.Error())
+		}
+		o.encoder.Encode(turn)
+	}
+	o.events, o.usage, o.calls = nil, tokenUsage{}, 0
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/liuzl/ai/gemini"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// Prompt is a prompt template published by an MCP server, invoked from the
+// REPL as /Command.
+type Prompt struct {
+	Command     string
+	Server      string
+	MCPName     string
+	Description string
+	Arguments   []*mcp.PromptArgument
+}
+
+// builtinCommands are the slash commands a prompt may not shadow.
+var builtinCommands = map[string]bool{
+	"prompts": true, "resources": true, "attach": true, "subscribe": true, "unsubscribe": true,
+	"sessions": true, "save": true, "load": true, "resume": true, "system": true, "policy": true,
+	"loglevel": true,
+}
+
+// discoverPrompts registers the prompts of one MCP server, if it declared the
+// prompts capability.
+func (a *Agent) discoverPrompts(ctx context.Context, server string) error {
+	prompts, err := a.listPrompts(ctx, server)
+	if err != nil {
+		return err
+	}
+	a.discoveredPrompts = append(a.discoveredPrompts, prompts...)
+	a.assignPromptCommands()
+	return nil
+}
+
+// listPrompts fetches the prompts of one MCP server; servers without the
+// prompts capability have none.
+func (a *Agent) listPrompts(ctx context.Context, server string) ([]Prompt, error) {
+	if a.servers.capabilities(server).Prompts == nil {
+		return nil, nil
+	}
+	session, _ := a.servers.session(server)
+	var prompts []Prompt
+	for prompt, err := range session.Prompts(ctx, nil) {
+		if err != nil {
+			return nil, err
+		}
+		prompts = append(prompts, Prompt{
+			Server:      server,
+			MCPName:     prompt.Name,
+			Description: prompt.Description,
+			Arguments:   prompt.Arguments,
+		})
+	}
+	return prompts, nil
+}
+
+// assignPromptCommands names each prompt's slash command after the prompt,
+// falling back to server.prompt when the name is taken by a built-in command
+// or by a prompt of another server.
+func (a *Agent) assignPromptCommands() {
+	servers := make(map[string]int)
+	for _, prompt := range a.discoveredPrompts {
+		servers[prompt.MCPName]++
+	}
+	for i := range a.discoveredPrompts {
+		prompt := &a.discoveredPrompts[i]
+		prompt.Command = prompt.MCPName
+		if servers[prompt.MCPName] > 1 || builtinCommands[strings.ToLower(prompt.MCPName)] {
+			prompt.Command = prompt.Server + "." + prompt.MCPName
+		}
+	}
+}
+
+// findPrompt looks up a prompt by its command, or by its server.prompt name.
+func (a *Agent) findPrompt(command string) (Prompt, bool) {
+	for _, prompt := range a.discoveredPrompts {
+		if prompt.Command == command || prompt.Server+"."+prompt.MCPName == command {
+			return prompt, true
+		}
+	}
+	return Prompt{}, false
+}
+
+// printPrompts lists the prompt commands with their arguments.
+func (a *Agent) printPrompts() {
+	if len(a.discoveredPrompts) == 0 {
+		fmt.Printf("%sNo prompts published by the connected servers.%s\n", ColorGray, ColorReset)
+		return
+	}
+	prompts := append([]Prompt(nil), a.discoveredPrompts...)
+	sort.Slice(prompts, func(i, j int) bool { return prompts[i].Command < prompts[j].Command })
+
+	fmt.Printf("\n%s%s=== MCP Prompts ===%s\n", ColorBold, ColorCyan, ColorReset)
+	for _, prompt := range prompts {
+		fmt.Printf("%s/%s%s", ColorPurple, prompt.Command, ColorReset)
+		for _, arg := range prompt.Arguments {
+			if arg.Required {
+				fmt.Printf(" %s=...", arg.Name)
+			} else {
+				fmt.Printf(" %s[%s=...]%s", ColorGray, arg.Name, ColorReset)
+			}
+		}
+		fmt.Printf(" %s(%s)%s\n", ColorGray, prompt.Server, ColorReset)
+		if prompt.Description != "" {
+			fmt.Printf("  %s%s%s\n", ColorGray, prompt.Description, ColorReset)
+		}
+	}
+	fmt.Printf("%sEnd a value with '?' to list completions, e.g. /%s name=ab?%s\n", ColorGray, prompts[0].Command, ColorReset)
+	fmt.Printf("%s%s=== End Prompts ===%s\n\n", ColorBold, ColorCyan, ColorReset)
+}
+
+// runPromptCommand expands a "/prompt arg=value ..." command into the
+// messages of the prompt. Missing required arguments, and values ending in
+// '?', are asked for with readLine, listing the server's completions. handled
+// is false if input does not name a prompt.
+func (a *Agent) runPromptCommand(ctx context.Context, input string, readLine func(label string) (string, bool)) (messages []gemini.Content, handled bool) {
+	command, rest, _ := strings.Cut(strings.TrimPrefix(input, "/"), " ")
+	prompt, ok := a.findPrompt(command)
+	if !ok {
+		return nil, false
+	}
+
+	args, err := parsePromptArgs(rest)
+	if err == nil {
+		err = prompt.checkArgs(args)
+	}
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", ColorRed, err, ColorReset)
+		return nil, true
+	}
+	for _, arg := range prompt.Arguments {
+		value, given := args[arg.Name]
+		prefix, wantsCompletion := strings.CutSuffix(value, "?")
+		if given && !wantsCompletion || !given && !arg.Required {
+			continue
+		}
+		answer, ok := a.askPromptArg(ctx, prompt, arg, prefix, args, readLine)
+		if !ok {
+			fmt.Printf("%sPrompt cancelled.%s\n", ColorYellow, ColorReset)
+			return nil, true
+		}
+		if answer == "" {
+			delete(args, arg.Name)
+			continue
+		}
+		args[arg.Name] = answer
+	}
+
+	session, ok := a.servers.session(prompt.Server)
+	if !ok {
+		fmt.Printf("%sError: MCP server '%s' is not connected%s\n", ColorRed, prompt.Server, ColorReset)
+		return nil, true
+	}
+	if a.toolTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.toolTimeout)
+		defer cancel()
+	}
+	result, err := session.GetPrompt(ctx, &mcp.GetPromptParams{Name: prompt.MCPName, Arguments: args})
+	if err != nil {
+		fmt.Printf("%sError: failed to get prompt '%s': %v%s\n", ColorRed, prompt.Command, err, ColorReset)
+		return nil, true
+	}
+	for _, message := range result.Messages {
+		role := "user"
+		if message.Role == "assistant" {
+			role = "model"
+		}
+		parts := promptContentParts(message.Content)
+		if len(parts) == 0 {
+			continue
+		}
+		// Gemini expects alternating turns, so merge consecutive messages of
+		// the same role.
+		if n := len(messages); n > 0 && *messages[n-1].Role == role {
+			messages[n-1].Parts = append(messages[n-1].Parts, parts...)
+			continue
+		}
+		messages = append(messages, gemini.Content{Parts: parts, Role: gemini.StringPtr(role)})
+	}
+	fmt.Printf("%s📝 Prompt '%s' added %d message(s) to the conversation.%s\n", ColorGreen, prompt.Command, len(messages), ColorReset)
+	return messages, true
+}
+
+func (p Prompt) checkArgs(args map[string]string) error {
+	var unknown []string
+	for name := range args {
+		known := false
+		for _, arg := range p.Arguments {
+			known = known || arg.Name == name
+		}
+		if !known {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	var names []string
+	for _, arg := range p.Arguments {
+		names = append(names, arg.Name)
+	}
+	return fmt.Errorf("unknown argument(s) %s for /%s; it takes: %s",
+		strings.Join(unknown, ", "), p.Command, strings.Join(names, ", "))
+}
+
+// askPromptArg reads an argument value from the user, listing completions
+// for the prefix typed so far. Answering with a value ending in '?' lists the
+// completions for that prefix instead.
+func (a *Agent) askPromptArg(ctx context.Context, prompt Prompt, arg *mcp.PromptArgument, prefix string, args map[string]string, readLine func(string) (string, bool)) (string, bool) {
+	label := fmt.Sprintf("  %s%s%s", ColorCyan, arg.Name, ColorReset)
+	if arg.Description != "" {
+		label += fmt.Sprintf(" %s(%s)%s", ColorGray, arg.Description, ColorReset)
+	}
+	for {
+		if values, more := a.completePromptArg(ctx, prompt, arg.Name, prefix, args); len(values) > 0 {
+			suffix := ""
+			if more {
+				suffix = ", ..."
+			}
+			fmt.Printf("  %sCompletions: %s%s%s\n", ColorGray, strings.Join(values, ", "), suffix, ColorReset)
+		}
+		line, ok := readLine(label + ": ")
+		if !ok {
+			return "", false
+		}
+		if p, again := strings.CutSuffix(line, "?"); again {
+			prefix = p
+			continue
+		}
+		if line == "" && arg.Required {
+			return "", false
+		}
+		return line, true
+	}
+}
+
+// completePromptArg asks the prompt's server to complete an argument value,
+// if the server supports completions.
+func (a *Agent) completePromptArg(ctx context.Context, prompt Prompt, name, prefix string, args map[string]string) (values []string, more bool) {
+	if a.servers.capabilities(prompt.Server).Completions == nil {
+		return nil, false
+	}
+	params := &mcp.CompleteParams{
+		Ref:      &mcp.CompleteReference{Type: "ref/prompt", Name: prompt.MCPName},
+		Argument: mcp.CompleteParamsArgument{Name: name, Value: prefix},
+	}
+	known := make(map[string]string)
+	for key, value := range args {
+		if key != name && !strings.HasSuffix(value, "?") {
+			known[key] = value
+		}
+	}
+	if len(known) > 0 {
+		params.Context = &mcp.CompleteContext{Arguments: known}
+	}
+	// ClientSession.Complete panics in this SDK version, so send it ourselves.
+	var result mcp.CompleteResult
+	if err := a.servers.request(ctx, prompt.Server, methodComplete, params, &result); err != nil {
+		fmt.Printf("  %sCompletion failed: %v%s\n", ColorGray, err, ColorReset)
+		return nil, false
+	}
+	return result.Completion.Values, result.Completion.HasMore
+}
+
+// parsePromptArgs parses space separated name=value pairs. Values may be
+// double quoted to include spaces, with \" and \\ as escapes.
+func parsePromptArgs(input string) (map[string]string, error) {
+	args := make(map[string]string)
+	s := strings.TrimSpace(input)
+	for s != "" {
+		name, rest, ok := strings.Cut(s, "=")
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			field, _, _ := strings.Cut(s, " ")
+			return nil, fmt.Errorf("expected name=value, got %q", field)
+		}
+		var value strings.Builder
+		if strings.HasPrefix(rest, `"`) {
+			i, closed := 1, false
+			for ; i < len(rest); i++ {
+				c := rest[i]
+				if c == '\\' && i+1 < len(rest) {
+					i++
+					value.WriteByte(rest[i])
+					continue
+				}
+				if c == '"' {
+					closed = true
+					break
+				}
+				value.WriteByte(c)
+			}
+			if !closed {
+				return nil, errors.New("unterminated quoted value for " + name)
+			}
+			rest = rest[i+1:]
+		} else {
+			end := strings.IndexAny(rest, " \t")
+			if end < 0 {
+				end = len(rest)
+			}
+			value.WriteString(rest[:end])
+			rest = rest[end:]
+		}
+		args[name] = value.String()
+		s = strings.TrimSpace(rest)
+	}
+	return args, nil
+}
+
+// promptContentParts converts the content of a prompt message into Gemini parts.
+func promptContentParts(content mcp.Content) []gemini.Part {
+	inline := func(mimeType string, data []byte) []gemini.Part {
+		if !inlineSupported(mimeType) {
+			return []gemini.Part{{Text: gemini.StringPtr(fmt.Sprintf("[%s content omitted]", mimeType))}}
+		}
+		return []gemini.Part{{InlineData: &gemini.Blob{
+			MimeType: mimeType,
+			Data:     base64.StdEncoding.EncodeToString(data),
+		}}}
+	}
+	switch c := content.(type) {
+	case *mcp.TextContent:
+		return []gemini.Part{{Text: gemini.StringPtr(c.Text)}}
+	case *mcp.ImageContent:
+		return inline(c.MIMEType, c.Data)
+	case *mcp.AudioContent:
+		return inline(c.MIMEType, c.Data)
+	case *mcp.EmbeddedResource:
+		if c.Resource == nil {
+			return nil
+		}
+		if c.Resource.Blob != nil {
+			return inline(c.Resource.MIMEType, c.Resource.Blob)
+		}
+		return []gemini.Part{{Text: gemini.StringPtr(fmt.Sprintf("Resource %s:\n%s", c.Resource.URI, c.Resource.Text))}}
+	case *mcp.ResourceLink:
+		return []gemini.Part{{Text: gemini.StringPtr(fmt.Sprintf("Resource link: %s (%s)", c.URI, c.Name))}}
+	default:
+		return nil
+	}
+}
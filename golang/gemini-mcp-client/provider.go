@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"os"
+
+	"gemini-mcp-bash/internal/httpretry"
+
+	"github.com/liuzl/ai/gemini"
+)
+
+// Providers selectable with AI_PROVIDER.
+const (
+	providerGemini    = "gemini"
+	providerOpenAI    = "openai"
+	providerAnthropic = "anthropic"
+)
+
+// Provider is a model backend the agent loop can drive. Whatever the backend,
+// requests and responses are passed through as the Gemini API types,
+// gemini.GenerateContentRequest and gemini.GenerateContentResponse: the agent
+// keeps its history, sessions and compaction in Gemini's content format, and
+// every other provider translates messages, tool declarations, function calls
+// and function responses to and from it.
+type Provider interface {
+	// Name is shown as the speaker of model replies.
+	Name() string
+	// Model is the model requests are sent to, used to look up its prices.
+	Model() string
+	// Generate returns the complete response to request.
+	Generate(ctx context.Context, request *gemini.GenerateContentRequest) (*gemini.GenerateContentResponse, error)
+	// GenerateStream returns the response to request in chunks as they are
+	// produced. Text may be split across chunks; function calls arrive whole.
+	GenerateStream(ctx context.Context, request *gemini.GenerateContentRequest) iter.Seq2[*gemini.GenerateContentResponse, error]
+}
+
+// newProvider creates the provider named by AI_PROVIDER, Gemini by default,
+// configured from that provider's environment variables. Its requests retry
+// through retry.
+func newProvider(retry *httpretry.Transport) (Provider, error) {
+	switch name := envString("AI_PROVIDER", providerGemini); name {
+	case providerGemini, "":
+		// The Gemini SDK takes no http.Client, so it can only be made to retry
+		// through the default transport.
+		httpretry.WrapDefault().Logf = retry.Logf
+		return newGeminiProvider(), nil
+	case providerOpenAI:
+		return newOpenAIProvider(retry), nil
+	case providerAnthropic:
+		return newAnthropicProvider(retry), nil
+	default:
+		return nil, fmt.Errorf("unsupported AI_PROVIDER %q, want %s, %s or %s", name, providerGemini, providerOpenAI, providerAnthropic)
+	}
+}
+
+// geminiProvider talks to the Gemini API, configured with GEMINI_API_KEY,
+// GEMINI_BASE_URL and GEMINI_MODEL.
+type geminiProvider struct {
+	client *gemini.Client
+	model  string
+}
+
+func newGeminiProvider() *geminiProvider {
+	return &geminiProvider{
+		client: gemini.NewClient(os.Getenv("GEMINI_API_KEY"), gemini.WithBaseURL(os.Getenv("GEMINI_BASE_URL"))),
+		model:  os.Getenv("GEMINI_MODEL"),
+	}
+}
+
+func (p *geminiProvider) Name() string { return "Gemini" }
+
+func (p *geminiProvider) Model() string { return p.model }
+
+func (p *geminiProvider) Generate(ctx context.Context, request *gemini.GenerateContentRequest) (*gemini.GenerateContentResponse, error) {
+	return p.client.GenerateContent(ctx, p.model, request)
+}
+
+func (p *geminiProvider) GenerateStream(ctx context.Context, request *gemini.GenerateContentRequest) iter.Seq2[*gemini.GenerateContentResponse, error] {
+	return p.client.GenerateContentStream(ctx, p.model, request)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+)
+
+// refreshServers brings what the agent knows about the servers up to date
+// before a request. Servers that reconnected since it was last called are
+// discovered again from scratch and their resource subscriptions renewed;
+// servers that announced a changed list of tools, resources or prompts have
+// that list fetched again, and the changes are reported.
+func (a *Agent) refreshServers(ctx context.Context) {
+	reconnected := a.servers.takeReconnected()
+	for _, server := range reconnected {
+		a.forgetServer(server)
+		fmt.Printf("%s🔄 Rediscovering the capabilities of '%s'...%s\n", ColorCyan, server, ColorReset)
+		if err := a.discoverTools(ctx, server); err != nil {
+			fmt.Printf("  %s❌ Failed to list tools on '%s': %v%s\n", ColorRed, server, err, ColorReset)
+		}
+		if err := a.discoverResources(ctx, server); err != nil {
+			fmt.Printf("  %s❌ Failed to list resources on '%s': %v%s\n", ColorRed, server, err, ColorReset)
+		}
+		if err := a.discoverPrompts(ctx, server); err != nil {
+			fmt.Printf("  %s❌ Failed to list prompts on '%s': %v%s\n", ColorRed, server, err, ColorReset)
+		}
+		a.resubscribe(ctx, server)
+	}
+
+	for server, lists := range a.servers.takeChanged() {
+		if slices.Contains(reconnected, server) {
+			continue
+		}
+		for _, list := range lists {
+			if err := a.refreshList(ctx, server, list); err != nil {
+				fmt.Printf("%s❌ Failed to refresh the %s of '%s': %v%s\n", ColorRed, list, server, err, ColorReset)
+			}
+		}
+	}
+}
+
+// forgetServer drops everything discovered on a server.
+func (a *Agent) forgetServer(server string) {
+	a.discoveredTools = slices.DeleteFunc(a.discoveredTools, func(t Tool) bool { return t.Server == server })
+	a.discoveredResources = slices.DeleteFunc(a.discoveredResources, func(r Resource) bool { return r.Server == server })
+	a.discoveredPrompts = slices.DeleteFunc(a.discoveredPrompts, func(p Prompt) bool { return p.Server == server })
+	a.assignPromptCommands()
+}
+
+// refreshList fetches one list of a server again, replacing the old one, and
+// prints what was added and removed. The next request declares the new tools
+// to the model.
+func (a *Agent) refreshList(ctx context.Context, server, list string) error {
+	switch list {
+	case listTools:
+		tools, err := a.listTools(ctx, server)
+		if err != nil {
+			return err
+		}
+		var before, after []string
+		a.discoveredTools = slices.DeleteFunc(a.discoveredTools, func(t Tool) bool {
+			if t.Server == server {
+				before = append(before, t.Name)
+			}
+			return t.Server == server
+		})
+		a.discoveredTools = append(a.discoveredTools, tools...)
+		for _, tool := range tools {
+			after = append(after, tool.Name)
+		}
+		printListChanges(server, list, before, after)
+		for _, tool := range tools {
+			if !slices.Contains(before, tool.Name) {
+				printSchemaWarnings(tool)
+			}
+		}
+
+	case listResources:
+		resources, err := a.listResources(ctx, server)
+		if err != nil {
+			return err
+		}
+		var before, after []string
+		a.discoveredResources = slices.DeleteFunc(a.discoveredResources, func(r Resource) bool {
+			if r.Server == server {
+				before = append(before, r.label())
+			}
+			return r.Server == server
+		})
+		a.discoveredResources = append(a.discoveredResources, resources...)
+		for _, resource := range resources {
+			after = append(after, resource.label())
+		}
+		printListChanges(server, list, before, after)
+
+	case listPrompts:
+		prompts, err := a.listPrompts(ctx, server)
+		if err != nil {
+			return err
+		}
+		var before, after []string
+		a.discoveredPrompts = slices.DeleteFunc(a.discoveredPrompts, func(p Prompt) bool {
+			if p.Server == server {
+				before = append(before, p.MCPName)
+			}
+			return p.Server == server
+		})
+		a.discoveredPrompts = append(a.discoveredPrompts, prompts...)
+		a.assignPromptCommands()
+		for _, prompt := range prompts {
+			after = append(after, prompt.MCPName)
+		}
+		printListChanges(server, list, before, after)
+	}
+	return nil
+}
+
+// printListChanges reports how a server's list changed from before to after.
+func printListChanges(server, list string, before, after []string) {
+	var added, removed []string
+	for _, name := range after {
+		if !slices.Contains(before, name) {
+			added = append(added, name)
+		}
+	}
+	for _, name := range before {
+		if !slices.Contains(after, name) {
+			removed = append(removed, name)
+		}
+	}
+	fmt.Printf("%s🔄 Refreshed the %s of '%s' (%d now).%s\n", ColorCyan, list, server, len(after), ColorReset)
+	for _, name := range added {
+		fmt.Printf("  %s➕ Added: %s%s\n", ColorGreen, name, ColorReset)
+	}
+	for _, name := range removed {
+		fmt.Printf("  %s➖ Removed: %s%s\n", ColorYellow, name, ColorReset)
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		fmt.Printf("  %sNone added or removed; descriptions may have changed.%s\n", ColorGray, ColorReset)
+	}
+}
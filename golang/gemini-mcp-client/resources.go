@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/liuzl/ai/gemini"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// readResourceFunction is the synthetic function that lets the model read MCP
+// resources. The agent answers it itself instead of forwarding it as a tool call.
+const readResourceFunction = "read_resource"
+
+// Resource is a resource or resource template published by an MCP server.
+// Exactly one of URI and URITemplate is set.
+type Resource struct {
+	Server      string
+	URI         string
+	URITemplate string
+	Name        string
+	Description string
+	MIMEType    string
+}
+
+func (r Resource) label() string {
+	if r.URI != "" {
+		return r.URI
+	}
+	return r.URITemplate
+}
+
+// matches reports whether uri is this resource, or could be produced by this
+// template judging by the template's literal prefix.
+func (r Resource) matches(uri string) bool {
+	if r.URI != "" {
+		return r.URI == uri
+	}
+	prefix, _, _ := strings.Cut(r.URITemplate, "{")
+	return prefix != "" && strings.HasPrefix(uri, prefix)
+}
+
+// discoverResources registers the resources and resource templates of one MCP
+// server, if it declared the resources capability.
+func (a *Agent) discoverResources(ctx context.Context, server string) error {
+	resources, err := a.listResources(ctx, server)
+	if err != nil {
+		return err
+	}
+	a.discoveredResources = append(a.discoveredResources, resources...)
+	for _, resource := range resources {
+		if resource.URI != "" {
+			fmt.Printf("  %s📄 Discovered resource: %s (%s)%s\n", ColorGreen, resource.URI, server, ColorReset)
+		} else {
+			fmt.Printf("  %s📄 Discovered resource template: %s (%s)%s\n", ColorGreen, resource.URITemplate, server, ColorReset)
+		}
+	}
+	return nil
+}
+
+// listResources fetches the resources and resource templates of one MCP
+// server; servers without the resources capability have none.
+func (a *Agent) listResources(ctx context.Context, server string) ([]Resource, error) {
+	if a.servers.capabilities(server).Resources == nil {
+		return nil, nil
+	}
+	session, _ := a.servers.session(server)
+	var resources []Resource
+	for resource, err := range session.Resources(ctx, nil) {
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, Resource{
+			Server:      server,
+			URI:         resource.URI,
+			Name:        resource.Name,
+			Description: resource.Description,
+			MIMEType:    resource.MIMEType,
+		})
+	}
+	for template, err := range session.ResourceTemplates(ctx, nil) {
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, Resource{
+			Server:      server,
+			URITemplate: template.URITemplate,
+			Name:        template.Name,
+			Description: template.Description,
+			MIMEType:    template.MIMEType,
+		})
+	}
+	return resources, nil
+}
+
+// availableResources returns the discovered resources whose server is
+// connected.
+func (a *Agent) availableResources() []Resource {
+	var resources []Resource
+	for _, resource := range a.discoveredResources {
+		if !a.servers.isDown(resource.Server) {
+			resources = append(resources, resource)
+		}
+	}
+	return resources
+}
+
+// resourceServers returns the servers that declared the resources capability.
+func (a *Agent) resourceServers() []string {
+	var servers []string
+	for _, server := range a.servers.names() {
+		if a.servers.capabilities(server).Resources != nil {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// resourceServer decides which server to read uri from. An explicit server
+// wins; otherwise the server listing the URI, then one with a matching
+// template, and finally the only server publishing resources at all.
+func (a *Agent) resourceServer(uri, server string) (string, error) {
+	if server != "" {
+		if _, ok := a.servers.session(server); !ok {
+			return "", fmt.Errorf("MCP server '%s' is not connected", server)
+		}
+		return server, nil
+	}
+	for _, resource := range a.discoveredResources {
+		if resource.URI == uri {
+			return resource.Server, nil
+		}
+	}
+	var candidates []string
+	for _, resource := range a.discoveredResources {
+		if resource.matches(uri) && !slices.Contains(candidates, resource.Server) {
+			candidates = append(candidates, resource.Server)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = a.resourceServers()
+	}
+	switch len(candidates) {
+	case 0:
+		return "", errors.New("no connected MCP server publishes resources")
+	case 1:
+		return candidates[0], nil
+	default:
+		return "", fmt.Errorf("resource %s could be served by %s; specify the server", uri, strings.Join(candidates, ", "))
+	}
+}
+
+// readResource reads uri from the server that serves it, bounded by the tool
+// timeout like a tool call.
+func (a *Agent) readResource(ctx context.Context, uri, server string) (*mcp.ReadResourceResult, error) {
+	server, err := a.resourceServer(uri, server)
+	if err != nil {
+		return nil, err
+	}
+	session, ok := a.servers.session(server)
+	if !ok {
+		return nil, fmt.Errorf("MCP server '%s' is not connected", server)
+	}
+	if a.toolTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.toolTimeout)
+		defer cancel()
+	}
+	result, err := session.ReadResource(ctx, &mcp.ReadResourceParams{URI: uri})
+	if err != nil {
+		return nil, err
+	}
+	a.markResourceRead(uri)
+	return result, nil
+}
+
+// readResourceDeclaration describes read_resource to the model, listing what
+// the servers publish so it knows which URIs exist.
+func (a *Agent) readResourceDeclaration() gemini.FunctionDeclaration {
+	var b strings.Builder
+	b.WriteString("Read a resource published by a connected MCP server, such as a file or a database record, by its URI.")
+	b.WriteString(" Available resources and URI templates:")
+	for _, resource := range a.availableResources() {
+		fmt.Fprintf(&b, "\n- %s (server %s)", resource.label(), resource.Server)
+		if resource.Description != "" {
+			fmt.Fprintf(&b, ": %s", resource.Description)
+		}
+	}
+	parameters := &gemini.Schema{
+		Type: "object",
+		Properties: map[string]*gemini.Schema{
+			"uri": {Type: "string", Description: "The URI of the resource to read."},
+		},
+		Required: []string{"uri"},
+	}
+	if servers := a.resourceServers(); len(servers) > 1 {
+		parameters.Properties["server"] = &gemini.Schema{
+			Type:        "string",
+			Description: "The server to read from, when the URI alone is ambiguous.",
+			Enum:        servers,
+		}
+	}
+	return gemini.FunctionDeclaration{
+		Name:        readResourceFunction,
+		Description: b.String(),
+		Parameters:  parameters,
+	}
+}
+
+// callReadResource answers the model's read_resource calls.
+func (a *Agent) callReadResource(ctx context.Context, args map[string]any) (map[string]any, []gemini.Part, error) {
+	uri, _ := args["uri"].(string)
+	server, _ := args["server"].(string)
+	if uri == "" {
+		return map[string]any{"error": "uri is required"}, nil, nil
+	}
+	result, err := a.readResource(ctx, uri, server)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		return map[string]any{"error": fmt.Sprintf("Failed to read resource: %v", err)}, nil, nil
+	}
+	response, inlineParts := convertToolResult(readResourceFunction, resourceToolResult(result))
+	return response, inlineParts, nil
+}
+
+// resourceToolResult presents resource contents as a tool result of embedded
+// resources, so they are mapped for Gemini the same way.
+func resourceToolResult(result *mcp.ReadResourceResult) *mcp.CallToolResult {
+	toolResult := &mcp.CallToolResult{}
+	for _, contents := range result.Contents {
+		toolResult.Content = append(toolResult.Content, &mcp.EmbeddedResource{Resource: contents})
+	}
+	return toolResult
+}
+
+// attachResource reads uri and queues its contents to be sent with the next
+// user message.
+func (a *Agent) attachResource(ctx context.Context, uri, server string) error {
+	result, err := a.readResource(ctx, uri, server)
+	if err != nil {
+		return err
+	}
+	var attached int
+	for _, contents := range result.Contents {
+		switch {
+		case contents.Blob != nil && inlineSupported(contents.MIMEType):
+			a.pendingParts = append(a.pendingParts,
+				gemini.Part{Text: gemini.StringPtr(fmt.Sprintf("Attached resource %s (%s):", contents.URI, contents.MIMEType))},
+				gemini.Part{InlineData: &gemini.Blob{
+					MimeType: contents.MIMEType,
+					Data:     base64.StdEncoding.EncodeToString(contents.Blob),
+				}})
+		case contents.Blob != nil:
+			fmt.Printf("%sSkipping %s: %s cannot be sent to Gemini%s\n", ColorYellow, contents.URI, contents.MIMEType, ColorReset)
+			continue
+		default:
+			a.pendingParts = append(a.pendingParts,
+				gemini.Part{Text: gemini.StringPtr(fmt.Sprintf("Attached resource %s:\n%s", contents.URI, contents.Text))})
+		}
+		attached++
+	}
+	if attached == 0 {
+		return fmt.Errorf("resource %s has no contents that can be attached", uri)
+	}
+	fmt.Printf("%s📎 Attached %s; it will be sent with your next message.%s\n", ColorGreen, uri, ColorReset)
+	return nil
+}
+
+// setSubscription subscribes to or unsubscribes from updates of uri.
+func (a *Agent) setSubscription(ctx context.Context, uri, server string, subscribe bool) error {
+	server, err := a.resourceServer(uri, server)
+	if err != nil {
+		return err
+	}
+	if resources := a.servers.capabilities(server).Resources; resources == nil || !resources.Subscribe {
+		return fmt.Errorf("MCP server '%s' does not support resource subscriptions", server)
+	}
+	method := methodSubscribe
+	if !subscribe {
+		method = methodUnsubscribe
+	}
+	if err := a.servers.request(ctx, server, method, map[string]any{"uri": uri}, nil); err != nil {
+		return err
+	}
+
+	a.resourceMu.Lock()
+	defer a.resourceMu.Unlock()
+	if subscribe {
+		a.subscriptions[uri] = server
+	} else {
+		delete(a.subscriptions, uri)
+		delete(a.updatedResources, uri)
+	}
+	return nil
+}
+
+// resubscribe renews the subscriptions to resources of a server that
+// reconnected, dropping those the server no longer accepts.
+func (a *Agent) resubscribe(ctx context.Context, server string) {
+	a.resourceMu.Lock()
+	var uris []string
+	for uri, subscribed := range a.subscriptions {
+		if subscribed == server {
+			uris = append(uris, uri)
+		}
+	}
+	a.resourceMu.Unlock()
+	sort.Strings(uris)
+
+	for _, uri := range uris {
+		if err := a.servers.request(ctx, server, methodSubscribe, map[string]any{"uri": uri}, nil); err != nil {
+			fmt.Printf("  %s❌ Failed to resubscribe to %s: %v%s\n", ColorRed, uri, err, ColorReset)
+			a.resourceMu.Lock()
+			delete(a.subscriptions, uri)
+			a.resourceMu.Unlock()
+			continue
+		}
+		fmt.Printf("  %s🔔 Resubscribed to %s%s\n", ColorGreen, uri, ColorReset)
+	}
+}
+
+// resourceUpdated handles notifications/resources/updated for a subscribed URI.
+func (a *Agent) resourceUpdated(server string, params json.RawMessage) {
+	var updated struct {
+		URI string `json:"uri"`
+	}
+	if err := json.Unmarshal(params, &updated); err != nil || updated.URI == "" {
+		return
+	}
+	a.resourceMu.Lock()
+	a.updatedResources[updated.URI] = true
+	a.resourceMu.Unlock()
+	fmt.Printf("\n%s🔔 Resource updated on '%s': %s (use '/attach %s' to refresh it)%s\n",
+		ColorPurple, server, updated.URI, updated.URI, ColorReset)
+}
+
+func (a *Agent) markResourceRead(uri string) {
+	a.resourceMu.Lock()
+	defer a.resourceMu.Unlock()
+	delete(a.updatedResources, uri)
+}
+
+// printResources lists the discovered resources and templates, marking the
+// subscribed ones and those updated since they were last read.
+func (a *Agent) printResources() {
+	if len(a.discoveredResources) == 0 {
+		fmt.Printf("%sNo resources published by the connected servers.%s\n", ColorGray, ColorReset)
+		return
+	}
+	resources := append([]Resource(nil), a.discoveredResources...)
+	sort.SliceStable(resources, func(i, j int) bool {
+		return resources[i].Server < resources[j].Server
+	})
+
+	a.resourceMu.Lock()
+	defer a.resourceMu.Unlock()
+	fmt.Printf("\n%s%s=== MCP Resources ===%s\n", ColorBold, ColorCyan, ColorReset)
+	for _, resource := range resources {
+		kind := "resource"
+		if resource.URITemplate != "" {
+			kind = "template"
+		}
+		var marks []string
+		if _, ok := a.subscriptions[resource.URI]; ok {
+			marks = append(marks, "subscribed")
+		}
+		if a.updatedResources[resource.URI] {
+			marks = append(marks, "updated")
+		}
+		fmt.Printf("%s[%s] %s%s %s(%s)", ColorPurple, resource.Server, ColorReset, resource.label(), ColorGray, kind)
+		if len(marks) > 0 {
+			fmt.Printf(" %s[%s]", ColorYellow, strings.Join(marks, ", "))
+		}
+		fmt.Printf("%s\n", ColorReset)
+		if resource.Description != "" {
+			fmt.Printf("  %s%s%s\n", ColorGray, resource.Description, ColorReset)
+		}
+	}
+	fmt.Printf("%s%s=== End Resources ===%s\n\n", ColorBold, ColorCyan, ColorReset)
+}
+
+// runResourceCommand handles the /resources, /attach, /subscribe and
+// /unsubscribe REPL commands. It reports whether input was one of them.
+func (a *Agent) runResourceCommand(ctx context.Context, input string) bool {
+	fields := strings.Fields(input)
+	command := strings.ToLower(fields[0])
+	switch command {
+	case "/resources":
+		a.printResources()
+		return true
+	case "/attach", "/subscribe", "/unsubscribe":
+	default:
+		return false
+	}
+
+	if len(fields) < 2 || len(fields) > 3 {
+		fmt.Printf("%sUsage: %s <uri> [server]%s\n", ColorYellow, command, ColorReset)
+		return true
+	}
+	uri, server := fields[1], ""
+	if len(fields) == 3 {
+		server = fields[2]
+	}
+	var err error
+	switch command {
+	case "/attach":
+		err = a.attachResource(ctx, uri, server)
+	case "/subscribe":
+		if err = a.setSubscription(ctx, uri, server, true); err == nil {
+			fmt.Printf("%s🔔 Subscribed to %s%s\n", ColorGreen, uri, ColorReset)
+		}
+	case "/unsubscribe":
+		if err = a.setSubscription(ctx, uri, server, false); err == nil {
+			fmt.Printf("%sUnsubscribed from %s%s\n", ColorGreen, uri, ColorReset)
+		}
+	}
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", ColorRed, err, ColorReset)
+	}
+	return true
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/liuzl/ai/gemini"
+	"github.com/modelcontextprotocol/go-sdk/jsonschema"
+)
+
+// maxSchemaDepth bounds recursion through nested and self-referencing schemas.
+const maxSchemaDepth = 16
+
+// geminiFormats lists the string/number formats Gemini accepts in a Schema.
+var geminiFormats = map[string]bool{
+	"date-time": true,
+	"enum":      true,
+	"int32":     true,
+	"int64":     true,
+	"float":     true,
+	"double":    true,
+}
+
+// schemaConverter translates an MCP tool input schema (JSON Schema) into a
+// Gemini schema, recording a warning for every construct it has to degrade.
+type schemaConverter struct {
+	root     *jsonschema.Schema
+	warnings []string
+}
+
+// convertInputSchema converts an MCP tool input schema into Gemini function
+// parameters. It never fails: anything Gemini cannot express is simplified and
+// reported in the returned warnings, and a missing or non-object schema falls
+// back to a bare object.
+func convertInputSchema(schema *jsonschema.Schema) (*gemini.Schema, []string) {
+	if schema == nil {
+		return &gemini.Schema{Type: "object"}, nil
+	}
+	c := &schemaConverter{root: schema}
+	result := c.convert(schema, "$", 0)
+	if result.Type != "object" {
+		c.warn("$", fmt.Sprintf("top-level type %q is not an object, using an empty object", result.Type))
+		return &gemini.Schema{Type: "object"}, c.warnings
+	}
+	return result, c.warnings
+}
+
+func (c *schemaConverter) warn(path, msg string) {
+	c.warnings = append(c.warnings, fmt.Sprintf("%s: %s", path, msg))
+}
+
+// convert translates a single schema node. path is a JSON-path-like location
+// used in warnings.
+func (c *schemaConverter) convert(s *jsonschema.Schema, path string, depth int) *gemini.Schema {
+	if depth > maxSchemaDepth {
+		c.warn(path, "schema nested too deeply, using an untyped object")
+		return &gemini.Schema{Type: "object"}
+	}
+
+	s = c.resolveRef(s, path)
+	s = c.mergeAllOf(s, path)
+
+	out := &gemini.Schema{Description: s.Description}
+	if out.Description == "" {
+		out.Description = s.Title
+	}
+
+	typ, alt, nullable := c.resolveType(s, path)
+	if alt != nil {
+		// Convert the chosen anyOf/oneOf alternative, keeping the outer description.
+		inner := c.convert(alt, path, depth+1)
+		if inner.Description == "" {
+			inner.Description = out.Description
+		}
+		inner.Nullable = inner.Nullable || nullable
+		return inner
+	}
+	if typ == "" {
+		c.warn(path, "no usable type, falling back to string")
+		typ = "string"
+	}
+	out.Type = typ
+	out.Nullable = nullable
+
+	if s.Format != "" {
+		if geminiFormats[s.Format] {
+			out.Format = s.Format
+		} else {
+			out.Description = appendNote(out.Description, fmt.Sprintf("Format: %s.", s.Format))
+		}
+	}
+
+	c.convertEnum(s, out, path)
+
+	switch out.Type {
+	case "object":
+		c.convertObject(s, out, path, depth)
+	case "array":
+		c.convertArray(s, out, path, depth)
+	}
+
+	for _, unsupported := range unsupportedKeywords(s) {
+		c.warn(path, fmt.Sprintf("%s is not supported by Gemini and was ignored", unsupported))
+	}
+	return out
+}
+
+// resolveRef follows local "$ref" pointers into $defs/definitions.
+func (c *schemaConverter) resolveRef(s *jsonschema.Schema, path string) *jsonschema.Schema {
+	for range maxSchemaDepth {
+		if s.Ref == "" {
+			return s
+		}
+		name, ok := strings.CutPrefix(s.Ref, "#/$defs/")
+		defs := c.root.Defs
+		if !ok {
+			name, ok = strings.CutPrefix(s.Ref, "#/definitions/")
+			defs = c.root.Definitions
+		}
+		target := defs[name]
+		if !ok || target == nil {
+			c.warn(path, fmt.Sprintf("cannot resolve $ref %q, using an untyped object", s.Ref))
+			return &jsonschema.Schema{Type: "object", Description: s.Description}
+		}
+		if target.Description == "" && s.Description != "" {
+			copied := *target
+			copied.Description = s.Description
+			target = &copied
+		}
+		s = target
+	}
+	c.warn(path, "$ref chain too long, using an untyped object")
+	return &jsonschema.Schema{Type: "object"}
+}
+
+// mergeAllOf folds allOf branches into a single schema. Only properties,
+// required fields, type and description are merged.
+func (c *schemaConverter) mergeAllOf(s *jsonschema.Schema, path string) *jsonschema.Schema {
+	if len(s.AllOf) == 0 {
+		return s
+	}
+	merged := *s
+	merged.AllOf = nil
+	merged.Properties = make(map[string]*jsonschema.Schema, len(s.Properties))
+	for name, prop := range s.Properties {
+		merged.Properties[name] = prop
+	}
+	merged.Required = append([]string(nil), s.Required...)
+	for i, branch := range s.AllOf {
+		branch = c.resolveRef(branch, fmt.Sprintf("%s.allOf[%d]", path, i))
+		if merged.Type == "" && len(merged.Types) == 0 {
+			merged.Type, merged.Types = branch.Type, branch.Types
+		}
+		if merged.Description == "" {
+			merged.Description = branch.Description
+		}
+		for name, prop := range branch.Properties {
+			if _, exists := merged.Properties[name]; !exists {
+				merged.Properties[name] = prop
+			}
+		}
+		merged.Required = append(merged.Required, branch.Required...)
+	}
+	return &merged
+}
+
+// resolveType determines the node's type. When the type comes from an
+// anyOf/oneOf alternative, that alternative is returned as alt and should be
+// converted instead. An empty type means none could be determined.
+func (c *schemaConverter) resolveType(s *jsonschema.Schema, path string) (typ string, alt *jsonschema.Schema, nullable bool) {
+	if len(s.Types) > 0 {
+		var nonNull []string
+		for _, t := range s.Types {
+			if t == "null" {
+				nullable = true
+			} else {
+				nonNull = append(nonNull, t)
+			}
+		}
+		if len(nonNull) == 0 {
+			return "", nil, nullable
+		}
+		if len(nonNull) > 1 {
+			c.warn(path, fmt.Sprintf("union type %v is not supported, using %q", s.Types, nonNull[0]))
+		}
+		return normalizeType(nonNull[0]), nil, nullable
+	}
+	if s.Type != "" {
+		return normalizeType(s.Type), nil, false
+	}
+
+	alternatives, keyword := s.AnyOf, "anyOf"
+	if len(alternatives) == 0 {
+		alternatives, keyword = s.OneOf, "oneOf"
+	}
+	if len(alternatives) > 0 {
+		var candidates []*jsonschema.Schema
+		for i, a := range alternatives {
+			a = c.resolveRef(a, fmt.Sprintf("%s.%s[%d]", path, keyword, i))
+			if a.Type == "null" {
+				nullable = true
+				continue
+			}
+			candidates = append(candidates, a)
+		}
+		if len(candidates) == 0 {
+			return "", nil, nullable
+		}
+		if len(candidates) > 1 {
+			c.warn(path, fmt.Sprintf("%s with %d alternatives is not supported, using the first", keyword, len(candidates)))
+		}
+		return "", candidates[0], nullable
+	}
+
+	// Infer a type from the keywords that are present.
+	switch {
+	case len(s.Properties) > 0 || len(s.Required) > 0:
+		return "object", nil, false
+	case s.Items != nil || len(s.PrefixItems) > 0:
+		return "array", nil, false
+	case len(s.Enum) > 0 || s.Const != nil:
+		return "string", nil, false
+	}
+	return "", nil, false
+}
+
+// normalizeType maps JSON Schema type names onto Gemini's type names.
+func normalizeType(t string) string {
+	switch t {
+	case "object", "array", "string", "number", "integer", "boolean":
+		return t
+	default:
+		return "string"
+	}
+}
+
+// convertEnum carries enum and const values across. Gemini only supports
+// string enums, so other enums are listed in the description instead.
+func (c *schemaConverter) convertEnum(s *jsonschema.Schema, out *gemini.Schema, path string) {
+	values := s.Enum
+	if s.Const != nil {
+		values = []any{*s.Const}
+	}
+	if len(values) == 0 {
+		return
+	}
+	strs := make([]string, 0, len(values))
+	for _, v := range values {
+		strs = append(strs, fmt.Sprint(v))
+	}
+	if out.Type == "string" {
+		out.Enum = strs
+		return
+	}
+	c.warn(path, fmt.Sprintf("enum on %s values is not supported, listed in description", out.Type))
+	out.Description = appendNote(out.Description, "Allowed values: "+strings.Join(strs, ", ")+".")
+}
+
+func (c *schemaConverter) convertObject(s *jsonschema.Schema, out *gemini.Schema, path string, depth int) {
+	if len(s.Properties) == 0 {
+		// {"not": {}} is the "false" schema that closes an object to extra keys.
+		if s.AdditionalProperties != nil && s.AdditionalProperties.Not == nil {
+			c.warn(path, "free-form object (additionalProperties) cannot be described, arguments are unconstrained")
+		}
+		return
+	}
+	out.Properties = make(map[string]*gemini.Schema, len(s.Properties))
+	names := make([]string, 0, len(s.Properties))
+	for name := range s.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		out.Properties[name] = c.convert(s.Properties[name], path+"."+name, depth+1)
+	}
+	seen := make(map[string]bool, len(s.Required))
+	for _, name := range s.Required {
+		if _, ok := out.Properties[name]; ok && !seen[name] {
+			out.Required = append(out.Required, name)
+			seen[name] = true
+		}
+	}
+}
+
+func (c *schemaConverter) convertArray(s *jsonschema.Schema, out *gemini.Schema, path string, depth int) {
+	switch {
+	case s.Items != nil:
+		out.Items = c.convert(s.Items, path+"[]", depth+1)
+	case len(s.PrefixItems) > 0:
+		c.warn(path, "tuple arrays (prefixItems) are not supported, using the first item schema")
+		out.Items = c.convert(s.PrefixItems[0], path+"[0]", depth+1)
+	default:
+		c.warn(path, "array without items, assuming string items")
+		out.Items = &gemini.Schema{Type: "string"}
+	}
+}
+
+// unsupportedKeywords lists structural JSON Schema keywords present on s that
+// have no Gemini equivalent. Plain validation keywords (pattern, minimum, ...)
+// are dropped silently since they do not change the argument shape.
+func unsupportedKeywords(s *jsonschema.Schema) []string {
+	var found []string
+	if s.Not != nil {
+		found = append(found, "not")
+	}
+	if s.If != nil || s.Then != nil || s.Else != nil {
+		found = append(found, "if/then/else")
+	}
+	if len(s.PatternProperties) > 0 {
+		found = append(found, "patternProperties")
+	}
+	if len(s.DependentSchemas) > 0 || len(s.DependentRequired) > 0 {
+		found = append(found, "dependent schemas")
+	}
+	return found
+}
+
+func appendNote(description, note string) string {
+	if description == "" {
+		return note
+	}
+	return description + " " + note
+}
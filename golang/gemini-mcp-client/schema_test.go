@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/liuzl/ai/gemini"
+	"github.com/modelcontextprotocol/go-sdk/jsonschema"
+)
+
+// object returns an object schema with the given properties.
+func object(properties map[string]*gemini.Schema, required ...string) *gemini.Schema {
+	return &gemini.Schema{Type: "object", Properties: properties, Required: required}
+}
+
+func TestConvertInputSchema(t *testing.T) {
+	tests := []struct {
+		name     string
+		schema   string
+		want     *gemini.Schema
+		warnings []string
+	}{
+		{
+			name:   "properties and required",
+			schema: `{"type": "object", "properties": {"path": {"type": "string", "description": "File to read"}, "lines": {"type": "integer", "title": "Line count"}}, "required": ["path", "missing", "path"]}`,
+			want: object(map[string]*gemini.Schema{
+				"path":  {Type: "string", Description: "File to read"},
+				"lines": {Type: "integer", Description: "Line count"},
+			}, "path"),
+		},
+		{
+			name:     "top-level type that is not an object",
+			schema:   `{"type": "string"}`,
+			want:     &gemini.Schema{Type: "object"},
+			warnings: []string{`$: top-level type "string" is not an object`},
+		},
+		{
+			name:   "$ref into $defs keeps the referring description",
+			schema: `{"type": "object", "properties": {"at": {"$ref": "#/$defs/point", "description": "Where to click"}}, "$defs": {"point": {"type": "object", "properties": {"x": {"type": "number"}}}}}`,
+			want: object(map[string]*gemini.Schema{
+				"at": {Type: "object", Description: "Where to click", Properties: map[string]*gemini.Schema{"x": {Type: "number"}}},
+			}),
+		},
+		{
+			name:   "$ref into definitions",
+			schema: `{"type": "object", "properties": {"mode": {"$ref": "#/definitions/mode"}}, "definitions": {"mode": {"type": "string", "description": "Open mode"}}}`,
+			want: object(map[string]*gemini.Schema{
+				"mode": {Type: "string", Description: "Open mode"},
+			}),
+		},
+		{
+			name:     "unresolvable $ref",
+			schema:   `{"type": "object", "properties": {"x": {"$ref": "https://example.com/schema.json"}}}`,
+			want:     object(map[string]*gemini.Schema{"x": {Type: "object"}}),
+			warnings: []string{`$.x: cannot resolve $ref "https://example.com/schema.json"`},
+		},
+		{
+			name:     "$ref cycle",
+			schema:   `{"type": "object", "properties": {"x": {"$ref": "#/$defs/a"}}, "$defs": {"a": {"$ref": "#/$defs/b"}, "b": {"$ref": "#/$defs/a"}}}`,
+			want:     object(map[string]*gemini.Schema{"x": {Type: "object"}}),
+			warnings: []string{"$.x: $ref chain too long"},
+		},
+		{
+			name:   "allOf merges properties, required, type and description",
+			schema: `{"allOf": [{"type": "object", "description": "Base", "properties": {"id": {"type": "string"}, "name": {"type": "integer"}}, "required": ["id"]}, {"$ref": "#/$defs/named"}], "properties": {"name": {"type": "string"}}, "$defs": {"named": {"properties": {"tags": {"type": "array", "items": {"type": "string"}}}, "required": ["name"]}}}`,
+			want: &gemini.Schema{Type: "object", Description: "Base", Properties: map[string]*gemini.Schema{
+				"id":   {Type: "string"},
+				"name": {Type: "string"},
+				"tags": {Type: "array", Items: &gemini.Schema{Type: "string"}},
+			}, Required: []string{"id", "name"}},
+		},
+		{
+			name:   "anyOf with null takes the other alternative as nullable",
+			schema: `{"type": "object", "properties": {"limit": {"description": "Maximum results", "anyOf": [{"type": "null"}, {"type": "integer"}]}}}`,
+			want: object(map[string]*gemini.Schema{
+				"limit": {Type: "integer", Description: "Maximum results", Nullable: true},
+			}),
+		},
+		{
+			name:   "oneOf takes the first alternative",
+			schema: `{"type": "object", "properties": {"id": {"oneOf": [{"type": "string", "description": "Name"}, {"type": "integer"}]}}}`,
+			want: object(map[string]*gemini.Schema{
+				"id": {Type: "string", Description: "Name"},
+			}),
+			warnings: []string{"$.id: oneOf with 2 alternatives is not supported, using the first"},
+		},
+		{
+			name:   "type lists",
+			schema: `{"type": "object", "properties": {"a": {"type": ["string", "null"]}, "b": {"type": ["integer", "string"]}, "c": {"type": ["null"]}}}`,
+			want: object(map[string]*gemini.Schema{
+				"a": {Type: "string", Nullable: true},
+				"b": {Type: "integer"},
+				"c": {Type: "string", Nullable: true},
+			}),
+			warnings: []string{`$.b: union type [integer string] is not supported, using "integer"`, "$.c: no usable type"},
+		},
+		{
+			name:   "string enums are kept, others are described",
+			schema: `{"type": "object", "properties": {"color": {"type": "string", "enum": ["red", "green"]}, "level": {"type": "integer", "description": "Level.", "enum": [1, 2, 3]}, "kind": {"const": "file"}}}`,
+			want: object(map[string]*gemini.Schema{
+				"color": {Type: "string", Enum: []string{"red", "green"}},
+				"level": {Type: "integer", Description: "Level. Allowed values: 1, 2, 3."},
+				"kind":  {Type: "string", Enum: []string{"file"}},
+			}),
+			warnings: []string{"$.level: enum on integer values is not supported"},
+		},
+		{
+			name:   "formats",
+			schema: `{"type": "object", "properties": {"when": {"type": "string", "format": "date-time"}, "site": {"type": "string", "description": "Site.", "format": "uri"}}}`,
+			want: object(map[string]*gemini.Schema{
+				"when": {Type: "string", Format: "date-time"},
+				"site": {Type: "string", Description: "Site. Format: uri."},
+			}),
+		},
+		{
+			name:   "arrays",
+			schema: `{"type": "object", "properties": {"a": {"type": "array", "items": {"type": "integer"}}, "b": {"type": "array", "prefixItems": [{"type": "number"}, {"type": "string"}]}, "c": {"type": "array"}}}`,
+			want: object(map[string]*gemini.Schema{
+				"a": {Type: "array", Items: &gemini.Schema{Type: "integer"}},
+				"b": {Type: "array", Items: &gemini.Schema{Type: "number"}},
+				"c": {Type: "array", Items: &gemini.Schema{Type: "string"}},
+			}),
+			warnings: []string{"$.b: tuple arrays (prefixItems) are not supported", "$.c: array without items"},
+		},
+		{
+			name:   "types inferred from keywords",
+			schema: `{"properties": {"o": {"required": ["x"]}, "a": {"items": {"type": "boolean"}}, "e": {"enum": ["x"]}, "u": {"description": "Anything"}}}`,
+			want: object(map[string]*gemini.Schema{
+				"o": {Type: "object"},
+				"a": {Type: "array", Items: &gemini.Schema{Type: "boolean"}},
+				"e": {Type: "string", Enum: []string{"x"}},
+				"u": {Type: "string", Description: "Anything"},
+			}),
+			warnings: []string{"$.u: no usable type, falling back to string"},
+		},
+		{
+			name:   "unsupported keywords and free-form objects",
+			schema: `{"type": "object", "properties": {"n": {"type": "string", "not": {"enum": ["x"]}}, "m": {"type": "object", "additionalProperties": {"type": "string"}}}}`,
+			want: object(map[string]*gemini.Schema{
+				"n": {Type: "string"},
+				"m": {Type: "object"},
+			}),
+			warnings: []string{"$.m: free-form object (additionalProperties)", "$.n: not is not supported"},
+		},
+		{
+			name:   "closed objects are not free-form",
+			schema: `{"type": "object", "properties": {"empty": {"type": "object", "additionalProperties": false}, "open": {"type": "object", "additionalProperties": true}}}`,
+			want: object(map[string]*gemini.Schema{
+				"empty": {Type: "object"},
+				"open":  {Type: "object"},
+			}),
+			warnings: []string{"$.open: free-form object (additionalProperties)"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var schema jsonschema.Schema
+			if err := json.Unmarshal([]byte(test.schema), &schema); err != nil {
+				t.Fatalf("invalid test schema: %v", err)
+			}
+			got, warnings := convertInputSchema(&schema)
+			if !reflect.DeepEqual(got, test.want) {
+				gotJSON, _ := json.Marshal(got)
+				wantJSON, _ := json.Marshal(test.want)
+				t.Errorf("schema:\n got %s\nwant %s", gotJSON, wantJSON)
+			}
+			if len(warnings) != len(test.warnings) {
+				t.Errorf("warnings = %q, want %d", warnings, len(test.warnings))
+			}
+			for _, want := range test.warnings {
+				found := false
+				for _, warning := range warnings {
+					found = found || strings.HasPrefix(warning, want)
+				}
+				if !found {
+					t.Errorf("no warning starting with %q in %q", want, warnings)
+				}
+			}
+		})
+	}
+}
+
+func TestConvertInputSchemaWithoutSchema(t *testing.T) {
+	got, warnings := convertInputSchema(nil)
+	if !reflect.DeepEqual(got, &gemini.Schema{Type: "object"}) || warnings != nil {
+		t.Errorf("convertInputSchema(nil) = %+v, %q, want a bare object", got, warnings)
+	}
+}
+
+func TestConvertInputSchemaStopsSelfReference(t *testing.T) {
+	var schema jsonschema.Schema
+	if err := json.Unmarshal([]byte(`{"$ref": "#/$defs/node", "$defs": {"node": {"type": "object", "properties": {"child": {"$ref": "#/$defs/node"}}}}}`), &schema); err != nil {
+		t.Fatal(err)
+	}
+	got, warnings := convertInputSchema(&schema)
+
+	// The root is at depth 0, so maxSchemaDepth nested children still have
+	// properties and the next one is cut off.
+	depth := 0
+	for node := got; node.Properties != nil; node = node.Properties["child"] {
+		depth++
+	}
+	if depth != maxSchemaDepth+1 {
+		t.Errorf("schema nests %d levels, want %d", depth, maxSchemaDepth+1)
+	}
+	if len(warnings) != 1 || !strings.HasSuffix(warnings[0], "schema nested too deeply, using an untyped object") {
+		t.Errorf("warnings = %q, want one about the depth", warnings)
+	}
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// pingTimeout bounds a health check ping.
+const pingTimeout = 10 * time.Second
+
+// The lists whose changes servers announce with notifications/*/list_changed.
+const (
+	listTools     = "tools"
+	listResources = "resources"
+	listPrompts   = "prompts"
+)
+
+// Notifications the SDK decodes that the pool hands to handlers as well.
+const (
+	notificationProgress       = "notifications/progress"
+	notificationLoggingMessage = "notifications/message"
+)
+
+// clientImplementation is how the agent introduces itself to MCP servers.
+var clientImplementation = &mcp.Implementation{Name: "gemini-mcp-client", Version: "v1.0.0"}
+
+// serverPool owns the sessions to all configured MCP servers, together with
+// any child processes and log files backing stdio servers. A server whose
+// session ends or stops answering pings is marked down and reconnected in the
+// background; the agent picks up reconnected servers with takeReconnected,
+// and servers whose tools, resources or prompts changed with takeChanged.
+type serverPool struct {
+	client  *mcp.Client
+	configs map[string]ServerConfig
+	// healthInterval is how often sessions are pinged, zero for never;
+	// maxReconnectDelay caps the backoff between reconnection attempts.
+	healthInterval    time.Duration
+	maxReconnectDelay time.Duration
+	// logLevel is the MCP logging level requested from servers that support
+	// logging, or logLevelOff.
+	logLevel atomic.Value
+	closing  atomic.Bool
+	done     chan struct{}
+	once     sync.Once
+
+	mu          sync.Mutex
+	sessions    map[string]*mcp.ClientSession
+	infos       map[string]*serverInfo
+	closers     map[string]io.Closer
+	down        map[string]bool
+	reconnected []string
+	changed     map[string]map[string]bool
+	checks      map[string]chan struct{}
+	handlers    map[string]func(server string, params json.RawMessage)
+}
+
+func newServerPool() *serverPool {
+	return &serverPool{
+		configs:           make(map[string]ServerConfig),
+		healthInterval:    envDuration("MCP_HEALTH_INTERVAL", 30*time.Second),
+		maxReconnectDelay: envDuration("MCP_RECONNECT_MAX_DELAY", time.Minute),
+		done:              make(chan struct{}),
+		sessions:          make(map[string]*mcp.ClientSession),
+		infos:             make(map[string]*serverInfo),
+		closers:           make(map[string]io.Closer),
+		down:              make(map[string]bool),
+		changed:           make(map[string]map[string]bool),
+		checks:            make(map[string]chan struct{}),
+		handlers:          make(map[string]func(string, json.RawMessage)),
+	}
+}
+
+// connectMCPServers opens one session per configured server. Servers that
+// fail to connect are reported and skipped; those that connect are kept
+// connected by supervise.
+func connectMCPServers(ctx context.Context, config *MCPConfig) *serverPool {
+	pool := newServerPool()
+	pool.client = mcp.NewClient(clientImplementation, pool.clientOptions())
+	for _, name := range config.serverNames() {
+		serverConfig := config.MCPServers[name]
+		pool.configs[name] = serverConfig
+		fmt.Printf("%sConnecting to MCP server '%s': %s%s\n", ColorCyan, name, serverConfig.describe(), ColorReset)
+		session, info, closer, err := pool.dial(ctx, name)
+		if err != nil {
+			fmt.Printf("%sWarning: Failed to connect to MCP server '%s': %v%s\n", ColorYellow, name, err, ColorReset)
+			if serverConfig.isStdio() {
+				fmt.Printf("%sServer stderr was logged to %s%s\n", ColorGray, serverLogPath(name), ColorReset)
+			}
+			continue
+		}
+		pool.add(name, session, info, closer)
+		go pool.supervise(name)
+		fmt.Printf("%s✅ Successfully connected to MCP server '%s'%s\n", ColorGreen, name, ColorReset)
+	}
+	return pool
+}
+
+// dial connects to the named server.
+func (p *serverPool) dial(ctx context.Context, name string) (*mcp.ClientSession, *serverInfo, io.Closer, error) {
+	info := &serverInfo{name: name, notify: p.dispatch}
+	transport, closer, err := p.configs[name].newTransport(name, info)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid config: %v", err)
+	}
+	session, err := p.client.Connect(ctx, transport)
+	if err != nil {
+		if closer != nil {
+			closer.Close()
+		}
+		return nil, nil, nil, err
+	}
+	return session, info, closer, nil
+}
+
+func (p *serverPool) add(name string, session *mcp.ClientSession, info *serverInfo, closer io.Closer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sessions[name] = session
+	p.infos[name] = info
+	if closer != nil {
+		p.closers[name] = closer
+	}
+	delete(p.down, name)
+}
+
+// clientOptions has the client tell the pool about the notifications the SDK
+// handles itself.
+func (p *serverPool) clientOptions() *mcp.ClientOptions {
+	return &mcp.ClientOptions{
+		ToolListChangedHandler: func(_ context.Context, session *mcp.ClientSession, _ *mcp.ToolListChangedParams) {
+			p.listChanged(session, listTools)
+		},
+		ResourceListChangedHandler: func(_ context.Context, session *mcp.ClientSession, _ *mcp.ResourceListChangedParams) {
+			p.listChanged(session, listResources)
+		},
+		PromptListChangedHandler: func(_ context.Context, session *mcp.ClientSession, _ *mcp.PromptListChangedParams) {
+			p.listChanged(session, listPrompts)
+		},
+		ProgressNotificationHandler: func(_ context.Context, session *mcp.ClientSession, params *mcp.ProgressNotificationParams) {
+			p.forward(session, notificationProgress, params)
+		},
+		LoggingMessageHandler: func(_ context.Context, session *mcp.ClientSession, params *mcp.LoggingMessageParams) {
+			p.forward(session, notificationLoggingMessage, params)
+		},
+	}
+}
+
+// forward hands a notification the SDK decoded to the handler registered
+// for it, like those dispatched by observedConn.
+func (p *serverPool) forward(session *mcp.ClientSession, method string, params any) {
+	p.mu.Lock()
+	name, ok := p.nameOf(session)
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+	if data, err := json.Marshal(params); err == nil {
+		p.dispatch(name, method, data)
+	}
+}
+
+// nameOf returns the name of the server of session; p.mu must be held.
+func (p *serverPool) nameOf(session *mcp.ClientSession) (string, bool) {
+	for name, s := range p.sessions {
+		if s == session {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// listChanged notes that the server of session changed one of its lists. The
+// agent fetches the list again before its next request.
+func (p *serverPool) listChanged(session *mcp.ClientSession, list string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	name, ok := p.nameOf(session)
+	if !ok {
+		return
+	}
+	if p.changed[name] == nil {
+		p.changed[name] = make(map[string]bool)
+	}
+	if !p.changed[name][list] {
+		p.changed[name][list] = true
+		fmt.Printf("\n%s🔔 MCP server '%s' changed its %s; they are refreshed before the next request.%s\n", ColorPurple, name, list, ColorReset)
+	}
+}
+
+// takeChanged returns the lists each server changed since it was last called.
+func (p *serverPool) takeChanged() map[string][]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	changed := make(map[string][]string, len(p.changed))
+	for name, lists := range p.changed {
+		for list := range lists {
+			changed[name] = append(changed[name], list)
+		}
+		sort.Strings(changed[name])
+	}
+	clear(p.changed)
+	return changed
+}
+
+// handle registers the handler for a notification the SDK does not route
+// itself (see observedConn).
+func (p *serverPool) handle(method string, handler func(server string, params json.RawMessage)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.handlers[method] = handler
+}
+
+func (p *serverPool) dispatch(server, method string, params json.RawMessage) {
+	p.mu.Lock()
+	handler := p.handlers[method]
+	p.mu.Unlock()
+	if handler != nil {
+		handler(server, params)
+	}
+}
+
+// names returns the names of the connected servers in a stable order.
+func (p *serverPool) names() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	names := make([]string, 0, len(p.sessions))
+	for name := range p.sessions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// session returns the session of the named server, if it is connected.
+func (p *serverPool) session(name string) (*mcp.ClientSession, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	session, ok := p.sessions[name]
+	return session, ok
+}
+
+// isDown reports whether the named server lost its session and is being
+// reconnected.
+func (p *serverPool) isDown(name string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.down[name]
+}
+
+// capabilities returns what the named server declared when initializing.
+func (p *serverPool) capabilities(server string) serverCapabilities {
+	p.mu.Lock()
+	info, ok := p.infos[server]
+	p.mu.Unlock()
+	if ok {
+		return info.Capabilities()
+	}
+	return serverCapabilities{}
+}
+
+// request sends an MCP request the SDK has no working method for to the
+// named server (see serverInfo.sendRequest).
+func (p *serverPool) request(ctx context.Context, server, method string, params, result any) error {
+	p.mu.Lock()
+	session, ok := p.sessions[server]
+	info := p.infos[server]
+	p.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("MCP server '%s' is not connected", server)
+	}
+	return info.sendRequest(ctx, session, method, params, result)
+}
+
+// level returns the logging level requested from the servers.
+func (p *serverPool) level() string {
+	level, _ := p.logLevel.Load().(string)
+	return level
+}
+
+// setLogLevel asks every connected server that supports logging to send log
+// messages at level and above, and remembers it for servers that reconnect.
+func (p *serverPool) setLogLevel(ctx context.Context, level string) error {
+	if logLevelRank(level) < 0 && level != logLevelOff {
+		return fmt.Errorf("unknown log level %q (want %s or %s)", level, strings.Join(logLevels, ", "), logLevelOff)
+	}
+	p.logLevel.Store(level)
+	var failed []string
+	for _, name := range p.names() {
+		if err := p.applyLogLevel(ctx, name); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to set the log level on %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// applyLogLevel sends the logging level to the named server if it declared
+// the logging capability. With logging off nothing is sent; the messages
+// servers send anyway are not shown.
+func (p *serverPool) applyLogLevel(ctx context.Context, name string) error {
+	level := p.level()
+	session, ok := p.session(name)
+	if !ok || level == "" || level == logLevelOff || p.capabilities(name).Logging == nil {
+		return nil
+	}
+	return session.SetLevel(ctx, &mcp.SetLevelParams{Level: mcp.LoggingLevel(level)})
+}
+
+// takeReconnected returns the servers that reconnected since it was last
+// called, so that their capabilities can be discovered again.
+func (p *serverPool) takeReconnected() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	names := p.reconnected
+	p.reconnected = nil
+	return names
+}
+
+// check asks the supervisor of the named server to ping it now, after a
+// request to it failed.
+func (p *serverPool) check(name string) {
+	p.mu.Lock()
+	checks := p.checks[name]
+	p.mu.Unlock()
+	select {
+	case checks <- struct{}{}:
+	default:
+	}
+}
+
+// supervise keeps the named server connected until the pool is closed. When
+// its session ends or stops answering pings, the server is marked down, so
+// its tools are withheld from the model, and reconnected with backoff.
+func (p *serverPool) supervise(name string) {
+	checks := make(chan struct{}, 1)
+	p.mu.Lock()
+	p.checks[name] = checks
+	p.mu.Unlock()
+	for {
+		session, ok := p.session(name)
+		if !ok {
+			return
+		}
+		reason := p.monitor(name, session, checks)
+		if p.closing.Load() {
+			return
+		}
+		p.markDown(name, session)
+		fmt.Printf("\n%sMCP server '%s' %s; its tools are unavailable until it reconnects.%s\n", ColorRed, name, reason, ColorReset)
+		if !p.reconnect(name) {
+			return
+		}
+	}
+}
+
+// monitor waits until session ends or fails a health check and says why.
+func (p *serverPool) monitor(name string, session *mcp.ClientSession, checks <-chan struct{}) string {
+	ended := make(chan error, 1)
+	go func() { ended <- session.Wait() }()
+	var ticks <-chan time.Time
+	if p.healthInterval > 0 {
+		ticker := time.NewTicker(p.healthInterval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	for {
+		select {
+		case err := <-ended:
+			reason := "exited unexpectedly"
+			if err != nil {
+				reason += fmt.Sprintf(" (%v)", err)
+			}
+			if p.configs[name].isStdio() {
+				reason += "; see " + serverLogPath(name)
+			}
+			return reason
+		case <-ticks:
+		case <-checks:
+		case <-p.done:
+			return ""
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+		err := session.Ping(ctx, nil)
+		cancel()
+		if err != nil && !p.closing.Load() {
+			return fmt.Sprintf("stopped answering pings (%v)", err)
+		}
+	}
+}
+
+// markDown drops the session of a server that is gone.
+func (p *serverPool) markDown(name string, session *mcp.ClientSession) {
+	p.mu.Lock()
+	delete(p.sessions, name)
+	delete(p.infos, name)
+	closer := p.closers[name]
+	delete(p.closers, name)
+	// Everything is discovered again once it reconnects.
+	delete(p.changed, name)
+	p.down[name] = true
+	p.mu.Unlock()
+	session.Close()
+	if closer != nil {
+		closer.Close()
+	}
+}
+
+// reconnect dials the named server until it answers, waiting twice as long
+// after each failure up to maxReconnectDelay. It gives up when the pool is
+// closed, reporting whether it reconnected.
+func (p *serverPool) reconnect(name string) bool {
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-time.After(delay):
+		case <-p.done:
+			return false
+		}
+		session, info, closer, err := p.dial(context.Background(), name)
+		if err != nil {
+			delay = min(delay*2, p.maxReconnectDelay)
+			fmt.Printf("\n%sReconnecting to MCP server '%s' failed (attempt %d): %v; next attempt in %v%s\n",
+				ColorGray, name, attempt, err, delay, ColorReset)
+			continue
+		}
+		if p.closing.Load() {
+			session.Close()
+			if closer != nil {
+				closer.Close()
+			}
+			return false
+		}
+		p.add(name, session, info, closer)
+		if err := p.applyLogLevel(context.Background(), name); err != nil {
+			fmt.Printf("\n%sWarning: Failed to set the log level on MCP server '%s': %v%s\n", ColorYellow, name, err, ColorReset)
+		}
+		p.mu.Lock()
+		p.reconnected = append(p.reconnected, name)
+		p.mu.Unlock()
+		fmt.Printf("\n%s✅ Reconnected to MCP server '%s'; its tools are available again.%s\n", ColorGreen, name, ColorReset)
+		return true
+	}
+}
+
+// Close shuts down every session, which for stdio servers closes their stdin
+// and waits for the process to exit (escalating to SIGTERM and SIGKILL), then
+// releases the log files. It is safe to call more than once.
+func (p *serverPool) Close() {
+	p.once.Do(func() {
+		p.closing.Store(true)
+		close(p.done)
+		p.mu.Lock()
+		sessions := make(map[string]*mcp.ClientSession, len(p.sessions))
+		for name, session := range p.sessions {
+			sessions[name] = session
+		}
+		p.mu.Unlock()
+
+		var wg sync.WaitGroup
+		for name, session := range sessions {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := session.Close(); err != nil {
+					fmt.Printf("%sWarning: Error closing MCP server '%s': %v%s\n", ColorYellow, name, err, ColorReset)
+				}
+			}()
+		}
+		wg.Wait()
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		for _, closer := range p.closers {
+			closer.Close()
+		}
+	})
+}
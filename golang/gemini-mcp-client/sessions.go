@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/liuzl/ai/gemini"
+)
+
+// resumeLast is the session name that resumes the most recently saved session.
+const resumeLast = "last"
+
+// newNameAttempts is how many random names newName tries before giving up.
+const newNameAttempts = 10
+
+var sessionNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// sessionStore keeps conversations on disk, one file per session holding a
+// JSON encoded gemini.Content per line.
+type sessionStore struct {
+	dir string
+}
+
+// savedSession describes a session file.
+type savedSession struct {
+	Name     string
+	Messages int
+	Modified time.Time
+}
+
+// newSessionStore stores sessions in AGENT_SESSION_DIR, defaulting to
+// gemini-mcp-client/sessions under the user's config directory.
+func newSessionStore() sessionStore {
+	dir := os.Getenv("AGENT_SESSION_DIR")
+	if dir == "" {
+		base, err := os.UserConfigDir()
+		if err != nil {
+			base = os.TempDir()
+		}
+		dir = filepath.Join(base, "gemini-mcp-client", "sessions")
+	}
+	return sessionStore{dir: dir}
+}
+
+// newName names a new session after the time it was started. A random
+// suffix keeps sessions started in the same second, here or by another
+// client, from sharing a file; names already on disk are skipped.
+func (s sessionStore) newName() (string, error) {
+	for range newNameAttempts {
+		name := fmt.Sprintf("%s-%08x", time.Now().Format("20060102-150405"), rand.Uint32())
+		_, err := os.Stat(s.path(name))
+		if errors.Is(err, os.ErrNotExist) {
+			return name, nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to name a new session: %v", err)
+		}
+	}
+	return "", fmt.Errorf("failed to name a new session: %d names in a row were taken in %s", newNameAttempts, s.dir)
+}
+
+func (s sessionStore) path(name string) string {
+	return filepath.Join(s.dir, name+".jsonl")
+}
+
+// save writes the history of a session, replacing the file atomically so a
+// crash never leaves a half written session behind.
+func (s sessionStore) save(name string, history []gemini.Content) error {
+	if !sessionNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid session name %q: use letters, digits, '.', '_' and '-'", name)
+	}
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create session directory: %v", err)
+	}
+	tmp, err := os.CreateTemp(s.dir, name+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to save session: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(w)
+	for _, content := range history {
+		if err := encoder.Encode(content); err != nil {
+			tmp.Close()
+			return fmt.Errorf("failed to encode session: %v", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save session: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save session: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path(name)); err != nil {
+		return fmt.Errorf("failed to save session: %v", err)
+	}
+	return nil
+}
+
+// load reads the history of a session.
+func (s sessionStore) load(name string) ([]gemini.Content, error) {
+	if !sessionNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid session name %q", name)
+	}
+	file, err := os.Open(s.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("no saved session named '%s'", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open session: %v", err)
+	}
+	defer file.Close()
+
+	var history []gemini.Content
+	scanner := bufio.NewScanner(file)
+	// Inline data makes for long lines.
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var content gemini.Content
+		if err := json.Unmarshal(scanner.Bytes(), &content); err != nil {
+			return nil, fmt.Errorf("session '%s' is corrupt at line %d: %v", name, line, err)
+		}
+		history = append(history, content)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read session: %v", err)
+	}
+	return history, nil
+}
+
+// list returns the saved sessions, most recently modified first.
+func (s sessionStore) list() ([]savedSession, error) {
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %v", err)
+	}
+	var sessions []savedSession
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".jsonl")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		sessions = append(sessions, savedSession{
+			Name:     name,
+			Messages: countLines(s.path(name)),
+			Modified: info.ModTime(),
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Modified.After(sessions[j].Modified)
+	})
+	return sessions, nil
+}
+
+func countLines(path string) int {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	var n int
+	for scanner.Scan() {
+		n++
+	}
+	return n
+}
+
+// resolve maps "last" to the most recently saved session.
+func (s sessionStore) resolve(name string) (string, error) {
+	if name != resumeLast {
+		return name, nil
+	}
+	sessions, err := s.list()
+	if err != nil {
+		return "", err
+	}
+	if len(sessions) == 0 {
+		return "", errors.New("there are no saved sessions to resume")
+	}
+	return sessions[0].Name, nil
+}
+
+// persist saves the conversation to the current session. Empty
+// conversations are not worth a file.
+func (a *Agent) persist() {
+	if len(a.conversationHistory) == 0 {
+		return
+	}
+	if err := a.sessions.save(a.sessionName, a.conversationHistory); err != nil {
+		fmt.Printf("%sWarning: %v%s\n", ColorYellow, err, ColorReset)
+	}
+}
+
+// resumeSession replaces the conversation with a saved session. The following
+// turns are saved to that session, or to a new one when fork is set so the
+// saved session stays as it is.
+func (a *Agent) resumeSession(name string, fork bool) error {
+	name, err := a.sessions.resolve(name)
+	if err != nil {
+		return err
+	}
+	history, err := a.sessions.load(name)
+	if err != nil {
+		return err
+	}
+	if len(history) == 0 {
+		return fmt.Errorf("session '%s' is empty", name)
+	}
+	newName := name
+	if fork {
+		if newName, err = a.sessions.newName(); err != nil {
+			return err
+		}
+	}
+	a.conversationHistory = history
+	a.droppedMessages = droppedBefore(history)
+	a.pendingParts = nil
+	a.usage.reset()
+	a.approval.resetSession()
+	a.sessionName = newName
+	if fork {
+		fmt.Printf("%s📂 Loaded session '%s' (%d messages) as new session '%s'.%s\n", ColorGreen, name, len(history), a.sessionName, ColorReset)
+		return nil
+	}
+	fmt.Printf("%s📂 Resumed session '%s' (%d messages).%s\n", ColorGreen, name, len(history), ColorReset)
+	return nil
+}
+
+// saveSession saves the conversation under a new name and continues in it.
+func (a *Agent) saveSession(name string) error {
+	if err := a.sessions.save(name, a.conversationHistory); err != nil {
+		return err
+	}
+	a.sessionName = name
+	fmt.Printf("%s💾 Session saved as '%s' (%s).%s\n", ColorGreen, name, a.sessions.path(name), ColorReset)
+	return nil
+}
+
+func (a *Agent) printSessions() {
+	sessions, err := a.sessions.list()
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", ColorRed, err, ColorReset)
+		return
+	}
+	if len(sessions) == 0 {
+		fmt.Printf("%sNo saved sessions in %s.%s\n", ColorGray, a.sessions.dir, ColorReset)
+		return
+	}
+	fmt.Printf("\n%s%s=== Saved Sessions (%s) ===%s\n", ColorBold, ColorCyan, a.sessions.dir, ColorReset)
+	for _, session := range sessions {
+		current := ""
+		if session.Name == a.sessionName {
+			current = " (current)"
+		}
+		fmt.Printf("%s%-24s%s %s%3d messages, %s%s%s\n", ColorPurple, session.Name, ColorReset,
+			ColorGray, session.Messages, session.Modified.Format("2006-01-02 15:04"), current, ColorReset)
+	}
+	fmt.Printf("%s%s=== End Sessions ===%s\n\n", ColorBold, ColorCyan, ColorReset)
+}
+
+// runSessionCommand handles the /save, /sessions, /load and /resume REPL
+// commands. It reports whether input was one of them.
+func (a *Agent) runSessionCommand(input string) bool {
+	fields := strings.Fields(input)
+	var err error
+	switch strings.ToLower(fields[0]) {
+	case "/sessions":
+		a.printSessions()
+	case "/save":
+		name := a.sessionName
+		if len(fields) > 1 {
+			name = fields[1]
+		}
+		err = a.saveSession(name)
+	case "/load":
+		if len(fields) != 2 {
+			fmt.Printf("%sUsage: /load <name>%s\n", ColorYellow, ColorReset)
+			return true
+		}
+		err = a.resumeSession(fields[1], true)
+	case "/resume":
+		name := resumeLast
+		if len(fields) > 1 {
+			name = fields[1]
+		}
+		err = a.resumeSession(name, false)
+	default:
+		return false
+	}
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", ColorRed, err, ColorReset)
+	}
+	return true
+}
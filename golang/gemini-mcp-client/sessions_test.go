@@ -0,0 +1,170 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/liuzl/ai/gemini"
+)
+
+// newSessionAgent returns an agent without servers that keeps its sessions
+// in dir.
+func newSessionAgent(t *testing.T, dir string) *Agent {
+	t.Helper()
+	t.Setenv("AGENT_SESSION_DIR", dir)
+	t.Setenv("MCP_AUDIT_LOG", "off")
+	agent, err := NewAgent(newGeminiProvider(), newServerPool())
+	if err != nil {
+		t.Fatalf("NewAgent: %v", err)
+	}
+	return agent
+}
+
+func testHistory(prompt string) []gemini.Content {
+	return []gemini.Content{
+		userMessage(prompt),
+		{Role: gemini.StringPtr("model"), Parts: []gemini.Part{{FunctionCall: &gemini.FunctionCall{Name: "test.echo", Args: map[string]any{"text": prompt}}}}},
+		{Role: gemini.StringPtr("user"), Parts: []gemini.Part{{FunctionResponse: &gemini.FunctionResponse{Name: "test.echo", Response: map[string]any{"content": "echo: " + prompt}}}}},
+		{Role: gemini.StringPtr("model"), Parts: []gemini.Part{{Text: gemini.StringPtr("done")}}},
+	}
+}
+
+func TestSessionStoreRoundTrip(t *testing.T) {
+	store := sessionStore{dir: t.TempDir()}
+	history := testHistory("hello")
+	if err := store.save("saved", history); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	loaded, err := store.load("saved")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, history) {
+		t.Errorf("loaded history differs:\n got %+v\nwant %+v", loaded, history)
+	}
+	sessions, err := store.list()
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].Name != "saved" || sessions[0].Messages != len(history) {
+		t.Errorf("list = %+v, want one session 'saved' with %d messages", sessions, len(history))
+	}
+	if name, err := store.resolve(resumeLast); err != nil || name != "saved" {
+		t.Errorf("resolve(last) = %q, %v, want saved", name, err)
+	}
+	if err := store.save("../escape", history); err == nil {
+		t.Error("save accepted a name outside the session directory")
+	}
+	if _, err := store.load("missing"); err == nil {
+		t.Error("load of a missing session succeeded")
+	}
+}
+
+func TestNewSessionNamesDoNotCollide(t *testing.T) {
+	store := sessionStore{dir: t.TempDir()}
+	seen := make(map[string]bool)
+	for range 1000 {
+		name, err := store.newName()
+		if err != nil {
+			t.Fatalf("newName: %v", err)
+		}
+		if !sessionNamePattern.MatchString(name) {
+			t.Fatalf("newName() = %q, not a valid session name", name)
+		}
+		if seen[name] {
+			t.Fatalf("newName() returned %q twice", name)
+		}
+		seen[name] = true
+	}
+
+	// Two clients started in the same second, and a clear in that second,
+	// each keep their own file.
+	dir := t.TempDir()
+	first, second := newSessionAgent(t, dir), newSessionAgent(t, dir)
+	first.conversationHistory = testHistory("first")
+	second.conversationHistory = testHistory("second")
+	first.persist()
+	second.persist()
+	firstName := first.sessionName
+	if err := first.clearConversation(); err != nil {
+		t.Fatalf("clear: %v", err)
+	}
+	if first.sessionName == firstName {
+		t.Errorf("clear kept the session name %q", firstName)
+	}
+	first.conversationHistory = testHistory("after clear")
+	first.persist()
+
+	for name, prompt := range map[string]string{firstName: "first", second.sessionName: "second", first.sessionName: "after clear"} {
+		history, err := first.sessions.load(name)
+		if err != nil {
+			t.Fatalf("load %s: %v", name, err)
+		}
+		if want := testHistory(prompt); !reflect.DeepEqual(history, want) {
+			t.Errorf("session %s was overwritten: got %+v, want %+v", name, history, want)
+		}
+	}
+}
+
+func TestResumeSession(t *testing.T) {
+	dir := t.TempDir()
+	original := newSessionAgent(t, dir)
+	original.conversationHistory = testHistory("hello")
+	original.persist()
+
+	resumed := newSessionAgent(t, dir)
+	if err := resumed.resumeSession(resumeLast, false); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	if resumed.sessionName != original.sessionName {
+		t.Errorf("resumed session is named %q, want %q", resumed.sessionName, original.sessionName)
+	}
+	if !reflect.DeepEqual(resumed.conversationHistory, original.conversationHistory) {
+		t.Errorf("resumed history differs: %+v", resumed.conversationHistory)
+	}
+
+	// A fork saves the following turns to a new session and leaves the
+	// loaded one as it was.
+	forked := newSessionAgent(t, dir)
+	if err := forked.resumeSession(original.sessionName, true); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if forked.sessionName == original.sessionName {
+		t.Fatalf("fork kept the session name %q", forked.sessionName)
+	}
+	forked.conversationHistory = append(forked.conversationHistory, userMessage("more"))
+	forked.persist()
+	saved, err := forked.sessions.load(original.sessionName)
+	if err != nil {
+		t.Fatalf("load original: %v", err)
+	}
+	if !reflect.DeepEqual(saved, original.conversationHistory) {
+		t.Errorf("fork changed the original session: %+v", saved)
+	}
+	saved, err = forked.sessions.load(forked.sessionName)
+	if err != nil {
+		t.Fatalf("load fork: %v", err)
+	}
+	if len(saved) != len(original.conversationHistory)+1 {
+		t.Errorf("fork saved %d messages, want %d", len(saved), len(original.conversationHistory)+1)
+	}
+}
+
+func TestNewSessionNameReportsUnusableDirectory(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "sessions")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	store := sessionStore{dir: file}
+	if name, err := store.newName(); err == nil {
+		t.Errorf("newName() = %q in a regular file, want an error", name)
+	}
+
+	t.Setenv("AGENT_SESSION_DIR", file)
+	t.Setenv("MCP_AUDIT_LOG", "off")
+	if _, err := NewAgent(newGeminiProvider(), newServerPool()); err == nil {
+		t.Error("NewAgent succeeded with sessions stored in a regular file")
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"gemini-mcp-bash/internal/sysprompt"
+
+	"github.com/liuzl/ai/gemini"
+)
+
+// systemInstruction renders the system prompt template for a request. A
+// template that fails to render is sent as is rather than failing the turn.
+func (a *Agent) systemInstruction() *gemini.Content {
+	text, err := a.renderSystemPrompt(a.systemTemplate)
+	if err != nil {
+		fmt.Printf("%sWarning: %v%s\n", ColorYellow, err, ColorReset)
+		text = a.systemTemplate
+	}
+	if strings.TrimSpace(text) == "" {
+		return nil
+	}
+	return &gemini.Content{Parts: []gemini.Part{{Text: gemini.StringPtr(text)}}}
+}
+
+func (a *Agent) renderSystemPrompt(template string) (string, error) {
+	available := a.availableTools()
+	tools := make([]sysprompt.Tool, 0, len(available))
+	for _, tool := range available {
+		tools = append(tools, sysprompt.Tool{Name: tool.Name, Description: tool.Description})
+	}
+	return sysprompt.Render(template, tools)
+}
+
+// setSystemTemplate replaces the system prompt template after checking that
+// it renders.
+func (a *Agent) setSystemTemplate(template string) error {
+	if _, err := a.renderSystemPrompt(template); err != nil {
+		return err
+	}
+	a.systemTemplate = template
+	fmt.Printf("%sSystem prompt updated; it applies from the next message.%s\n", ColorGreen, ColorReset)
+	return nil
+}
+
+// editSystemTemplate opens the template in $EDITOR.
+func (a *Agent) editSystemTemplate() error {
+	file, err := os.CreateTemp("", "system-prompt-*.tmpl")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.WriteString(a.systemTemplate); err != nil {
+		file.Close()
+		return err
+	}
+	file.Close()
+
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	cmd := exec.Command("sh", "-c", editor+` "$1"`, "sh", file.Name())
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("editor failed: %v", err)
+	}
+	data, err := os.ReadFile(file.Name())
+	if err != nil {
+		return err
+	}
+	if string(data) == a.systemTemplate {
+		fmt.Printf("%sSystem prompt unchanged.%s\n", ColorGray, ColorReset)
+		return nil
+	}
+	return a.setSystemTemplate(string(data))
+}
+
+// runSystemCommand handles the /system REPL command: show the rendered
+// prompt, replace its template, edit it in $EDITOR, reload it from a file or
+// reset it to the default. It reports whether input was that command.
+func (a *Agent) runSystemCommand(input string) bool {
+	command, arg, _ := strings.Cut(input, " ")
+	if strings.ToLower(command) != "/system" {
+		return false
+	}
+	arg = strings.TrimSpace(arg)
+	sub, rest, _ := strings.Cut(arg, " ")
+
+	var err error
+	switch strings.ToLower(sub) {
+	case "":
+		text, renderErr := a.renderSystemPrompt(a.systemTemplate)
+		if renderErr != nil {
+			text = a.systemTemplate
+		}
+		fmt.Printf("%s--- System Prompt ---%s\n%s\n%s---------------------%s\n", ColorBold, ColorReset, text, ColorBold, ColorReset)
+		fmt.Printf("%sUse '/system edit', '/system file <path>', '/system reset' or '/system <template>' to change it.%s\n", ColorGray, ColorReset)
+		return true
+	case "edit":
+		err = a.editSystemTemplate()
+	case "reset":
+		err = a.setSystemTemplate(sysprompt.Default)
+	case "file":
+		path := strings.TrimSpace(rest)
+		if path == "" {
+			fmt.Printf("%sUsage: /system file <path>%s\n", ColorYellow, ColorReset)
+			return true
+		}
+		var template string
+		if template, err = sysprompt.Load(path); err == nil {
+			err = a.setSystemTemplate(template)
+		}
+	default:
+		err = a.setSystemTemplate(arg)
+	}
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", ColorRed, err, ColorReset)
+	}
+	return true
+}
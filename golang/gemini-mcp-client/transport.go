@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/modelcontextprotocol/go-sdk/jsonrpc"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// MCP methods and notifications the SDK's client (v0.2.0) has no working API
+// for: ClientSession has no Subscribe or Unsubscribe, its Complete panics with
+// "reflect: Elem of invalid type mcp.Result", and it rejects resource update
+// notifications as an unknown method.
+const (
+	methodInitialize            = "initialize"
+	methodComplete              = "completion/complete"
+	methodSubscribe             = "resources/subscribe"
+	methodUnsubscribe           = "resources/unsubscribe"
+	notificationResourceUpdated = "notifications/resources/updated"
+)
+
+// Keys in a ping's _meta that make observedConn rewrite it into another request.
+const (
+	tunnelMethodKey = "gemini-mcp-client/method"
+	tunnelParamsKey = "gemini-mcp-client/params"
+	tunnelReplyKey  = "gemini-mcp-client/reply"
+)
+
+// serverCapabilities is the part of a server's initialize result the agent
+// cares about. A nil field means the server did not declare the capability.
+type serverCapabilities struct {
+	Completions *struct{} `json:"completions,omitempty"`
+	Logging     *struct{} `json:"logging,omitempty"`
+	Prompts     *struct {
+		ListChanged bool `json:"listChanged,omitempty"`
+	} `json:"prompts,omitempty"`
+	Resources *struct {
+		ListChanged bool `json:"listChanged,omitempty"`
+		Subscribe   bool `json:"subscribe,omitempty"`
+	} `json:"resources,omitempty"`
+	Tools *struct {
+		ListChanged bool `json:"listChanged,omitempty"`
+	} `json:"tools,omitempty"`
+}
+
+// serverInfo is what observedTransport learns about one server from the
+// messages it sees, and where it delivers notifications the SDK drops.
+type serverInfo struct {
+	name   string
+	notify func(server, method string, params json.RawMessage)
+
+	mu              sync.Mutex
+	initID          jsonrpc.ID
+	protocolVersion string
+	capabilities    serverCapabilities
+	// Tunnelled requests waiting for their results, by reply key, and by
+	// request ID once they are written. sendRequest removes both entries.
+	nextReply int64
+	replies   map[int64]*tunnelReply
+	inflight  map[jsonrpc.ID]*tunnelReply
+}
+
+// tunnelReply is where the result of a tunnelled request is delivered.
+type tunnelReply struct {
+	result chan json.RawMessage
+	id     jsonrpc.ID
+}
+
+// Capabilities returns the capabilities the server declared when initializing.
+func (s *serverInfo) Capabilities() serverCapabilities {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.capabilities
+}
+
+func (s *serverInfo) version() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.protocolVersion
+}
+
+// observedTransport wraps a transport so the agent can use parts of the MCP
+// protocol the SDK does not expose yet.
+type observedTransport struct {
+	mcp.Transport
+	info *serverInfo
+}
+
+func (t *observedTransport) Connect(ctx context.Context) (mcp.Connection, error) {
+	conn, err := t.Transport.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &observedConn{Connection: conn, info: t.info}, nil
+}
+
+type observedConn struct {
+	mcp.Connection
+	info *serverInfo
+}
+
+// Read records the initialize result and hands notifications the SDK would
+// reject to the server's notify callback.
+func (c *observedConn) Read(ctx context.Context) (jsonrpc.Message, error) {
+	for {
+		msg, err := c.Connection.Read(ctx)
+		if err != nil {
+			return nil, err
+		}
+		switch m := msg.(type) {
+		case *jsonrpc.Response:
+			c.recordInitializeResult(m)
+			c.deliverReply(m)
+		case *jsonrpc.Request:
+			if !m.IsCall() && m.Method == notificationResourceUpdated {
+				if c.info.notify != nil {
+					go c.info.notify(c.info.name, m.Method, m.Params)
+				}
+				continue
+			}
+		}
+		return msg, nil
+	}
+}
+
+// Write notes the initialize request and rewrites tunnelled pings.
+func (c *observedConn) Write(ctx context.Context, msg jsonrpc.Message) error {
+	if req, ok := msg.(*jsonrpc.Request); ok && req.IsCall() {
+		switch req.Method {
+		case methodInitialize:
+			c.info.mu.Lock()
+			c.info.initID = req.ID
+			c.info.mu.Unlock()
+		case "ping":
+			if tunnelled, reply := untunnel(req); tunnelled != nil {
+				c.info.mu.Lock()
+				if r, ok := c.info.replies[reply]; ok {
+					r.id = req.ID
+					c.info.inflight[req.ID] = r
+				}
+				c.info.mu.Unlock()
+				msg = tunnelled
+			}
+		}
+	}
+	return c.Connection.Write(ctx, msg)
+}
+
+func (c *observedConn) recordInitializeResult(resp *jsonrpc.Response) {
+	c.info.mu.Lock()
+	defer c.info.mu.Unlock()
+	if !resp.ID.IsValid() || resp.ID != c.info.initID || resp.Error != nil {
+		return
+	}
+	var result struct {
+		ProtocolVersion string             `json:"protocolVersion"`
+		Capabilities    serverCapabilities `json:"capabilities"`
+	}
+	if err := json.Unmarshal(resp.Result, &result); err == nil {
+		c.info.protocolVersion = result.ProtocolVersion
+		c.info.capabilities = result.Capabilities
+	}
+}
+
+// deliverReply hands the result of a tunnelled request to its sender.
+func (c *observedConn) deliverReply(resp *jsonrpc.Response) {
+	c.info.mu.Lock()
+	defer c.info.mu.Unlock()
+	if r, ok := c.info.inflight[resp.ID]; ok {
+		delete(c.info.inflight, resp.ID)
+		r.result <- resp.Result
+	}
+}
+
+// sendRequest sends an MCP request the SDK has no working method for, and
+// decodes its result into result unless that is nil. The request is tunnelled
+// through a ping that observedConn rewrites on the way out; the SDK discards
+// the result as a ping's, so observedConn passes it back separately.
+func (s *serverInfo) sendRequest(ctx context.Context, session *mcp.ClientSession, method string, params, result any) error {
+	reply := &tunnelReply{result: make(chan json.RawMessage, 1)}
+	s.mu.Lock()
+	if s.replies == nil {
+		s.replies = make(map[int64]*tunnelReply)
+		s.inflight = make(map[jsonrpc.ID]*tunnelReply)
+	}
+	s.nextReply++
+	key := s.nextReply
+	s.replies[key] = reply
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.replies, key)
+		if reply.id.IsValid() {
+			delete(s.inflight, reply.id)
+		}
+		s.mu.Unlock()
+	}()
+
+	err := session.Ping(ctx, &mcp.PingParams{Meta: mcp.Meta{
+		tunnelMethodKey: method,
+		tunnelParamsKey: params,
+		tunnelReplyKey:  key,
+	}})
+	if err != nil || result == nil {
+		return err
+	}
+	select {
+	case raw := <-reply.result:
+		return json.Unmarshal(raw, result)
+	case <-ctx.Done():
+		return fmt.Errorf("no result received for %s: %w", method, ctx.Err())
+	}
+}
+
+func untunnel(req *jsonrpc.Request) (*jsonrpc.Request, int64) {
+	var params struct {
+		Meta map[string]json.RawMessage `json:"_meta"`
+	}
+	if err := json.Unmarshal(req.Params, &params); err != nil {
+		return nil, 0
+	}
+	var method string
+	if err := json.Unmarshal(params.Meta[tunnelMethodKey], &method); err != nil || method == "" {
+		return nil, 0
+	}
+	var reply int64
+	json.Unmarshal(params.Meta[tunnelReplyKey], &reply)
+	return &jsonrpc.Request{ID: req.ID, Method: method, Params: params.Meta[tunnelParamsKey]}, reply
+}
+
+// mcpBaseTransport is http.DefaultTransport as it was before the Gemini
+// provider made it retry model requests; MCP requests are not retried.
+var mcpBaseTransport = http.DefaultTransport
+
+// protocolVersionTransport adds the Mcp-Protocol-Version header that the
+// streamable HTTP transport can no longer set once its connection is wrapped.
+type protocolVersionTransport struct {
+	base http.RoundTripper
+	info *serverInfo
+}
+
+func (t *protocolVersionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if version := t.info.version(); version != "" && req.Header.Get("Mcp-Protocol-Version") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Mcp-Protocol-Version", version)
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/jsonrpc"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// answeringTransport wraps a server's transport to answer the "test/..."
+// requests the SDK's server does not know: test/echo returns its params,
+// test/fail an error, and test/slow its params after slowReply.
+type answeringTransport struct {
+	mcp.Transport
+}
+
+func (t *answeringTransport) Connect(ctx context.Context) (mcp.Connection, error) {
+	conn, err := t.Transport.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &answeringConn{Connection: conn}, nil
+}
+
+const slowReply = 200 * time.Millisecond
+
+type answeringConn struct {
+	mcp.Connection
+}
+
+func (c *answeringConn) Read(ctx context.Context) (jsonrpc.Message, error) {
+	for {
+		msg, err := c.Connection.Read(ctx)
+		if err != nil {
+			return nil, err
+		}
+		req, ok := msg.(*jsonrpc.Request)
+		if !ok || !strings.HasPrefix(req.Method, "test/") {
+			return msg, nil
+		}
+		switch req.Method {
+		case "test/echo":
+			err = c.Connection.Write(ctx, &jsonrpc.Response{ID: req.ID, Result: req.Params})
+		case "test/fail":
+			err = c.Connection.Write(ctx, &jsonrpc.Response{ID: req.ID, Error: errors.New("no such thing")})
+		case "test/slow":
+			time.AfterFunc(slowReply, func() {
+				c.Connection.Write(context.Background(), &jsonrpc.Response{ID: req.ID, Result: req.Params})
+			})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func TestSendRequestTunnelsThroughPing(t *testing.T) {
+	ctx := context.Background()
+	server := mcp.NewServer(&mcp.Implementation{Name: "test", Version: "v1.0.0"}, nil)
+	serverTransport, clientTransport := mcp.NewInMemoryTransports()
+	if _, err := server.Connect(ctx, &answeringTransport{Transport: serverTransport}); err != nil {
+		t.Fatalf("server.Connect: %v", err)
+	}
+	info := &serverInfo{name: "test"}
+	session, err := mcp.NewClient(clientImplementation, nil).Connect(ctx, &observedTransport{Transport: clientTransport, info: info})
+	if err != nil {
+		t.Fatalf("client.Connect: %v", err)
+	}
+	defer session.Close()
+
+	var result struct {
+		Word string `json:"word"`
+	}
+	if err := info.sendRequest(ctx, session, "test/echo", map[string]string{"word": "hello"}, &result); err != nil {
+		t.Fatalf("test/echo: %v", err)
+	}
+	if result.Word != "hello" {
+		t.Errorf("test/echo returned %q, want hello", result.Word)
+	}
+
+	err = info.sendRequest(ctx, session, "test/fail", nil, &result)
+	if err == nil || !strings.Contains(err.Error(), "no such thing") {
+		t.Errorf("test/fail returned %v, want the server's error", err)
+	}
+
+	// A cancelled request leaves nothing waiting for its result, and its late
+	// reply is dropped.
+	slowCtx, cancel := context.WithTimeout(ctx, slowReply/4)
+	defer cancel()
+	if err := info.sendRequest(slowCtx, session, "test/slow", nil, &result); err == nil {
+		t.Error("test/slow returned no error after the context ended")
+	}
+	checkNothingWaiting(t, info)
+	time.Sleep(slowReply)
+	if err := session.Ping(ctx, nil); err != nil {
+		t.Errorf("ping: %v", err)
+	}
+	checkNothingWaiting(t, info)
+}
+
+func checkNothingWaiting(t *testing.T, info *serverInfo) {
+	t.Helper()
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	if len(info.replies) != 0 || len(info.inflight) != 0 {
+		t.Errorf("%d reply key(s) and %d request(s) left waiting", len(info.replies), len(info.inflight))
+	}
+}
+
+func TestUntunnel(t *testing.T) {
+	params, _ := json.Marshal(mcp.PingParams{Meta: mcp.Meta{
+		tunnelMethodKey: methodSubscribe,
+		tunnelParamsKey: map[string]string{"uri": "file:///a"},
+		tunnelReplyKey:  7,
+	}})
+	req := &jsonrpc.Request{ID: jsonrpc.ID{}, Method: "ping", Params: params}
+	tunnelled, reply := untunnel(req)
+	if tunnelled == nil {
+		t.Fatal("untunnel did not rewrite a tunnelled ping")
+	}
+	if tunnelled.ID != req.ID || tunnelled.Method != methodSubscribe || string(tunnelled.Params) != `{"uri":"file:///a"}` || reply != 7 {
+		t.Errorf("untunnel = %+v (params %s), %d", tunnelled, tunnelled.Params, reply)
+	}
+	if tunnelled, _ := untunnel(&jsonrpc.Request{ID: jsonrpc.ID{}, Method: "ping", Params: json.RawMessage(`{}`)}); tunnelled != nil {
+		t.Errorf("untunnel rewrote a plain ping into %+v", tunnelled)
+	}
+}
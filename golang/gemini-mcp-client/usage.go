@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/liuzl/ai/gemini"
+)
+
+// modelPrice is what a model costs in US dollars per million tokens. Cached
+// input is charged at the input price when it has no price of its own, and
+// thinking tokens at the output price.
+type modelPrice struct {
+	Input       float64 `json:"input"`
+	CachedInput float64 `json:"cached_input,omitempty"`
+	Output      float64 `json:"output"`
+}
+
+// defaultPrices are list prices of common models, for estimates only. The
+// file named by MODEL_PRICES (default model_prices.json) overrides and extends
+// them.
+var defaultPrices = map[string]modelPrice{
+	"gemini-2.5-pro":        {Input: 1.25, CachedInput: 0.31, Output: 10},
+	"gemini-2.5-flash":      {Input: 0.30, CachedInput: 0.075, Output: 2.50},
+	"gemini-2.5-flash-lite": {Input: 0.10, CachedInput: 0.025, Output: 0.40},
+	"gemini-2.0-flash":      {Input: 0.10, CachedInput: 0.025, Output: 0.40},
+	"gpt-4o":                {Input: 2.50, CachedInput: 1.25, Output: 10},
+	"gpt-4o-mini":           {Input: 0.15, CachedInput: 0.075, Output: 0.60},
+	"gpt-4.1":               {Input: 2, CachedInput: 0.50, Output: 8},
+	"gpt-4.1-mini":          {Input: 0.40, CachedInput: 0.10, Output: 1.60},
+	"claude-sonnet-4":       {Input: 3, CachedInput: 0.30, Output: 15},
+	"claude-opus-4":         {Input: 15, CachedInput: 1.50, Output: 75},
+	"claude-3-5-haiku":      {Input: 0.80, CachedInput: 0.08, Output: 4},
+}
+
+// loadPrices returns the default prices merged with the price file, a JSON
+// object mapping model names to prices.
+func loadPrices() (map[string]modelPrice, error) {
+	prices := make(map[string]modelPrice, len(defaultPrices))
+	for model, price := range defaultPrices {
+		prices[model] = price
+	}
+	pricesPath := os.Getenv("MODEL_PRICES")
+	if pricesPath == "" {
+		pricesPath = "model_prices.json"
+	}
+	data, err := os.ReadFile(pricesPath)
+	switch {
+	case errors.Is(err, os.ErrNotExist) && os.Getenv("MODEL_PRICES") == "":
+	case err != nil:
+		return nil, fmt.Errorf("failed to read model prices: %v", err)
+	default:
+		var custom map[string]modelPrice
+		if err := json.Unmarshal(data, &custom); err != nil {
+			return nil, fmt.Errorf("failed to parse model prices %s: %v", pricesPath, err)
+		}
+		for model, price := range custom {
+			prices[model] = price
+		}
+	}
+	return prices, nil
+}
+
+// priceOf finds the price of model, falling back to the longest model name
+// it starts with so that dated versions such as gpt-4o-2024-08-06 are priced
+// like their family.
+func priceOf(prices map[string]modelPrice, model string) (modelPrice, bool) {
+	model = strings.TrimPrefix(model, "models/")
+	if price, ok := prices[model]; ok {
+		return price, true
+	}
+	best := ""
+	for name := range prices {
+		if strings.HasPrefix(model, name) && len(name) > len(best) {
+			best = name
+		}
+	}
+	price, ok := prices[best]
+	return price, ok && best != ""
+}
+
+// tokenCounts adds up the usage reported with model responses.
+type tokenCounts struct {
+	Requests int
+	// Prompt includes the Cached tokens; Candidates does not include the
+	// Thoughts.
+	Prompt     int
+	Cached     int
+	Candidates int
+	Thoughts   int
+	Total      int
+}
+
+func (c *tokenCounts) add(usage *gemini.UsageMetadata) {
+	c.Requests++
+	c.Prompt += usage.PromptTokenCount
+	c.Cached += usage.CachedContentTokenCount
+	c.Candidates += usage.CandidatesTokenCount
+	c.Thoughts += usage.ThoughtsTokenCount
+	total := usage.TotalTokenCount
+	if total == 0 {
+		total = usage.PromptTokenCount + usage.CandidatesTokenCount + usage.ThoughtsTokenCount
+	}
+	c.Total += total
+}
+
+// cost estimates what the tokens cost at price.
+func (c tokenCounts) cost(price modelPrice) float64 {
+	cached := price.CachedInput
+	if cached == 0 {
+		cached = price.Input
+	}
+	return (float64(c.Prompt-c.Cached)*price.Input + float64(c.Cached)*cached +
+		float64(c.Candidates+c.Thoughts)*price.Output) / 1e6
+}
+
+// usageTracker accounts the tokens of the current session, turn by turn, and
+// enforces the session's budget.
+type usageTracker struct {
+	model string
+	price modelPrice
+	// priced is false when the model has no price, so costs are unknown.
+	priced bool
+	// tokenBudget and costBudget limit the session; zero means no limit.
+	tokenBudget int
+	costBudget  float64
+
+	turns []tokenCounts
+	total tokenCounts
+}
+
+func newUsageTracker(model string, prices map[string]modelPrice) *usageTracker {
+	price, priced := priceOf(prices, model)
+	return &usageTracker{model: model, price: price, priced: priced}
+}
+
+// startTurn starts counting a new turn.
+func (u *usageTracker) startTurn() {
+	u.turns = append(u.turns, tokenCounts{})
+}
+
+// record counts the usage of one model response.
+func (u *usageTracker) record(usage *gemini.UsageMetadata) {
+	if usage == nil {
+		return
+	}
+	if len(u.turns) == 0 {
+		u.startTurn()
+	}
+	u.turns[len(u.turns)-1].add(usage)
+	u.total.add(usage)
+}
+
+// reset forgets the usage, for a new session.
+func (u *usageTracker) reset() {
+	u.turns = nil
+	u.total = tokenCounts{}
+}
+
+// exhausted describes how the session went over its budget, or returns ""
+// while it is within it.
+func (u *usageTracker) exhausted() string {
+	if u.tokenBudget > 0 && u.total.Total >= u.tokenBudget {
+		return fmt.Sprintf("the session used %d tokens of its %d token budget", u.total.Total, u.tokenBudget)
+	}
+	if u.costBudget > 0 && u.priced {
+		if cost := u.total.cost(u.price); cost >= u.costBudget {
+			return fmt.Sprintf("the session cost an estimated $%.4f of its $%.2f budget", cost, u.costBudget)
+		}
+	}
+	return ""
+}
+
+func (u *usageTracker) formatCost(counts tokenCounts) string {
+	if !u.priced {
+		return "unknown"
+	}
+	return fmt.Sprintf("$%.4f", counts.cost(u.price))
+}
+
+// print shows the usage of the session and of its last turn.
+func (u *usageTracker) print() {
+	fmt.Printf("%sRequests: %d in %d turn(s)%s\n", ColorCyan, u.total.Requests, len(u.turns), ColorReset)
+	fmt.Printf("%sTokens: %d prompt (%d cached), %d output, %d thinking, %d total%s\n", ColorCyan,
+		u.total.Prompt, u.total.Cached, u.total.Candidates, u.total.Thoughts, u.total.Total, ColorReset)
+	if len(u.turns) > 0 {
+		last := u.turns[len(u.turns)-1]
+		fmt.Printf("%sLast turn: %d request(s), %d prompt, %d output, %d thinking tokens, cost %s%s\n", ColorGray,
+			last.Requests, last.Prompt, last.Candidates, last.Thoughts, u.formatCost(last), ColorReset)
+	}
+	if u.priced {
+		fmt.Printf("%sEstimated cost: %s (%s at $%g/$%g per million input/output tokens)%s\n", ColorYellow,
+			u.formatCost(u.total), u.model, u.price.Input, u.price.Output, ColorReset)
+	} else {
+		fmt.Printf("%sEstimated cost: unknown, no price for model %q (add it to MODEL_PRICES)%s\n", ColorYellow, u.model, ColorReset)
+	}
+	if u.tokenBudget > 0 {
+		fmt.Printf("%sToken budget: %d of %d used%s\n", ColorYellow, u.total.Total, u.tokenBudget, ColorReset)
+	}
+	if u.costBudget > 0 {
+		fmt.Printf("%sCost budget: %s of $%.2f used%s\n", ColorYellow, u.formatCost(u.total), u.costBudget, ColorReset)
+	}
+}
@@ -0,0 +1,293 @@
+// Package httpretry retries model API requests that fail in a way worth
+// retrying: rate limits, overloaded or unavailable servers and transient
+// network errors. Retries back off exponentially with jitter, or wait as long
+// as the server asks with Retry-After.
+//
+// Transport is an http.RoundTripper, so it works with any http.Client. The
+// retry settings are read from the environment:
+//
+//	LLM_MAX_RETRIES       retries after the first attempt (default 3, 0 disables retries)
+//	LLM_RETRY_BASE_DELAY  delay before the first retry, doubled for each one after (default 1s)
+//	LLM_RETRY_MAX_DELAY   longest delay between attempts (default 30s)
+package httpretry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// AttemptsHeader is set on a response that was given up on after retries to
+// the number of attempts made.
+const AttemptsHeader = "X-Retry-Attempts"
+
+// Transport retries requests through Base.
+type Transport struct {
+	// Base sends the requests; nil means http.DefaultTransport.
+	Base       http.RoundTripper
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+	// Logf, if set, is told about every retry.
+	Logf func(format string, args ...any)
+}
+
+// New returns a Transport over base configured from the environment.
+func New(base http.RoundTripper) *Transport {
+	return &Transport{
+		Base:       base,
+		MaxRetries: envInt("LLM_MAX_RETRIES", 3),
+		BaseDelay:  envDuration("LLM_RETRY_BASE_DELAY", time.Second),
+		MaxDelay:   envDuration("LLM_RETRY_MAX_DELAY", 30*time.Second),
+	}
+}
+
+// WrapDefault makes http.DefaultTransport retry, for clients of SDKs that do
+// not take an http.Client. This changes every request of the process that
+// goes through the default transport, so prefer setting a Transport from New
+// on the clients that should retry. It returns the installed Transport, which
+// is only installed once however often WrapDefault is called.
+func WrapDefault() *Transport {
+	if t, ok := http.DefaultTransport.(*Transport); ok {
+		return t
+	}
+	t := New(http.DefaultTransport)
+	http.DefaultTransport = t
+	return t
+}
+
+// RetryableStatus reports whether a response with status is worth retrying.
+func RetryableStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests,
+		http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout,
+		529: // Anthropic's "overloaded"
+		return true
+	}
+	return false
+}
+
+// retryableError reports whether a request that failed with err may succeed
+// when sent again.
+func retryableError(err error) bool {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// RetryAfter returns how long a response asks the client to wait, from the
+// Retry-After header (seconds or an HTTP date) or OpenAI's retry-after-ms.
+func RetryAfter(header http.Header) (time.Duration, bool) {
+	if ms, err := strconv.ParseFloat(header.Get("Retry-After-Ms"), 64); err == nil && ms >= 0 {
+		return time.Duration(ms * float64(time.Millisecond)), true
+	}
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		return max(time.Until(when), 0), true
+	}
+	return 0, false
+}
+
+// backoff returns the delay before retry number n (counting from 1): the base
+// delay doubled n-1 times, capped at the maximum, of which the second half is
+// random so that clients that failed together do not retry together.
+func (t *Transport) backoff(n int) time.Duration {
+	delay := t.BaseDelay
+	for i := 1; i < n && delay < t.MaxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, t.MaxDelay)
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	// A body can only be sent again if it can be recreated.
+	maxRetries := t.MaxRetries
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		maxRetries = 0
+	}
+
+	for attempt := 1; ; attempt++ {
+		try := req
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			try = req.Clone(req.Context())
+			try.Body = body
+		}
+		resp, err := base.RoundTrip(try)
+
+		var reason string
+		var delay time.Duration
+		switch {
+		case err != nil:
+			if !retryableError(err) || req.Context().Err() != nil {
+				return nil, err
+			}
+			reason = err.Error()
+			delay = t.backoff(attempt)
+		case RetryableStatus(resp.StatusCode):
+			reason = fmt.Sprintf("HTTP %d", resp.StatusCode)
+			if after, ok := RetryAfter(resp.Header); ok {
+				if after > t.MaxDelay {
+					// Waiting that long is the caller's call.
+					return giveUp(resp, attempt), nil
+				}
+				delay = after
+			} else {
+				delay = t.backoff(attempt)
+			}
+		default:
+			return resp, nil
+		}
+
+		if attempt > maxRetries {
+			if err != nil {
+				return nil, fmt.Errorf("%v (gave up after %d attempts)", err, attempt)
+			}
+			return giveUp(resp, attempt), nil
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		if t.Logf != nil {
+			// The query is left out since it may carry an API key.
+			t.Logf("%s %s%s failed with %s, retrying in %v (attempt %d of %d)",
+				req.Method, req.URL.Host, req.URL.Path, reason, delay.Round(time.Millisecond), attempt+1, maxRetries+1)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// giveUp marks a failed response with the number of attempts made.
+func giveUp(resp *http.Response, attempts int) *http.Response {
+	if attempts > 1 {
+		resp.Header.Set(AttemptsHeader, strconv.Itoa(attempts))
+	}
+	return resp
+}
+
+// StatusError is an API request that failed with an HTTP error status.
+type StatusError struct {
+	StatusCode int
+	// Message is the error message of the API, or the response body.
+	Message string
+	// Attempts is how many times the request was sent.
+	Attempts int
+	// RetryAfter is how long the server asked the client to wait, if it did.
+	RetryAfter time.Duration
+}
+
+// NewStatusError describes a failed response whose body has been read.
+func NewStatusError(resp *http.Response, body []byte) *StatusError {
+	e := &StatusError{StatusCode: resp.StatusCode, Message: errorMessage(body), Attempts: 1}
+	if n, err := strconv.Atoi(resp.Header.Get(AttemptsHeader)); err == nil {
+		e.Attempts = n
+	}
+	e.RetryAfter, _ = RetryAfter(resp.Header)
+	return e
+}
+
+func (e *StatusError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "HTTP %d", e.StatusCode)
+	if text := http.StatusText(e.StatusCode); text != "" {
+		fmt.Fprintf(&b, " %s", text)
+	}
+	if e.Message != "" {
+		fmt.Fprintf(&b, ": %s", e.Message)
+	}
+	var notes []string
+	if e.StatusCode == http.StatusTooManyRequests {
+		notes = append(notes, "rate limited")
+	}
+	if e.Attempts > 1 {
+		notes = append(notes, fmt.Sprintf("gave up after %d attempts", e.Attempts))
+	}
+	if e.RetryAfter > 0 {
+		notes = append(notes, fmt.Sprintf("the server asked to retry after %v", e.RetryAfter.Round(time.Second)))
+	}
+	if len(notes) > 0 {
+		fmt.Fprintf(&b, " (%s)", strings.Join(notes, "; "))
+	}
+	return b.String()
+}
+
+// errorMessage extracts the message from the error bodies of the Gemini,
+// OpenAI and Anthropic APIs, falling back to the body itself.
+func errorMessage(body []byte) string {
+	var shaped struct {
+		Error   json.RawMessage `json:"error"`
+		Message string          `json:"message"`
+	}
+	if json.Unmarshal(body, &shaped) == nil {
+		var nested struct {
+			Message string `json:"message"`
+		}
+		var flat string
+		switch {
+		case json.Unmarshal(shaped.Error, &nested) == nil && nested.Message != "":
+			return nested.Message
+		case json.Unmarshal(shaped.Error, &flat) == nil && flat != "":
+			return flat
+		case shaped.Message != "":
+			return shaped.Message
+		}
+	}
+	message := strings.TrimSpace(string(body))
+	if len(message) > 500 {
+		message = message[:500] + "..."
+	}
+	return message
+}
+
+func envInt(name string, def int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value < 0 {
+		return def
+	}
+	return value
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil || value < 0 {
+		return def
+	}
+	return value
+}
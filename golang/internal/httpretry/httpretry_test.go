@@ -0,0 +1,251 @@
+package httpretry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   http.Header
+		want     time.Duration
+		slack    time.Duration
+		notFound bool
+	}{
+		{name: "seconds", header: http.Header{"Retry-After": {"5"}}, want: 5 * time.Second},
+		{name: "zero seconds", header: http.Header{"Retry-After": {"0"}}, want: 0},
+		{name: "HTTP date", header: http.Header{"Retry-After": {time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat)}}, want: 10 * time.Second, slack: 2 * time.Second},
+		{name: "HTTP date in the past", header: http.Header{"Retry-After": {"Mon, 02 Jan 2006 15:04:05 GMT"}}, want: 0},
+		{name: "milliseconds", header: http.Header{"Retry-After-Ms": {"1500"}}, want: 1500 * time.Millisecond},
+		{name: "milliseconds win", header: http.Header{"Retry-After-Ms": {"250.5"}, "Retry-After": {"5"}}, want: 250500 * time.Microsecond},
+		{name: "missing", header: http.Header{}, notFound: true},
+		{name: "negative", header: http.Header{"Retry-After": {"-1"}}, notFound: true},
+		{name: "garbage", header: http.Header{"Retry-After": {"soon"}, "Retry-After-Ms": {"later"}}, notFound: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := RetryAfter(test.header)
+			if ok == test.notFound {
+				t.Fatalf("RetryAfter(%v) found = %v, want %v", test.header, ok, !test.notFound)
+			}
+			if got > test.want || got < test.want-test.slack {
+				t.Errorf("RetryAfter(%v) = %v, want %v (less up to %v)", test.header, got, test.want, test.slack)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	transport := &Transport{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for _, test := range []struct {
+		n    int
+		full time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{50, time.Second},
+	} {
+		n, full := test.n, test.full
+		seen := make(map[time.Duration]bool)
+		for range 100 {
+			delay := transport.backoff(n)
+			if delay < full/2 || delay > full {
+				t.Fatalf("backoff(%d) = %v, want between %v and %v", n, delay, full/2, full)
+			}
+			seen[delay] = true
+		}
+		// The second half of the delay is random.
+		if len(seen) < 10 {
+			t.Errorf("backoff(%d) returned only %d different delays in 100 tries", n, len(seen))
+		}
+	}
+	if delay := (&Transport{MaxDelay: time.Second}).backoff(1); delay != 0 {
+		t.Errorf("backoff without a base delay = %v, want 0", delay)
+	}
+}
+
+// failingServer answers with the given statuses in turn, then with 200, and
+// records the bodies it was sent.
+type failingServer struct {
+	mu       sync.Mutex
+	statuses []int
+	header   http.Header
+	bodies   []string
+}
+
+func (s *failingServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bodies = append(s.bodies, string(body))
+	if len(s.statuses) == 0 {
+		io.WriteString(w, "ok")
+		return
+	}
+	for key, values := range s.header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(s.statuses[0])
+	s.statuses = s.statuses[1:]
+	io.WriteString(w, `{"error": {"message": "try again"}}`)
+}
+
+func (s *failingServer) attempts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.bodies)
+}
+
+// serve starts handler and returns a client that retries with short delays.
+func serve(t *testing.T, handler http.Handler, maxRetries int) (*http.Client, string) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	transport := &Transport{MaxRetries: maxRetries, BaseDelay: time.Millisecond, MaxDelay: 100 * time.Millisecond}
+	return &http.Client{Transport: transport}, server.URL
+}
+
+func TestRetriesReplayTheBody(t *testing.T) {
+	server := &failingServer{statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, 529}}
+	client, url := serve(t, server, 3)
+	resp, err := client.Post(url, "application/json", strings.NewReader(`{"prompt": "hi"}`))
+	if err != nil {
+		t.Fatalf("Post: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(AttemptsHeader) != "" {
+		t.Errorf("got HTTP %d with %s %q, want 200 without it", resp.StatusCode, AttemptsHeader, resp.Header.Get(AttemptsHeader))
+	}
+	if len(server.bodies) != 4 {
+		t.Fatalf("server saw %d attempts, want 4", len(server.bodies))
+	}
+	for i, body := range server.bodies {
+		if body != `{"prompt": "hi"}` {
+			t.Errorf("attempt %d sent body %q", i+1, body)
+		}
+	}
+}
+
+func TestRetriesGiveUp(t *testing.T) {
+	tests := []struct {
+		name     string
+		server   *failingServer
+		body     io.Reader
+		status   int
+		attempts int
+	}{
+		{
+			name:     "after the last retry",
+			server:   &failingServer{statuses: []int{503, 503, 503, 503}},
+			status:   503,
+			attempts: 3,
+		},
+		{
+			name:     "on errors that are not worth retrying",
+			server:   &failingServer{statuses: []int{400}},
+			status:   400,
+			attempts: 1,
+		},
+		{
+			name:     "when the server asks to wait longer than the maximum delay",
+			server:   &failingServer{statuses: []int{429, 429}, header: http.Header{"Retry-After": {"60"}}},
+			status:   429,
+			attempts: 1,
+		},
+		{
+			name:     "when the body cannot be sent again",
+			server:   &failingServer{statuses: []int{503}},
+			body:     io.MultiReader(strings.NewReader("once")),
+			status:   503,
+			attempts: 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, url := serve(t, test.server, 2)
+			req, err := http.NewRequest(http.MethodPost, url, test.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("Do: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != test.status {
+				t.Errorf("got HTTP %d, want %d", resp.StatusCode, test.status)
+			}
+			if n := test.server.attempts(); n != test.attempts {
+				t.Errorf("server saw %d attempts, want %d", n, test.attempts)
+			}
+			want := ""
+			if test.attempts > 1 {
+				want = strconv.Itoa(test.attempts)
+			}
+			if got := resp.Header.Get(AttemptsHeader); got != want {
+				t.Errorf("%s = %q, want %q", AttemptsHeader, got, want)
+			}
+			// The final response is handed over unread.
+			if !strings.Contains(string(body), "try again") {
+				t.Errorf("body = %q, want the server's error", body)
+			}
+		})
+	}
+}
+
+func TestRetryWaitEndsWithTheContext(t *testing.T) {
+	server := &failingServer{statuses: []int{503, 503}, header: http.Header{"Retry-After-Ms": {"90"}}}
+	client, url := serve(t, server, 2)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = client.Do(req)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Do error = %v, want the context's", err)
+	}
+	if elapsed := time.Since(start); elapsed > 80*time.Millisecond {
+		t.Errorf("Do returned after %v, want it to stop waiting with the context", elapsed)
+	}
+	if n := server.attempts(); n != 1 {
+		t.Errorf("server saw %d attempts, want 1", n)
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{
+		AttemptsHeader: {"4"},
+		"Retry-After":  {"20"},
+	}}
+	err := NewStatusError(resp, []byte(`{"error": {"message": "quota exceeded"}}`))
+	want := "HTTP 429 Too Many Requests: quota exceeded (rate limited; gave up after 4 attempts; the server asked to retry after 20s)"
+	if err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err.Error(), want)
+	}
+	for body, want := range map[string]string{
+		`{"error": "flat"}`:        "flat",
+		`{"message": "top level"}`: "top level",
+		"  plain text  ":           "plain text",
+		strings.Repeat("x", 600):   strings.Repeat("x", 500) + "...",
+	} {
+		if got := errorMessage([]byte(body)); got != want {
+			t.Errorf("errorMessage(%.20q) = %.20q, want %.20q", body, got, want)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package mockllm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+type anthropicBlock struct {
+	Type      string          `json:"type"`
+	Text      string          `json:"text"`
+	ID        string          `json:"id"`
+	Name      string          `json:"name"`
+	Input     map[string]any  `json:"input"`
+	ToolUseID string          `json:"tool_use_id"`
+	Content   json.RawMessage `json:"content"`
+}
+
+// anthropicBlocks decodes content that is a string or a list of blocks.
+func anthropicBlocks(content json.RawMessage) ([]anthropicBlock, error) {
+	if len(content) == 0 || string(content) == "null" {
+		return nil, nil
+	}
+	var text string
+	if err := json.Unmarshal(content, &text); err == nil {
+		return []anthropicBlock{{Type: "text", Text: text}}, nil
+	}
+	var blocks []anthropicBlock
+	if err := json.Unmarshal(content, &blocks); err != nil {
+		return nil, fmt.Errorf("invalid content: %v", err)
+	}
+	return blocks, nil
+}
+
+func blocksText(blocks []anthropicBlock) string {
+	var texts []string
+	for _, block := range blocks {
+		if block.Type == "text" {
+			texts = append(texts, block.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+func parseAnthropic(body io.Reader) (Request, error) {
+	var wire struct {
+		Model    string          `json:"model"`
+		Stream   bool            `json:"stream"`
+		System   json.RawMessage `json:"system"`
+		Messages []struct {
+			Role    string          `json:"role"`
+			Content json.RawMessage `json:"content"`
+		} `json:"messages"`
+		Tools []struct {
+			Name string `json:"name"`
+		} `json:"tools"`
+	}
+	if err := json.NewDecoder(body).Decode(&wire); err != nil {
+		return Request{}, err
+	}
+	request := Request{Model: wire.Model, Stream: wire.Stream}
+	system, err := anthropicBlocks(wire.System)
+	if err != nil {
+		return Request{}, fmt.Errorf("system: %v", err)
+	}
+	request.System = blocksText(system)
+	for _, tool := range wire.Tools {
+		request.Tools = append(request.Tools, tool.Name)
+	}
+	callNames := make(map[string]string)
+	for _, message := range wire.Messages {
+		blocks, err := anthropicBlocks(message.Content)
+		if err != nil {
+			return Request{}, err
+		}
+		converted := Message{Role: message.Role, Text: blocksText(blocks)}
+		if message.Role == "assistant" {
+			converted.Role = "model"
+		}
+		for _, block := range blocks {
+			switch block.Type {
+			case "tool_use":
+				callNames[block.ID] = block.Name
+				converted.FunctionCalls = append(converted.FunctionCalls, FunctionCall{Name: block.Name, Args: block.Input})
+			case "tool_result":
+				response := block.Content
+				var text string
+				if json.Unmarshal(block.Content, &text) == nil && json.Valid([]byte(text)) {
+					response = json.RawMessage(text)
+				}
+				converted.FunctionResponses = append(converted.FunctionResponses, FunctionResponse{Name: callNames[block.ToolUseID], Response: response})
+			}
+		}
+		request.Messages = append(request.Messages, converted)
+	}
+	return request, nil
+}
+
+func anthropicUsage(usage *Usage) map[string]any {
+	if usage == nil {
+		return map[string]any{"input_tokens": 0, "output_tokens": 0}
+	}
+	return map[string]any{"input_tokens": usage.PromptTokens, "output_tokens": usage.CompletionTokens}
+}
+
+func writeAnthropic(w http.ResponseWriter, response Response, stream bool) {
+	stopReason := "end_turn"
+	if len(response.FunctionCalls) > 0 {
+		stopReason = "tool_use"
+	}
+	input := func(call FunctionCall) map[string]any {
+		if call.Args == nil {
+			return map[string]any{}
+		}
+		return call.Args
+	}
+	if !stream {
+		var content []map[string]any
+		if text := response.text(); text != "" {
+			content = append(content, map[string]any{"type": "text", "text": text})
+		}
+		for i, call := range response.FunctionCalls {
+			content = append(content, map[string]any{"type": "tool_use", "id": fmt.Sprintf("toolu_%d", i+1), "name": call.Name, "input": input(call)})
+		}
+		writeJSON(w, map[string]any{
+			"type":        "message",
+			"role":        "assistant",
+			"content":     content,
+			"stop_reason": stopReason,
+			"usage":       anthropicUsage(response.Usage),
+		})
+		return
+	}
+
+	events := newEventStream(w)
+	send := func(event string, data map[string]any) {
+		data["type"] = event
+		events.send(event, data)
+	}
+	usage := anthropicUsage(response.Usage)
+	send("message_start", map[string]any{"message": map[string]any{
+		"type": "message", "role": "assistant", "content": []any{},
+		"usage": map[string]any{"input_tokens": usage["input_tokens"], "output_tokens": 0},
+	}})
+	index := 0
+	if chunks := response.textChunks(); len(chunks) > 0 {
+		send("content_block_start", map[string]any{"index": index, "content_block": map[string]any{"type": "text", "text": ""}})
+		for _, chunk := range chunks {
+			send("content_block_delta", map[string]any{"index": index, "delta": map[string]any{"type": "text_delta", "text": chunk}})
+		}
+		send("content_block_stop", map[string]any{"index": index})
+		index++
+	}
+	for i, call := range response.FunctionCalls {
+		send("content_block_start", map[string]any{"index": index, "content_block": map[string]any{
+			"type": "tool_use", "id": fmt.Sprintf("toolu_%d", i+1), "name": call.Name, "input": map[string]any{},
+		}})
+		args, _ := json.Marshal(input(call))
+		half := len(args) / 2
+		for _, piece := range []string{string(args[:half]), string(args[half:])} {
+			send("content_block_delta", map[string]any{"index": index, "delta": map[string]any{"type": "input_json_delta", "partial_json": piece}})
+		}
+		send("content_block_stop", map[string]any{"index": index})
+		index++
+	}
+	send("message_delta", map[string]any{"delta": map[string]any{"stop_reason": stopReason}, "usage": map[string]any{"output_tokens": usage["output_tokens"]}})
+	send("message_stop", map[string]any{})
+}
@@ -0,0 +1,117 @@
+package mockllm
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+type geminiPart struct {
+	Text         *string `json:"text,omitempty"`
+	FunctionCall *struct {
+		Name string         `json:"name"`
+		Args map[string]any `json:"args,omitempty"`
+	} `json:"functionCall,omitempty"`
+	FunctionResponse *struct {
+		Name     string          `json:"name"`
+		Response json.RawMessage `json:"response"`
+	} `json:"functionResponse,omitempty"`
+}
+
+type geminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []geminiPart `json:"parts"`
+}
+
+func parseGemini(body io.Reader) (Request, error) {
+	var wire struct {
+		Contents          []geminiContent `json:"contents"`
+		SystemInstruction *geminiContent  `json:"systemInstruction"`
+		Tools             []struct {
+			FunctionDeclarations []struct {
+				Name string `json:"name"`
+			} `json:"functionDeclarations"`
+		} `json:"tools"`
+	}
+	if err := json.NewDecoder(body).Decode(&wire); err != nil {
+		return Request{}, err
+	}
+	var request Request
+	if wire.SystemInstruction != nil {
+		request.System = geminiText(*wire.SystemInstruction)
+	}
+	for _, tool := range wire.Tools {
+		for _, decl := range tool.FunctionDeclarations {
+			request.Tools = append(request.Tools, decl.Name)
+		}
+	}
+	for _, content := range wire.Contents {
+		message := Message{Role: content.Role, Text: geminiText(content)}
+		if message.Role == "" {
+			message.Role = "user"
+		}
+		for _, part := range content.Parts {
+			if part.FunctionCall != nil {
+				message.FunctionCalls = append(message.FunctionCalls, FunctionCall{Name: part.FunctionCall.Name, Args: part.FunctionCall.Args})
+			}
+			if part.FunctionResponse != nil {
+				message.FunctionResponses = append(message.FunctionResponses, FunctionResponse{Name: part.FunctionResponse.Name, Response: part.FunctionResponse.Response})
+			}
+		}
+		request.Messages = append(request.Messages, message)
+	}
+	return request, nil
+}
+
+func geminiText(content geminiContent) string {
+	var texts []string
+	for _, part := range content.Parts {
+		if part.Text != nil {
+			texts = append(texts, *part.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+func geminiResponse(parts []map[string]any, finish bool, usage *Usage) map[string]any {
+	candidate := map[string]any{"content": map[string]any{"role": "model", "parts": parts}}
+	if finish {
+		candidate["finishReason"] = "STOP"
+	}
+	response := map[string]any{"candidates": []any{candidate}}
+	if usage != nil {
+		response["usageMetadata"] = map[string]any{
+			"promptTokenCount":     usage.PromptTokens,
+			"candidatesTokenCount": usage.CompletionTokens,
+			"totalTokenCount":      usage.PromptTokens + usage.CompletionTokens,
+		}
+	}
+	return response
+}
+
+func geminiFunctionCalls(calls []FunctionCall) []map[string]any {
+	var parts []map[string]any
+	for _, call := range calls {
+		parts = append(parts, map[string]any{"functionCall": map[string]any{"name": call.Name, "args": call.Args}})
+	}
+	return parts
+}
+
+func writeGemini(w http.ResponseWriter, response Response, stream bool) {
+	if !stream {
+		var parts []map[string]any
+		if text := response.text(); text != "" {
+			parts = append(parts, map[string]any{"text": text})
+		}
+		parts = append(parts, geminiFunctionCalls(response.FunctionCalls)...)
+		writeJSON(w, geminiResponse(parts, true, response.Usage))
+		return
+	}
+	events := newEventStream(w)
+	for _, chunk := range response.textChunks() {
+		events.send("", geminiResponse([]map[string]any{{"text": chunk}}, false, nil))
+	}
+	// Gemini sends function calls whole, and usage with the last chunk.
+	events.send("", geminiResponse(geminiFunctionCalls(response.FunctionCalls), true, response.Usage))
+}
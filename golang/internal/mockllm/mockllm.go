@@ -0,0 +1,377 @@
+// Package mockllm is a scriptable stand-in for the Gemini, OpenAI and
+// Anthropic HTTP APIs, for running the clients in this module offline.
+//
+// A Fixture lists the requests the server expects, in order, and the
+// response to each. Responses may contain text, function calls and usage, and
+// are streamed when the client asks for a stream. Requests that do not match
+// the next expectation get an HTTP 400 and are recorded as failures.
+//
+// Point a client at the server with GEMINI_BASE_URL, OPENAI_BASE_URL or
+// ANTHROPIC_BASE_URL. The server answers on the paths of all three APIs:
+//
+//	POST /v1beta/models/{model}:generateContent
+//	POST /v1beta/models/{model}:streamGenerateContent
+//	POST /v1/chat/completions
+//	POST /v1/messages
+package mockllm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// APIs a request can arrive through.
+const (
+	Gemini    = "gemini"
+	OpenAI    = "openai"
+	Anthropic = "anthropic"
+)
+
+// Fixture scripts a conversation.
+type Fixture struct {
+	Exchanges []Exchange `json:"exchanges"`
+}
+
+// Exchange is one expected request and the response to it.
+type Exchange struct {
+	Expect   Expect   `json:"expect"`
+	Response Response `json:"response"`
+}
+
+// Expect describes a request. Empty fields match anything.
+type Expect struct {
+	// API is gemini, openai or anthropic.
+	API    string `json:"api,omitempty"`
+	Model  string `json:"model,omitempty"`
+	Stream *bool  `json:"stream,omitempty"`
+	// Messages is the number of messages in the request, not counting the
+	// system prompt.
+	Messages int `json:"messages,omitempty"`
+	// Contains are substrings of the last message, including the JSON of any
+	// function responses in it.
+	Contains []string `json:"contains,omitempty"`
+	// SystemContains are substrings of the system prompt.
+	SystemContains []string `json:"system_contains,omitempty"`
+	// Tools are function names that must be declared, as sent on the wire.
+	Tools []string `json:"tools,omitempty"`
+	// FunctionResponses are the names of the functions the last message
+	// answers, in order.
+	FunctionResponses []string `json:"function_responses,omitempty"`
+}
+
+// Response is what the server answers.
+type Response struct {
+	Text string `json:"text,omitempty"`
+	// Chunks splits Text when streaming; by default it is sent in one chunk.
+	Chunks        []string       `json:"chunks,omitempty"`
+	FunctionCalls []FunctionCall `json:"function_calls,omitempty"`
+	Usage         *Usage         `json:"usage,omitempty"`
+	// Status, when set, makes the server fail the request with this HTTP
+	// status and Error as the message.
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Headers are added to the HTTP response, e.g. Retry-After.
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// FunctionCall is a function call in a response, named as on the wire.
+type FunctionCall struct {
+	Name string         `json:"name"`
+	Args map[string]any `json:"args,omitempty"`
+}
+
+// Usage is the token usage reported with a response.
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+}
+
+// Request is a model request as the server understood it, whichever API it
+// came through.
+type Request struct {
+	API      string
+	Model    string
+	Stream   bool
+	System   string
+	Messages []Message
+	Tools    []string
+}
+
+// Message is a message of a request. Role is user, model or tool; OpenAI tool
+// messages answering the same assistant message are merged into one.
+type Message struct {
+	Role              string
+	Text              string
+	FunctionCalls     []FunctionCall
+	FunctionResponses []FunctionResponse
+}
+
+// FunctionResponse is the result of a function call sent back to the model.
+type FunctionResponse struct {
+	Name     string
+	Response json.RawMessage
+}
+
+// Load reads a fixture from a JSON file.
+func Load(path string) (*Fixture, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fixture: %v", err)
+	}
+	var fixture Fixture
+	if err := json.Unmarshal(data, &fixture); err != nil {
+		return nil, fmt.Errorf("failed to parse fixture %s: %v", path, err)
+	}
+	return &fixture, nil
+}
+
+// Server serves a fixture. It is an http.Handler; use it with httptest or
+// http.ListenAndServe.
+type Server struct {
+	// Loop restarts the fixture once every exchange has been served.
+	Loop bool
+	// Logf, if set, is told about every request and failure.
+	Logf func(format string, args ...any)
+
+	mu       sync.Mutex
+	fixture  *Fixture
+	next     int
+	requests []Request
+	failures []string
+}
+
+// NewServer returns a server for fixture.
+func NewServer(fixture *Fixture) *Server {
+	return &Server{fixture: fixture}
+}
+
+// Requests returns the requests received so far.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// Failures returns a description of every request that did not match its
+// expectation or came after the fixture ran out.
+func (s *Server) Failures() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.failures...)
+}
+
+// Remaining returns how many exchanges have not been served yet.
+func (s *Server) Remaining() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.fixture.Exchanges) - s.next
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "mockllm: only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	var api, model string
+	stream := false
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1beta/models/"):
+		api = Gemini
+		var method string
+		model, method, _ = strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1beta/models/"), ":")
+		stream = method == "streamGenerateContent"
+	case strings.HasSuffix(r.URL.Path, "/chat/completions"):
+		api = OpenAI
+	case strings.HasSuffix(r.URL.Path, "/messages"):
+		api = Anthropic
+	default:
+		http.Error(w, "mockllm: unknown endpoint "+r.URL.Path, http.StatusNotFound)
+		return
+	}
+
+	var request Request
+	var err error
+	switch api {
+	case Gemini:
+		request, err = parseGemini(r.Body)
+		request.Model, request.Stream = model, stream
+	case OpenAI:
+		request, err = parseOpenAI(r.Body)
+	case Anthropic:
+		request, err = parseAnthropic(r.Body)
+	}
+	request.API = api
+	if err != nil {
+		s.fail(w, api, http.StatusBadRequest, fmt.Sprintf("mockllm: invalid %s request: %v", api, err))
+		return
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, request)
+	if s.next == len(s.fixture.Exchanges) && s.Loop {
+		s.next = 0
+	}
+	if s.next == len(s.fixture.Exchanges) {
+		s.mu.Unlock()
+		s.fail(w, api, http.StatusInternalServerError, fmt.Sprintf("mockllm: unexpected request %d, the fixture has only %d exchanges", len(s.requests), len(s.fixture.Exchanges)))
+		return
+	}
+	exchange := s.fixture.Exchanges[s.next]
+	s.next++
+	number := s.next
+	s.mu.Unlock()
+	s.logf("request %d: %s %s, %d message(s), stream=%v", number, api, request.Model, len(request.Messages), request.Stream)
+
+	if problems := exchange.Expect.check(request); len(problems) > 0 {
+		s.fail(w, api, http.StatusBadRequest, fmt.Sprintf("mockllm: request %d does not match the fixture: %s", number, strings.Join(problems, "; ")))
+		return
+	}
+	response := exchange.Response
+	for key, value := range response.Headers {
+		w.Header().Set(key, value)
+	}
+	if response.Status != 0 {
+		writeError(w, api, response.Status, response.Error)
+		return
+	}
+	switch api {
+	case Gemini:
+		writeGemini(w, response, request.Stream)
+	case OpenAI:
+		writeOpenAI(w, response, request.Stream)
+	case Anthropic:
+		writeAnthropic(w, response, request.Stream)
+	}
+}
+
+func (s *Server) fail(w http.ResponseWriter, api string, status int, message string) {
+	s.mu.Lock()
+	s.failures = append(s.failures, message)
+	s.mu.Unlock()
+	s.logf("%s", message)
+	writeError(w, api, status, message)
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.Logf != nil {
+		s.Logf(format, args...)
+	}
+}
+
+// check returns how request differs from the expectation.
+func (e Expect) check(request Request) []string {
+	var problems []string
+	if e.API != "" && e.API != request.API {
+		problems = append(problems, fmt.Sprintf("api is %s, want %s", request.API, e.API))
+	}
+	if e.Model != "" && e.Model != request.Model {
+		problems = append(problems, fmt.Sprintf("model is %q, want %q", request.Model, e.Model))
+	}
+	if e.Stream != nil && *e.Stream != request.Stream {
+		problems = append(problems, fmt.Sprintf("stream is %v, want %v", request.Stream, *e.Stream))
+	}
+	if e.Messages != 0 && e.Messages != len(request.Messages) {
+		problems = append(problems, fmt.Sprintf("%d messages, want %d", len(request.Messages), e.Messages))
+	}
+	var last Message
+	if len(request.Messages) > 0 {
+		last = request.Messages[len(request.Messages)-1]
+	}
+	lastText := last.Text
+	for _, response := range last.FunctionResponses {
+		lastText += "\n" + string(response.Response)
+	}
+	for _, want := range e.Contains {
+		if !strings.Contains(lastText, want) {
+			problems = append(problems, fmt.Sprintf("last message does not contain %q", want))
+		}
+	}
+	for _, want := range e.SystemContains {
+		if !strings.Contains(request.System, want) {
+			problems = append(problems, fmt.Sprintf("system prompt does not contain %q", want))
+		}
+	}
+	for _, want := range e.Tools {
+		found := false
+		for _, tool := range request.Tools {
+			found = found || tool == want
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("tool %q is not declared (have %s)", want, strings.Join(request.Tools, ", ")))
+		}
+	}
+	if e.FunctionResponses != nil {
+		var names []string
+		for _, response := range last.FunctionResponses {
+			names = append(names, response.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(e.FunctionResponses, ",") {
+			problems = append(problems, fmt.Sprintf("last message answers [%s], want [%s]", strings.Join(names, ", "), strings.Join(e.FunctionResponses, ", ")))
+		}
+	}
+	return problems
+}
+
+// writeError fails a request the way the API would.
+func writeError(w http.ResponseWriter, api string, status int, message string) {
+	body := map[string]any{"code": status, "message": message}
+	if api == Anthropic {
+		body = map[string]any{"type": "api_error", "message": message}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"error": body})
+}
+
+// textChunks returns the pieces a streamed text is sent in.
+func (r Response) textChunks() []string {
+	if len(r.Chunks) > 0 {
+		return r.Chunks
+	}
+	if r.Text == "" {
+		return nil
+	}
+	return []string{r.Text}
+}
+
+// text returns the full text of the response.
+func (r Response) text() string {
+	if r.Text == "" {
+		return strings.Join(r.Chunks, "")
+	}
+	return r.Text
+}
+
+// eventStream writes server-sent events.
+type eventStream struct {
+	w http.ResponseWriter
+}
+
+func newEventStream(w http.ResponseWriter) eventStream {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	return eventStream{w: w}
+}
+
+// send writes one event carrying v as JSON, with an event name if event is
+// not empty.
+func (s eventStream) send(event string, v any) {
+	data, _ := json.Marshal(v)
+	if event != "" {
+		fmt.Fprintf(s.w, "event: %s\n", event)
+	}
+	fmt.Fprintf(s.w, "data: %s\n\n", data)
+	if flusher, ok := s.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
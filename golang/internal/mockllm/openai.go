@@ -0,0 +1,184 @@
+package mockllm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+func parseOpenAI(body io.Reader) (Request, error) {
+	var wire struct {
+		Model    string `json:"model"`
+		Stream   bool   `json:"stream"`
+		Messages []struct {
+			Role      string          `json:"role"`
+			Content   json.RawMessage `json:"content"`
+			ToolCalls []struct {
+				ID       string `json:"id"`
+				Function struct {
+					Name      string `json:"name"`
+					Arguments string `json:"arguments"`
+				} `json:"function"`
+			} `json:"tool_calls"`
+			ToolCallID string `json:"tool_call_id"`
+		} `json:"messages"`
+		Tools []struct {
+			Function struct {
+				Name string `json:"name"`
+			} `json:"function"`
+		} `json:"tools"`
+	}
+	if err := json.NewDecoder(body).Decode(&wire); err != nil {
+		return Request{}, err
+	}
+	request := Request{Model: wire.Model, Stream: wire.Stream}
+	for _, tool := range wire.Tools {
+		request.Tools = append(request.Tools, tool.Function.Name)
+	}
+	callNames := make(map[string]string)
+	for _, message := range wire.Messages {
+		text, err := openAIText(message.Content)
+		if err != nil {
+			return Request{}, err
+		}
+		switch message.Role {
+		case "system", "developer":
+			request.System = strings.TrimPrefix(request.System+"\n"+text, "\n")
+		case "tool":
+			response := FunctionResponse{Name: callNames[message.ToolCallID], Response: json.RawMessage(text)}
+			if !json.Valid(response.Response) {
+				response.Response, _ = json.Marshal(text)
+			}
+			if n := len(request.Messages); n > 0 && request.Messages[n-1].Role == "tool" {
+				request.Messages[n-1].FunctionResponses = append(request.Messages[n-1].FunctionResponses, response)
+				continue
+			}
+			request.Messages = append(request.Messages, Message{Role: "tool", FunctionResponses: []FunctionResponse{response}})
+		default:
+			converted := Message{Role: message.Role, Text: text}
+			if message.Role == "assistant" {
+				converted.Role = "model"
+			}
+			for _, call := range message.ToolCalls {
+				callNames[call.ID] = call.Function.Name
+				var args map[string]any
+				if err := json.Unmarshal([]byte(call.Function.Arguments), &args); err != nil {
+					return Request{}, fmt.Errorf("arguments of tool call %s: %v", call.ID, err)
+				}
+				converted.FunctionCalls = append(converted.FunctionCalls, FunctionCall{Name: call.Function.Name, Args: args})
+			}
+			request.Messages = append(request.Messages, converted)
+		}
+	}
+	return request, nil
+}
+
+// openAIText returns the text of message content, which is a string or a
+// list of parts.
+func openAIText(content json.RawMessage) (string, error) {
+	if len(content) == 0 || string(content) == "null" {
+		return "", nil
+	}
+	var text string
+	if err := json.Unmarshal(content, &text); err == nil {
+		return text, nil
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(content, &parts); err != nil {
+		return "", fmt.Errorf("invalid message content: %v", err)
+	}
+	var texts []string
+	for _, part := range parts {
+		if part.Type == "text" {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n"), nil
+}
+
+func openAIToolCalls(calls []FunctionCall, stream bool) []map[string]any {
+	var toolCalls []map[string]any
+	for i, call := range calls {
+		args, _ := json.Marshal(call.Args)
+		if call.Args == nil {
+			args = []byte("{}")
+		}
+		toolCall := map[string]any{
+			"id":       fmt.Sprintf("call_%d", i+1),
+			"type":     "function",
+			"function": map[string]any{"name": call.Name, "arguments": string(args)},
+		}
+		if stream {
+			toolCall["index"] = i
+		}
+		toolCalls = append(toolCalls, toolCall)
+	}
+	return toolCalls
+}
+
+func openAIUsage(usage *Usage) map[string]any {
+	return map[string]any{
+		"prompt_tokens":     usage.PromptTokens,
+		"completion_tokens": usage.CompletionTokens,
+		"total_tokens":      usage.PromptTokens + usage.CompletionTokens,
+	}
+}
+
+func writeOpenAI(w http.ResponseWriter, response Response, stream bool) {
+	finishReason := "stop"
+	if len(response.FunctionCalls) > 0 {
+		finishReason = "tool_calls"
+	}
+	if !stream {
+		message := map[string]any{"role": "assistant", "content": nil}
+		if text := response.text(); text != "" {
+			message["content"] = text
+		}
+		if len(response.FunctionCalls) > 0 {
+			message["tool_calls"] = openAIToolCalls(response.FunctionCalls, false)
+		}
+		body := map[string]any{
+			"object":  "chat.completion",
+			"choices": []any{map[string]any{"index": 0, "message": message, "finish_reason": finishReason}},
+		}
+		if response.Usage != nil {
+			body["usage"] = openAIUsage(response.Usage)
+		}
+		writeJSON(w, body)
+		return
+	}
+
+	events := newEventStream(w)
+	delta := func(delta map[string]any, finishReason any) map[string]any {
+		return map[string]any{
+			"object":  "chat.completion.chunk",
+			"choices": []any{map[string]any{"index": 0, "delta": delta, "finish_reason": finishReason}},
+		}
+	}
+	events.send("", delta(map[string]any{"role": "assistant"}, nil))
+	for _, chunk := range response.textChunks() {
+		events.send("", delta(map[string]any{"content": chunk}, nil))
+	}
+	// Send each tool call's arguments in two pieces, as OpenAI splits them.
+	for _, toolCall := range openAIToolCalls(response.FunctionCalls, true) {
+		function := toolCall["function"].(map[string]any)
+		args := function["arguments"].(string)
+		half := len(args) / 2
+		function["arguments"] = args[:half]
+		events.send("", delta(map[string]any{"tool_calls": []any{toolCall}}, nil))
+		events.send("", delta(map[string]any{"tool_calls": []any{map[string]any{
+			"index":    toolCall["index"],
+			"function": map[string]any{"arguments": args[half:]},
+		}}}, nil))
+	}
+	events.send("", delta(map[string]any{}, finishReason))
+	if response.Usage != nil {
+		events.send("", map[string]any{"object": "chat.completion.chunk", "choices": []any{}, "usage": openAIUsage(response.Usage)})
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+}
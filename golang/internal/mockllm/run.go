@@ -0,0 +1,36 @@
+package mockllm
+
+import (
+	"io"
+	"os"
+	"testing"
+)
+
+// RunMain runs a client's main function with input on stdin and returns what
+// it printed to stdout, for testing the chat loops of the clients against a
+// Server.
+func RunMain(t testing.TB, main func(), input string) string {
+	t.Helper()
+	stdin, err := os.CreateTemp(t.TempDir(), "stdin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin.WriteString(input)
+	stdin.Seek(0, io.SeekStart)
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStdin, oldStdout := os.Stdin, os.Stdout
+	os.Stdin, os.Stdout = stdin, writer
+	defer func() { os.Stdin, os.Stdout = oldStdin, oldStdout }()
+
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(reader)
+		output <- string(data)
+	}()
+	main()
+	writer.Close()
+	return <-output
+}
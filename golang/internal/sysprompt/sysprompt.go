@@ -0,0 +1,87 @@
+// Package sysprompt loads and renders the system prompt shared by the chat
+// clients in this module.
+//
+// A system prompt is a text/template. It can use these variables:
+//
+//	{{.Date}}   the current date, e.g. 2025-08-05
+//	{{.Time}}   the current local time, e.g. 15:04
+//	{{.Cwd}}    the working directory of the client
+//	{{.OS}}     the operating system the client runs on
+//	{{.Tools}}  the available tools, each with a .Name and .Description
+package sysprompt
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"text/template"
+	"time"
+)
+
+// EnvFile names the environment variable holding the path of a system prompt
+// template to use instead of Default.
+const EnvFile = "SYSTEM_PROMPT_FILE"
+
+// Default is the system prompt used unless another template is configured.
+const Default = `You are a helpful AI assistant{{if .Tools}} connected to multiple external systems via MCP tools{{end}}.
+The current date is {{.Date}}.
+{{- if .Tools}}
+You can use tools to help users with their requests.
+{{- end}}
+Always be helpful and provide clear, accurate responses.`
+
+// Tool describes a tool for the {{.Tools}} variable.
+type Tool struct {
+	Name        string
+	Description string
+}
+
+// Vars are the variables available to a template.
+type Vars struct {
+	Date  string
+	Time  string
+	Cwd   string
+	OS    string
+	Tools []Tool
+}
+
+// Load returns the template in path, or Default if path is empty.
+func Load(path string) (string, error) {
+	if path == "" {
+		return Default, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read system prompt: %v", err)
+	}
+	return string(data), nil
+}
+
+// LoadFromEnv returns the template named by SYSTEM_PROMPT_FILE, or Default.
+func LoadFromEnv() (string, error) {
+	return Load(os.Getenv(EnvFile))
+}
+
+// Render executes a template with the current date, working directory and
+// operating system, and the given tools.
+func Render(text string, tools []Tool) (string, error) {
+	tmpl, err := template.New("system prompt").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid system prompt template: %v", err)
+	}
+	now := time.Now()
+	cwd, _ := os.Getwd()
+	vars := Vars{
+		Date:  now.Format("2006-01-02"),
+		Time:  now.Format("15:04"),
+		Cwd:   cwd,
+		OS:    runtime.GOOS,
+		Tools: tools,
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, vars); err != nil {
+		return "", fmt.Errorf("failed to render system prompt: %v", err)
+	}
+	return b.String(), nil
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"log"
+	"os"
+	"os/exec"
 
 	"github.com/modelcontextprotocol/go-sdk/mcp"
 )
@@ -10,7 +12,17 @@ import (
 func main() {
 	ctx := context.Background()
 	client := mcp.NewClient(&mcp.Implementation{Name: "mcp-client", Version: "v25.8.0"}, nil)
-	transport := mcp.NewStreamableClientTransport("http://localhost:8080/mcp", nil)
+	// With no arguments, talk to the streamable HTTP server on :8080. Otherwise
+	// the arguments are a command to spawn as an MCP server over stdio, e.g.
+	// `mcpclient python mcp_shell_server.py`; its stderr goes to our log.
+	var transport mcp.Transport
+	if len(os.Args) > 1 {
+		cmd := exec.Command(os.Args[1], os.Args[2:]...)
+		cmd.Stderr = log.Writer()
+		transport = mcp.NewCommandTransport(cmd)
+	} else {
+		transport = mcp.NewStreamableClientTransport("http://localhost:8080/mcp", nil)
+	}
 	session, err := client.Connect(ctx, transport)
 	if err != nil {
 		log.Fatal(err)
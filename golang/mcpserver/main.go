@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+var (
+	transport = flag.String("transport", "http", "transport to serve on: 'http' (streamable HTTP) or 'stdio'")
+	addr      = flag.String("addr", ":8080", "listen address for the streamable HTTP transport")
+	timeout   = flag.Duration("timeout", 60*time.Second, "default and maximum run time of a shell command")
+	maxOutput = flag.Int("max-output", 64*1024, "maximum bytes of stdout and of stderr returned per command")
+)
+
+// GetOSInfoArgs are the (empty) arguments of get_os_info.
+type GetOSInfoArgs struct{}
+
+// SetCwdArgs are the arguments of set_cwd.
+type SetCwdArgs struct {
+	Path string `json:"path" jsonschema:"The path to use as the new working directory. Relative paths are resolved against the current one."`
+}
+
+// ExecuteShellArgs are the arguments of execute_shell.
+type ExecuteShellArgs struct {
+	Cmd            string `json:"cmd" jsonschema:"The shell command to execute."`
+	TimeoutSeconds int    `json:"timeout_seconds,omitempty" jsonschema:"Optional time limit in seconds, capped by the server's maximum."`
+}
+
+// ExecuteShellResult is the structured result of execute_shell.
+type ExecuteShellResult struct {
+	Stdout    string `json:"stdout"`
+	Stderr    string `json:"stderr"`
+	ExitCode  int    `json:"exit_code"`
+	TimedOut  bool   `json:"timed_out,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+	Cwd       string `json:"cwd"`
+}
+
+// shellServer implements the shell tools. Unlike py/mcp_shell_server.py, which
+// keeps one global working directory, each client session gets its own.
+type shellServer struct {
+	defaultCwd string
+	timeout    time.Duration
+	maxOutput  int
+
+	mu   sync.Mutex
+	cwds map[*mcp.ServerSession]string
+}
+
+func newShellServer(defaultCwd string, timeout time.Duration, maxOutput int) *shellServer {
+	return &shellServer{
+		defaultCwd: defaultCwd,
+		timeout:    timeout,
+		maxOutput:  maxOutput,
+		cwds:       make(map[*mcp.ServerSession]string),
+	}
+}
+
+// cwd returns the working directory of the given session.
+func (s *shellServer) cwd(ss *mcp.ServerSession) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cwd, ok := s.cwds[ss]; ok {
+		return cwd
+	}
+	return s.defaultCwd
+}
+
+// setCwd records the working directory of a session, forgetting it once the
+// session ends.
+func (s *shellServer) setCwd(ss *mcp.ServerSession, cwd string) {
+	s.mu.Lock()
+	_, known := s.cwds[ss]
+	s.cwds[ss] = cwd
+	s.mu.Unlock()
+	if !known {
+		go func() {
+			ss.Wait()
+			s.mu.Lock()
+			delete(s.cwds, ss)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+func (s *shellServer) getOSInfo(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[GetOSInfoArgs]) (*mcp.CallToolResultFor[any], error) {
+	log.Printf("Request for OS info received.")
+	return textResult(osName()), nil
+}
+
+func (s *shellServer) setCwdTool(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[SetCwdArgs]) (*mcp.CallToolResultFor[any], error) {
+	path := params.Arguments.Path
+	if path == "" {
+		return nil, errors.New("path is required")
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(s.cwd(ss), path)
+	}
+	path = filepath.Clean(path)
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		log.Printf("Invalid directory: %s", path)
+		return nil, fmt.Errorf("invalid directory: %s", path)
+	}
+	s.setCwd(ss, path)
+	log.Printf("Session %q working directory set to: %s", ss.ID(), path)
+	return textResult("Working directory set to: " + path), nil
+}
+
+func (s *shellServer) executeShell(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[ExecuteShellArgs]) (*mcp.CallToolResultFor[ExecuteShellResult], error) {
+	args := params.Arguments
+	if strings.TrimSpace(args.Cmd) == "" {
+		return nil, errors.New("cmd is required")
+	}
+	limit := s.timeout
+	if args.TimeoutSeconds > 0 && time.Duration(args.TimeoutSeconds)*time.Second < limit {
+		limit = time.Duration(args.TimeoutSeconds) * time.Second
+	}
+	cwd := s.cwd(ss)
+	log.Printf("Executing shell command in %s: %s", cwd, args.Cmd)
+
+	ctx, cancel := context.WithTimeout(ctx, limit)
+	defer cancel()
+	cmd := shellCommand(ctx, args.Cmd)
+	cmd.Dir = cwd
+	killProcessGroup(cmd)
+	// Don't wait forever for pipes held open by background children that
+	// escaped the kill.
+	cmd.WaitDelay = 2 * time.Second
+	stdout := &cappedBuffer{max: s.maxOutput}
+	stderr := &cappedBuffer{max: s.maxOutput}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err := cmd.Run()
+	result := ExecuteShellResult{
+		Stdout:    stdout.String(),
+		Stderr:    stderr.String(),
+		Truncated: stdout.truncated || stderr.truncated,
+		TimedOut:  errors.Is(ctx.Err(), context.DeadlineExceeded),
+		Cwd:       cwd,
+	}
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+	case errors.As(err, &exitErr):
+		result.ExitCode = exitErr.ExitCode()
+	case result.TimedOut:
+		result.ExitCode = -1
+	default:
+		return nil, fmt.Errorf("failed to run command: %v", err)
+	}
+	log.Printf("Command completed with exit code %d (timed out: %v)", result.ExitCode, result.TimedOut)
+
+	return &mcp.CallToolResultFor[ExecuteShellResult]{
+		Content:           []mcp.Content{&mcp.TextContent{Text: formatShellResult(result, limit)}},
+		StructuredContent: result,
+	}, nil
+}
+
+// shellCommand runs line through the platform shell, like Python's shell=True.
+func shellCommand(ctx context.Context, line string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", line)
+	}
+	return exec.CommandContext(ctx, "/bin/sh", "-c", line)
+}
+
+func formatShellResult(r ExecuteShellResult, limit time.Duration) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "exit code: %d\n", r.ExitCode)
+	if r.TimedOut {
+		fmt.Fprintf(&b, "command timed out after %v\n", limit)
+	}
+	if r.Truncated {
+		b.WriteString("output was truncated\n")
+	}
+	fmt.Fprintf(&b, "stdout:\n%s\nstderr:\n%s", r.Stdout, r.Stderr)
+	return b.String()
+}
+
+// cappedBuffer keeps at most max bytes, silently discarding the rest so that
+// a chatty command cannot exhaust memory or flood the model's context.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	if room := c.max - c.buf.Len(); room < len(p) {
+		c.truncated = true
+		if room > 0 {
+			c.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return c.buf.Write(p)
+}
+
+func (c *cappedBuffer) String() string {
+	return c.buf.String()
+}
+
+func textResult(text string) *mcp.CallToolResultFor[any] {
+	return &mcp.CallToolResultFor[any]{Content: []mcp.Content{&mcp.TextContent{Text: text}}}
+}
+
+// osName returns the OS name the way Python's platform.system() does.
+func osName() string {
+	switch runtime.GOOS {
+	case "linux":
+		return "Linux"
+	case "darwin":
+		return "Darwin"
+	case "windows":
+		return "Windows"
+	default:
+		return runtime.GOOS
+	}
+}
+
+// newServer returns an MCP server offering the shell tools.
+func newServer(shell *shellServer) *mcp.Server {
+	server := mcp.NewServer(&mcp.Implementation{Name: "Shell", Version: "v1.0.0"}, nil)
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "get_os_info",
+		Description: `Get the operating system of the server (e.g. "Linux", "Windows", "Darwin").`,
+	}, shell.getOSInfo)
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "set_cwd",
+		Description: "Set the working directory for shell commands in this session.",
+	}, shell.setCwdTool)
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "execute_shell",
+		Description: "Run a shell command in the session's working directory and return its exit code, stdout and stderr.",
+	}, shell.executeShell)
+	return server
+}
+
+func main() {
+	flag.Parse()
+	// stdout carries the protocol in stdio mode, so always log to stderr.
+	log.SetOutput(os.Stderr)
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		log.Fatalf("Failed to get working directory: %v", err)
+	}
+	server := newServer(newShellServer(cwd, *timeout, *maxOutput))
+
+	switch *transport {
+	case "stdio":
+		log.Printf("MCP Shell server running on stdio (cwd %s)", cwd)
+		if err := server.Run(context.Background(), mcp.NewStdioTransport()); err != nil {
+			log.Fatalf("Server failed: %v", err)
+		}
+	case "http":
+		handler := mcp.NewStreamableHTTPHandler(func(*http.Request) *mcp.Server {
+			return server
+		}, nil)
+		mux := http.NewServeMux()
+		mux.Handle("/mcp", handler)
+		log.Printf("MCP Shell server listening at http://%s/mcp (cwd %s)", *addr, cwd)
+		if err := http.ListenAndServe(*addr, mux); err != nil {
+			log.Fatalf("Server failed: %v", err)
+		}
+	default:
+		log.Fatalf("Unknown transport %q, want 'http' or 'stdio'", *transport)
+	}
+}
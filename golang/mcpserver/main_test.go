@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// connect returns a client session of a server offering shell's tools.
+func connect(t *testing.T, shell *shellServer) *mcp.ClientSession {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the tests run /bin/sh commands")
+	}
+	ctx := context.Background()
+	serverTransport, clientTransport := mcp.NewInMemoryTransports()
+	if _, err := newServer(shell).Connect(ctx, serverTransport); err != nil {
+		t.Fatalf("server.Connect: %v", err)
+	}
+	session, err := mcp.NewClient(&mcp.Implementation{Name: "test", Version: "v1.0.0"}, nil).Connect(ctx, clientTransport)
+	if err != nil {
+		t.Fatalf("client.Connect: %v", err)
+	}
+	t.Cleanup(func() { session.Close() })
+	return session
+}
+
+func call(t *testing.T, session *mcp.ClientSession, name string, args map[string]any) *mcp.CallToolResult {
+	t.Helper()
+	result, err := session.CallTool(context.Background(), &mcp.CallToolParams{Name: name, Arguments: args})
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	if result.IsError {
+		t.Fatalf("%s failed: %+v", name, result.Content[0])
+	}
+	return result
+}
+
+func execute(t *testing.T, session *mcp.ClientSession, cmd string) ExecuteShellResult {
+	t.Helper()
+	data, err := json.Marshal(call(t, session, "execute_shell", map[string]any{"cmd": cmd}).StructuredContent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result ExecuteShellResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		t.Fatalf("execute_shell returned %s: %v", data, err)
+	}
+	return result
+}
+
+func TestWorkingDirectoryPerSession(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	shell := newShellServer(root, 10*time.Second, 1024)
+	first, second := connect(t, shell), connect(t, shell)
+
+	call(t, first, "set_cwd", map[string]any{"path": "sub"})
+	if got := execute(t, first, "pwd"); strings.TrimSpace(got.Stdout) != filepath.Join(root, "sub") || got.Cwd != filepath.Join(root, "sub") {
+		t.Errorf("first session runs in %q (cwd %q), want %s/sub", got.Stdout, got.Cwd, root)
+	}
+	if got := execute(t, second, "pwd"); strings.TrimSpace(got.Stdout) != root {
+		t.Errorf("second session runs in %q, want %s", got.Stdout, root)
+	}
+
+	result, err := first.CallTool(context.Background(), &mcp.CallToolParams{Name: "set_cwd", Arguments: map[string]any{"path": "missing"}})
+	if err == nil && !result.IsError {
+		t.Error("set_cwd accepted a missing directory")
+	}
+
+	first.Close()
+	// The server forgets a session's directory once it ends.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		shell.mu.Lock()
+		remaining := len(shell.cwds)
+		shell.mu.Unlock()
+		if remaining == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d working directories left after the session closed", remaining)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOutputIsCapped(t *testing.T) {
+	session := connect(t, newShellServer(t.TempDir(), 10*time.Second, 10))
+	got := execute(t, session, "echo 0123456789abcdef; echo fedcba9876543210 >&2; exit 3")
+	if got.Stdout != "0123456789" || got.Stderr != "fedcba9876" || !got.Truncated || got.ExitCode != 3 {
+		t.Errorf("execute_shell = %+v, want 10 bytes of each stream, truncated, exit code 3", got)
+	}
+	if got := execute(t, session, "echo short"); got.Stdout != "short\n" || got.Truncated {
+		t.Errorf("execute_shell = %+v, want untruncated output", got)
+	}
+}
+
+func TestTimeoutKillsBackgroundChildren(t *testing.T) {
+	dir := t.TempDir()
+	session := connect(t, newShellServer(dir, 300*time.Millisecond, 1024))
+	start := time.Now()
+	got := execute(t, session, "(sleep 1; touch late) & sleep 30")
+	if !got.TimedOut || got.ExitCode != -1 {
+		t.Errorf("execute_shell = %+v, want a timeout", got)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("execute_shell returned after %v", elapsed)
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+	if _, err := os.Stat(filepath.Join(dir, "late")); err == nil {
+		t.Error("a background child outlived the timeout")
+	}
+}
@@ -0,0 +1,7 @@
+package main
+
+import "os/exec"
+
+// killProcessGroup leaves cmd as it is: Windows has no process groups to
+// signal, so only the shell itself is killed.
+func killProcessGroup(cmd *exec.Cmd) {}
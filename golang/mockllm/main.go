@@ -0,0 +1,44 @@
+// Command mockllm serves a fixture of scripted model responses on the Gemini,
+// OpenAI and Anthropic APIs, so that the clients in this module can run
+// without an API key or network:
+//
+//	go run ./mockllm -fixture mockllm/example.json &
+//	GEMINI_BASE_URL=http://127.0.0.1:8089 go run ./gemini-mcp-client
+//
+// See package gemini-mcp-bash/internal/mockllm for the fixture format.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+
+	"gemini-mcp-bash/internal/mockllm"
+)
+
+var (
+	addr    = flag.String("addr", "127.0.0.1:8089", "listen address")
+	fixture = flag.String("fixture", "", "JSON file with the expected requests and canned responses")
+	loop    = flag.Bool("loop", false, "start the fixture over once every exchange has been served")
+)
+
+func main() {
+	flag.Parse()
+	if *fixture == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	script, err := mockllm.Load(*fixture)
+	if err != nil {
+		log.Fatalf("Failed to load fixture: %v", err)
+	}
+	server := mockllm.NewServer(script)
+	server.Loop = *loop
+	server.Logf = log.Printf
+
+	log.Printf("Mock LLM serving %d exchange(s) from %s at http://%s", len(script.Exchanges), *fixture, *addr)
+	if err := http.ListenAndServe(*addr, server); err != nil {
+		log.Fatalf("Server failed: %v", err)
+	}
+}
@@ -12,6 +12,9 @@ import (
 	"strings"
 	"time"
 
+	"gemini-mcp-bash/internal/httpretry"
+	"gemini-mcp-bash/internal/sysprompt"
+
 	_ "github.com/joho/godotenv/autoload"
 )
 
@@ -30,7 +33,8 @@ const (
 )
 
 type GeminiRequest struct {
-	Contents []Content `json:"contents"`
+	Contents          []Content `json:"contents"`
+	SystemInstruction *Content  `json:"systemInstruction,omitempty"`
 }
 
 type Content struct {
@@ -61,6 +65,16 @@ func main() {
 		model = "gemini-2.5-flash"
 	}
 	url := fmt.Sprintf("%s/v1beta/models/%s:generateContent?key=%s", baseURL, model, apiKey)
+	systemTemplate, err := sysprompt.LoadFromEnv()
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", ColorRed, err, ColorReset)
+		return
+	}
+	retry := httpretry.New(nil)
+	retry.Logf = func(format string, args ...any) {
+		fmt.Printf("\n%s⏳ %s%s\n", ColorYellow, fmt.Sprintf(format, args...), ColorReset)
+	}
+	client := &http.Client{Transport: retry}
 	fmt.Printf("%s%s🤖 Gemini MCP Agent Ready%s\n", ColorBold, ColorPurple, ColorReset)
 	fmt.Printf("%sType 'exit' to quit%s\n\n", ColorGray, ColorReset)
 
@@ -87,6 +101,11 @@ func main() {
 			Role:  "user",
 		})
 		reqBody := GeminiRequest{Contents: conversation}
+		if systemPrompt, err := sysprompt.Render(systemTemplate, nil); err != nil {
+			fmt.Printf("%sWarning: %v%s\n", ColorYellow, err, ColorReset)
+		} else {
+			reqBody.SystemInstruction = &Content{Parts: []Part{{Text: systemPrompt}}}
+		}
 		jsonData, err := json.Marshal(reqBody)
 		if err != nil {
 			fmt.Printf("%sError: %v%s\n", ColorRed, err, ColorReset)
@@ -100,7 +119,6 @@ func main() {
 			continue
 		}
 		req.Header.Set("Content-Type", "application/json")
-		client := &http.Client{}
 		resp, err := client.Do(req)
 		if err != nil {
 			fmt.Printf("%sError: %v%s\n", ColorRed, err, ColorReset)
@@ -113,7 +131,7 @@ func main() {
 			continue
 		}
 		if resp.StatusCode != http.StatusOK {
-			fmt.Printf("%sError: HTTP %d - %s%s\n", ColorRed, resp.StatusCode, string(body), ColorReset)
+			fmt.Printf("%sError: %v%s\n", ColorRed, httpretry.NewStatusError(resp, body), ColorReset)
 			continue
 		}
 		var geminiResp GeminiResponse
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gemini-mcp-bash/internal/mockllm"
+)
+
+func TestChatKeepsConversation(t *testing.T) {
+	fixture := &mockllm.Fixture{Exchanges: []mockllm.Exchange{
+		{
+			Expect: mockllm.Expect{
+				API:            mockllm.Gemini,
+				Model:          "test-model",
+				Messages:       1,
+				Contains:       []string{"hello"},
+				SystemContains: []string{"The current date is"},
+			},
+			Response: mockllm.Response{Text: "Hi there!"},
+		},
+		{
+			Expect:   mockllm.Expect{Messages: 3, Contains: []string{"how are you"}},
+			Response: mockllm.Response{Status: 429, Error: "slow down", Headers: map[string]string{"Retry-After": "0"}},
+		},
+		{
+			Expect:   mockllm.Expect{Messages: 3, Contains: []string{"how are you"}},
+			Response: mockllm.Response{Text: "Fine, thanks."},
+		},
+		{
+			Expect:   mockllm.Expect{Messages: 5},
+			Response: mockllm.Response{Status: 503, Error: "overloaded"},
+		},
+		{
+			Expect:   mockllm.Expect{Messages: 5},
+			Response: mockllm.Response{Status: 500, Error: "backend down"},
+		},
+	}}
+	mock := mockllm.NewServer(fixture)
+	server := httptest.NewServer(mock)
+	defer server.Close()
+	t.Setenv("GEMINI_BASE_URL", server.URL)
+	t.Setenv("GEMINI_API_KEY", "test")
+	t.Setenv("GEMINI_MODEL", "test-model")
+	t.Setenv("SYSTEM_PROMPT_FILE", "")
+	t.Setenv("LLM_MAX_RETRIES", "1")
+	t.Setenv("LLM_RETRY_BASE_DELAY", "1ms")
+
+	output := mockllm.RunMain(t, main, "hello\nhow are you\nstill there?\nexit\n")
+
+	for _, failure := range mock.Failures() {
+		t.Error(failure)
+	}
+	for _, want := range []string{"Hi there!", "retrying", "Fine, thanks.", "HTTP 500", "backend down", "gave up after 2 attempts", "Goodbye!"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("output does not contain %q:\n%s", want, output)
+		}
+	}
+	if n := mock.Remaining(); n != 0 {
+		t.Errorf("%d exchange(s) were not requested", n)
+	}
+}
@@ -2,10 +2,19 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"net/url"
 	"os"
 	"strings"
+	"time"
+
+	"gemini-mcp-bash/internal/httpretry"
+	"gemini-mcp-bash/internal/sysprompt"
 
 	_ "github.com/joho/godotenv/autoload"
 	"github.com/liuzl/ai"
@@ -25,6 +34,10 @@ const (
 	ColorReset  = "\033[0m"
 )
 
+// attemptTimeout is how long a model request may take to answer, each time it
+// is sent.
+const attemptTimeout = 30 * time.Second
+
 func main() {
 	provider := os.Getenv("AI_PROVIDER")
 	var apiKey, baseURL string
@@ -45,9 +58,32 @@ func main() {
 		return
 	}
 
-	client, err := ai.NewClient(ai.WithProvider(provider), ai.WithAPIKey(apiKey), ai.WithBaseURL(baseURL))
+	// Each attempt gets its own time limit; a client timeout would span all
+	// the retries and their delays.
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.ResponseHeaderTimeout = attemptTimeout
+	retry := httpretry.New(base)
+	retry.Logf = func(format string, args ...any) {
+		fmt.Printf("\n%s⏳ %s%s\n", ColorYellow, fmt.Sprintf(format, args...), ColorReset)
+	}
+	var client ai.Client
+	if provider == "gemini" {
+		client = newGeminiClient(apiKey, baseURL, retry)
+	} else {
+		// The SDK takes no http.Client, so it can only be made to retry
+		// through the default transport it uses.
+		httpretry.WrapDefault().Logf = retry.Logf
+		var err error
+		client, err = ai.NewClient(ai.WithProvider(provider), ai.WithAPIKey(apiKey), ai.WithBaseURL(baseURL))
+		if err != nil {
+			fmt.Printf("Error creating client: %v", err)
+			return
+		}
+	}
+
+	systemTemplate, err := sysprompt.LoadFromEnv()
 	if err != nil {
-		fmt.Printf("Error creating client: %v", err)
+		fmt.Printf("%sError: %v%s\n", ColorRed, err, ColorReset)
 		return
 	}
 
@@ -74,7 +110,15 @@ func main() {
 
 		Content := ai.Message{Role: "user", Content: userInput}
 		conversation = append(conversation, Content)
-		resp, err := client.Generate(context.Background(), &ai.Request{Model: "gemini-2.5-flash", Messages: conversation})
+		messages := conversation
+		if systemPrompt, err := sysprompt.Render(systemTemplate, nil); err != nil {
+			fmt.Printf("%sWarning: %v%s\n", ColorYellow, err, ColorReset)
+		} else {
+			// The ai package has no system role of its own; OpenAI takes the
+			// message as is, and geminiClient moves it to systemInstruction.
+			messages = append([]ai.Message{{Role: "system", Content: systemPrompt}}, conversation...)
+		}
+		resp, err := client.Generate(context.Background(), &ai.Request{Model: "gemini-2.5-flash", Messages: messages})
 		if err != nil {
 			fmt.Printf("%sError: %v%s\n", ColorRed, err, ColorReset)
 			continue
@@ -88,3 +132,96 @@ func main() {
 		fmt.Println()
 	}
 }
+
+type geminiRequest struct {
+	Contents          []geminiContent `json:"contents"`
+	SystemInstruction *geminiContent  `json:"systemInstruction,omitempty"`
+}
+
+type geminiContent struct {
+	Parts []geminiPart `json:"parts"`
+	Role  string       `json:"role,omitempty"`
+}
+
+type geminiPart struct {
+	Text string `json:"text"`
+}
+
+type geminiResponse struct {
+	Candidates []struct {
+		Content geminiContent `json:"content"`
+	} `json:"candidates"`
+}
+
+// geminiClient is an ai.Client that calls generateContent directly. The ai
+// package's Gemini client cannot set systemInstruction and sends system
+// messages as a leading user turn, so this one lifts them out instead.
+type geminiClient struct {
+	apiKey  string
+	baseURL string
+	http    *http.Client
+}
+
+func newGeminiClient(apiKey, baseURL string, transport http.RoundTripper) *geminiClient {
+	if baseURL == "" {
+		baseURL = "https://generativelanguage.googleapis.com"
+	}
+	return &geminiClient{apiKey: apiKey, baseURL: baseURL, http: &http.Client{Transport: transport}}
+}
+
+// Generate sends the text of req's messages, with any system messages joined
+// into the system instruction.
+func (c *geminiClient) Generate(ctx context.Context, req *ai.Request) (*ai.Response, error) {
+	var body geminiRequest
+	var system []string
+	for _, msg := range req.Messages {
+		switch msg.Role {
+		case "system":
+			system = append(system, msg.Content)
+		case ai.RoleAssistant, ai.RoleModel:
+			body.Contents = append(body.Contents, geminiContent{Role: "model", Parts: []geminiPart{{Text: msg.Content}}})
+		default:
+			body.Contents = append(body.Contents, geminiContent{Role: "user", Parts: []geminiPart{{Text: msg.Content}}})
+		}
+	}
+	if len(system) > 0 {
+		body.SystemInstruction = &geminiContent{Parts: []geminiPart{{Text: strings.Join(system, "\n\n")}}}
+	}
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	endpoint, err := url.JoinPath(c.baseURL, "v1beta", "models", req.Model+":generateContent")
+	if err != nil {
+		return nil, fmt.Errorf("invalid base URL: %v", err)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("x-goog-api-key", c.apiKey)
+	resp, err := c.http.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, httpretry.NewStatusError(resp, respBody)
+	}
+	var geminiResp geminiResponse
+	if err := json.Unmarshal(respBody, &geminiResp); err != nil {
+		return nil, err
+	}
+	var text strings.Builder
+	if len(geminiResp.Candidates) > 0 {
+		for _, part := range geminiResp.Candidates[0].Content.Parts {
+			text.WriteString(part.Text)
+		}
+	}
+	return &ai.Response{Text: text.String()}, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gemini-mcp-bash/internal/mockllm"
+)
+
+func TestChatWithProviders(t *testing.T) {
+	for _, provider := range []struct {
+		name, api, prefix string
+	}{
+		{"gemini", mockllm.Gemini, "GEMINI"},
+		{"openai", mockllm.OpenAI, "OPENAI"},
+	} {
+		t.Run(provider.name, func(t *testing.T) {
+			fixture := &mockllm.Fixture{Exchanges: []mockllm.Exchange{
+				{
+					Expect:   mockllm.Expect{API: provider.api, Contains: []string{"hello"}},
+					Response: mockllm.Response{Text: "Hi from " + provider.name},
+				},
+				{
+					Expect:   mockllm.Expect{API: provider.api, Contains: []string{"busy"}},
+					Response: mockllm.Response{Status: 429, Error: "slow down", Headers: map[string]string{"Retry-After": "0"}},
+				},
+				{
+					Expect:   mockllm.Expect{API: provider.api, Contains: []string{"busy"}},
+					Response: mockllm.Response{Text: "Back again"},
+				},
+				{
+					Expect:   mockllm.Expect{API: provider.api, Contains: []string{"fail"}},
+					Response: mockllm.Response{Status: 400, Error: "bad request"},
+				},
+			}}
+			mock := mockllm.NewServer(fixture)
+			server := httptest.NewServer(mock)
+			defer server.Close()
+			t.Setenv("AI_PROVIDER", provider.name)
+			t.Setenv(provider.prefix+"_BASE_URL", server.URL)
+			t.Setenv(provider.prefix+"_API_KEY", "test")
+			t.Setenv("SYSTEM_PROMPT_FILE", "")
+
+			output := mockllm.RunMain(t, main, "hello\nbusy\nfail\nexit\n")
+
+			for _, failure := range mock.Failures() {
+				t.Error(failure)
+			}
+			for _, want := range []string{"Hi from " + provider.name, "retrying", "Back again", "Error:", "Goodbye!"} {
+				if !strings.Contains(output, want) {
+					t.Errorf("output does not contain %q:\n%s", want, output)
+				}
+			}
+			// The system prompt goes in the system message for OpenAI and in
+			// systemInstruction for Gemini, never as a user turn.
+			requests := mock.Requests()
+			if len(requests) == 0 {
+				t.Fatal("no requests")
+			}
+			first := requests[0]
+			if !strings.Contains(first.System, "helpful AI assistant") {
+				t.Errorf("system prompt not sent as a system instruction: %+v", first)
+			}
+			if len(first.Messages) == 0 || first.Messages[0].Role != "user" || first.Messages[0].Text != "hello" {
+				t.Errorf("messages do not begin with the user's text: %+v", first.Messages)
+			}
+			if n := mock.Remaining(); n != 0 {
+				t.Errorf("%d exchange(s) were not requested", n)
+			}
+		})
+	}
+}